@@ -9,16 +9,16 @@ import (
 	"slices"
 	"strconv"
 	"strings"
-	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+	"github.com/rivo/uniseg"
 	"golang.design/x/clipboard"
 )
 
-type Line struct {
-	text string
-	changed bool
+type Line struct { // cached syntax highlighting for one row of an Edit
 	styles []tcell.Style
 	start_str bool
 	start_str_type rune
@@ -33,18 +33,28 @@ type Edit struct {
 	width int
 	height int
 	
-	buffer []Line
+	buffer *TextBuffer
+	lines []Line // highlighting for the first len(lines) rows
 	
 	toprow int
 	leftchar int
 	cursor Cursor
+	extra_cursors []Cursor // more cursors editing alongside cursor, in multicursor.go
 	use_line_numbers bool
 	
 	current_mode string
 	number_string string
-	
-	UNDO_HISTORY []Snapshot
-	REDO_HISTORY []Snapshot
+	pending_command string // operator and motion keys of a normal mode command still being typed
+	visual_mode string // "v", "V" or "b" (block) while selecting in a visual mode, current_mode stays "n"
+	
+	undo_root *UndoNode
+	undo_current *UndoNode
+	undo_nodes []*UndoNode // every node, oldest first
+	undo_seq int
+	undo_group *UndoStep // the edit session still being recorded
+	undo_cursor Cursor // cursor as of the last key, the start of the next step
+	undo_extra_cursors []Cursor
+	undo_size int
 	
 	is_main bool
 }
@@ -57,20 +67,12 @@ type Cursor struct {
 	preferencial_col int
 }
 
-type Snapshot struct {
-	buffer []Line
-	cursor Cursor
-	time_taken int64
-	fulltext string
-}
-
 var version string = "0.0.1"
 
 var s tcell.Screen
 var current_window string
 var file_name string
 var absolute_path string
-var opening_file string
 var title string
 
 var DEF_STYLE tcell.Style
@@ -105,6 +107,12 @@ var BUTTON_DOWN bool
 
 var SUGGESTIONS []string
 var SELECTED_SUGGESTION int
+var SUGGESTING_FOR string // the start of the word SUGGESTIONS were found for
+
+var FILE_NAMES []string // every name in the file, found in the background for the rows not highlighted yet
+var FILE_NAMES_OF *TextBuffer
+var FILE_NAMES_VERSION int
+var FILE_NAMES_SCANNING bool
 
 var MOVE_DOWN = 1
 var MOVE_UP = 2
@@ -140,6 +148,7 @@ var APP_CONFIG_DIR string
 var titleColor = tcell.NewRGBColor(25, 25, 25)
 var highlightColor = tcell.NewRGBColor(100, 100, 100)
 var lineNumberColor = tcell.NewRGBColor(50, 50, 50)
+var matchColor = tcell.NewRGBColor(80, 70, 30)
 var colorSTRING = tcell.NewRGBColor(127, 173, 94)
 var colorFUNCTION = tcell.NewRGBColor(199, 157, 78)
 var colorKEYWORD = tcell.NewRGBColor(176, 95, 199)
@@ -157,35 +166,22 @@ var CUR_X, CUR_Y int
 var CUR_CURS_X, CUR_CURS_Y int
 
 var USE_CLIP bool
-var CLIP_BUFF string
 
 func emitStr(x, y int, style tcell.Style, str string) {
-	for i, r := range []rune(str) {
-		s.SetContent(x+i, y, r, nil, style)
-	}
-}
-
-func emitStrColored(x, y int, style []tcell.Style, str string) {
-	for i, r := range []rune(str) {
-		s.SetContent(x+i, y, r, nil, style[i])
+	for _, r := range []rune(str) {
+		s.SetContent(x, y, r, nil, style)
+		x += max(runewidth.RuneWidth(r), 1)
 	}
 }
 
 func createEdit() Edit {
 	width, height := s.Size()
 	
-	buffer := make([]Line, 1)
-	old_buffer := make([]string, 1)
-	
 	cursor := Cursor{row: 0, col: 0, row_anchor: 0, col_anchor: 0}
-	buffer[0] = Line{text: "", end_str: false, names: []string{}}
-	old_buffer[0] = ""
 	
-	edit := Edit{row: 1, col: 0, width: width, height: height-1, buffer: buffer, cursor: cursor, toprow: 0, leftchar: 0, use_line_numbers: true, current_mode: "i", number_string: "", is_main: false}
+	edit := Edit{row: 1, col: 0, width: width, height: height-1, buffer: newTextBuffer(""), lines: []Line{}, cursor: cursor, toprow: 0, leftchar: 0, use_line_numbers: true, current_mode: "i", number_string: "", is_main: false}
 	
-	readyUndoHistory(&edit)
-	
-	edit.UNDO_HISTORY[0].time_taken = 0 // ensuring it stays as independant event
+	clearUndoHistory(&edit)
 	
 	return edit
 }
@@ -195,6 +191,7 @@ func setupUI() {
 	
 	MAIN_TEXTEDIT = createEdit()
 	MAIN_TEXTEDIT.is_main = true
+	setupPanes()
 	
 	INPT_TEXTEDIT = createEdit()
 	INPT_TEXTEDIT.width = 30
@@ -210,6 +207,33 @@ func setupUI() {
 	FIND_TEXTEDIT.col = 2
 	FIND_TEXTEDIT.use_line_numbers = false
 	
+	PICKER_TEXTEDIT = createEdit()
+	PICKER_TEXTEDIT.use_line_numbers = false
+	PICKER_TEXTEDIT.current_mode = "n"
+	
+	EXPLORER_TEXTEDIT = createEdit()
+	EXPLORER_TEXTEDIT.use_line_numbers = false
+	EXPLORER_TEXTEDIT.current_mode = "n"
+	
+	FINDER_TEXTEDIT = createEdit()
+	FINDER_TEXTEDIT.use_line_numbers = false
+	
+	FINDER_LIST_TEXTEDIT = createEdit()
+	FINDER_LIST_TEXTEDIT.use_line_numbers = false
+	FINDER_LIST_TEXTEDIT.current_mode = "n"
+	
+	FINDER_PREVIEW_TEXTEDIT = createEdit()
+	FINDER_PREVIEW_TEXTEDIT.current_mode = "n"
+	
+	for _, box := range(getGrepBoxes()) {
+		*box = createEdit()
+		box.use_line_numbers = false
+	}
+	
+	GREP_LIST_TEXTEDIT = createEdit()
+	GREP_LIST_TEXTEDIT.use_line_numbers = false
+	GREP_LIST_TEXTEDIT.current_mode = "n"
+	
 	REPLACE_TEXTEDIT = createEdit()
 	REPLACE_TEXTEDIT.height = 1
 	REPLACE_TEXTEDIT.width = width-4
@@ -217,36 +241,47 @@ func setupUI() {
 	REPLACE_TEXTEDIT.col = 2
 	REPLACE_TEXTEDIT.use_line_numbers = false
 	
+	COMMAND_TEXTEDIT = createEdit()
+	COMMAND_TEXTEDIT.use_line_numbers = false
+	layoutCommandLine(width, height)
+	
 	SHOWING_INPUT_MODAL = false
 	SHOWING_INPUT_BOOL = false
 	CURRENT_SELECTED_BOOL = true
 	CURRENT_TEXT_EDIT = "main"
+	showKeymapError() // from reading it at the start, before there was anywhere to show it
 	
 	redrawFullScreen()
 }
 
 func createNew() {
-	title = "Untitled"
-	file_name = ""
 	setupUI()
+	newUntitledFile()
 }
 
-func checkForStyleUpdates(edit *Edit) {
-	for indx, line := range(edit.buffer) {
+func checkForStyleUpdates(edit *Edit, upto int) {
+	if edit.buffer.first_changed < len(edit.lines) {
+		edit.lines = edit.lines[:edit.buffer.first_changed]
+	}
+	edit.buffer.first_changed = edit.buffer.lineCount()
+	
+	if upto > edit.buffer.lineCount() {
+		upto = edit.buffer.lineCount()
+	}
+	
+	for indx := len(edit.lines); indx < upto; indx++ {
 		var preline Line
 		
 		if indx > 0 {
-			preline = edit.buffer[indx-1]
+			preline = edit.lines[indx-1]
 		}else{
 			preline = Line{}
 		}
 		
-		if !line.changed && line.start_str == preline.end_str && line.start_str_type == preline.end_str_type {
-			continue
-		}
+		line := Line{}
+		text := edit.buffer.line(indx)
 		
 		line.styles = []tcell.Style{}
-		line.changed = false
 		line.names = []string{}
 		line.start_str = preline.end_str
 		line.start_str_type = preline.end_str_type
@@ -262,7 +297,7 @@ func checkForStyleUpdates(edit *Edit) {
 		
 		was_literal := false
 		
-		for indx_c, char := range(line.text) {
+		for indx_c, char := range(text) {
 			is_name := false
 			is_literal := false
 			
@@ -344,6 +379,9 @@ func checkForStyleUpdates(edit *Edit) {
 			was_literal = is_literal
 			
 			prechar = char
+			
+			// styles are indexed by byte, so multi-byte characters repeat their style
+			line.styles = append(line.styles, repeatSlice(line.styles[len(line.styles)-1], utf8.RuneLen(char)-1)...)
 		} //
 		
 		if was_name {
@@ -361,7 +399,7 @@ func checkForStyleUpdates(edit *Edit) {
 		line.end_str = cur_str
 		line.end_str_type = cur_str_type
 		
-		edit.buffer[indx] = line
+		edit.lines = append(edit.lines, line)
 	}
 }
 
@@ -380,16 +418,16 @@ func repeatSlice[T any](s T, n int) []T {
 }
 
 func drawEdit(edit *Edit, is_current bool) {
-	checkForStyleUpdates(edit)
+	checkForStyleUpdates(edit, edit.toprow+edit.height)
 	
 	if edit.is_main {
 		CUR_CURS_X, CUR_CURS_Y = -99, -99
 	}
 	
-	buffer := edit.buffer
+	line_count := edit.buffer.lineCount()
 	cursor := edit.cursor
 	
-	line_num_width := len(strconv.Itoa(len(buffer)))
+	line_num_width := len(strconv.Itoa(line_count))
 	
 	if !edit.use_line_numbers {
 		line_num_width = 0
@@ -402,11 +440,11 @@ func drawEdit(edit *Edit, is_current bool) {
 		
 		line_num := edit.toprow+yraw // 0 based
 		
-		if line_num >= len(buffer) && edit.use_line_numbers{
+		if line_num >= line_count && edit.use_line_numbers{
 			emitStr(edit.col, y, LINE_NUMBER_STYLE, strings.Repeat(" ", line_num_width-1)+"~"+strings.Repeat(" ", edit.width-line_num_width))
 			emitStr(edit.col+line_num_width, y, DEF_STYLE, strings.Repeat(" ", edit.width-line_num_width))
 			continue
-		}else if line_num >= len(buffer){
+		}else if line_num >= line_count{
 			emitStr(edit.col, y, DEF_STYLE, strings.Repeat(" ", edit.width))
 			continue
 		}
@@ -434,63 +472,87 @@ func drawEdit(edit *Edit, is_current bool) {
 		}
 		
 		
-		// detect if it's in the cursor selection range
+		line_text := edit.buffer.line(line_num)
 		
-		minRng := -1
-		maxRng := -1
+		// detect if it's in the selection range of any of the cursors
 		
-		if cursor.col != cursor.col_anchor || cursor.row != cursor.row_anchor {
-			// it is a worry here (cursor is selecting something)
-			end_row := cursor.row
-			end_col := cursor.col
-			start_row := cursor.row_anchor
-			start_col := cursor.col_anchor
-				
-			if end_row < start_row {
-				start_row, end_row = end_row, start_row
-				start_col, end_col = end_col, start_col
-			}else if end_row == start_row && start_col > end_col {
-				end_col, start_col = start_col, end_col
+		ranges := [][2]int{} // byte columns just outside each selection on this line
+		matched := getMatchColumns(edit, line_num) // of the matches of find
+		extra_cols := []int{} // the other cursors on this line
+		
+		block_left := -1 // display columns of a block selection
+		block_right := -1
+		
+		if edit.visual_mode == "b" {
+			start_row, end_row, left, right := getBlockBounds(edit)
+			
+			if line_num >= start_row && line_num <= end_row {
+				block_left, block_right = left, right
+			}
+		}
+		
+		for indx, cursor := range(getAllCursors(edit)) {
+			if indx > 0 && cursor.row == line_num {
+				extra_cols = append(extra_cols, cursor.col)
 			}
 			
-			if line_num > start_row && line_num < end_row {
-				minRng = -1
-				maxRng = len(edit.buffer[line_num].text)+1
-			}else if line_num == start_row && line_num == end_row {
-				minRng = start_col-1
-				maxRng = end_col
-			}else if line_num == start_row {
-				minRng = start_col-1
-				maxRng = len(edit.buffer[line_num].text)+1
-			}else if line_num == end_row {
-				minRng = -1
-				maxRng = end_col
+			if edit.visual_mode == "b" {
+				continue
+			}else if edit.visual_mode == "V" {
+				start_row, _, end_row, _ := getCursorRange(edit, cursor)
+				
+				if line_num >= start_row && line_num <= end_row {
+					ranges = append(ranges, [2]int{-1, len(line_text)+1})
+				}
+			}else if cursor.row != cursor.row_anchor || cursor.col != cursor.col_anchor || edit.visual_mode != "" {
+				// it is a worry here (cursor is selecting something)
+				start_row, start_col, end_row, end_col := getCursorRange(edit, cursor)
+				
+				if line_num > start_row && line_num < end_row {
+					ranges = append(ranges, [2]int{-1, len(line_text)+1})
+				}else if line_num == start_row && line_num == end_row {
+					ranges = append(ranges, [2]int{start_col-1, end_col})
+				}else if line_num == start_row {
+					ranges = append(ranges, [2]int{start_col-1, len(line_text)+1})
+				}else if line_num == end_row {
+					ranges = append(ranges, [2]int{-1, end_col})
+				}
 			}
 		}
 				
-		lineToDraw := ""
+		x := edit.col+line_num_width
+		text_width := edit.width-line_num_width
+		
+		cells := 0
 		tru_col_current := 0
 		
-		runes := []rune(buffer[line_num].text)
-		exist_styles := buffer[line_num].styles
+		rest := line_text
+		state := -1
+		exist_styles := edit.lines[line_num].styles
 		exist_styles_len := len(exist_styles)
 		
-		charIndx := 0
+		charIndx := 0 // byte offset of the current grapheme cluster
 		
 		curs_line := cursor_pos == line_num
 		curs_char := cursor.col
 		
-		styles := []tcell.Style{}
-		
-		for true {
+		for cells < text_width {
 			is_cursor := curs_line && charIndx == curs_char
 			
 			if edit.is_main && is_cursor {
-				CUR_CURS_X, CUR_CURS_Y = len(lineToDraw), y
+				CUR_CURS_X, CUR_CURS_Y = x+cells, y
 			}
-			is_cursor = is_cursor && is_current
+			is_cursor = (is_cursor || slices.Contains(extra_cols, charIndx)) && is_current
 			
-			is_in_highlight := charIndx > minRng && charIndx < maxRng
+			is_in_highlight := tru_col_current >= block_left && tru_col_current < block_right
+			for _, rng := range(ranges) {
+				is_in_highlight = is_in_highlight || charIndx > rng[0] && charIndx < rng[1]
+			}
+			
+			is_in_match := false
+			for _, rng := range(matched) {
+				is_in_match = is_in_match || charIndx >= rng[0] && charIndx < rng[1]
+			}
 			
 			cur_style := DEF_STYLE
 			if charIndx < exist_styles_len {
@@ -503,50 +565,63 @@ func drawEdit(edit *Edit, is_current bool) {
 				cur_style = NORMAL_MODE_STYLE
 			}else if is_in_highlight {
 				cur_style = HIGHLIGHT_STYLE
+			}else if is_in_match {
+				cur_style = cur_style.Background(matchColor)
 			}
 			
-			if charIndx >= len(runes) {
-				lineToDraw += strings.Repeat(" ", edit.width-len(lineToDraw))
-				styles = append(styles, cur_style)
-				styles = append(styles, repeatSlice(DEF_STYLE, edit.width-len(styles))...)
+			if len(rest) == 0 {
+				emitStr(x+cells, y, cur_style, " ")
+				cells ++
 				break
 			}
 			
-			char := runes[charIndx]
+			var cluster string
+			cluster, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+			width := clusterWidth(cluster)
 			
-			if char != '\t'{
-				if tru_col_current >= edit.leftchar {
-					lineToDraw += string(char)
-					styles = append(styles, cur_style)
-				}
-				tru_col_current ++
-			}else{
-				for tab_indx := range(4) {
-					if tru_col_current >= edit.leftchar {
-						lineToDraw += " "
+			if cluster == "\t" {
+				for tab_indx := range(width) {
+					if block_right != -1 { // a block can take in only part of a tab
+						is_in_highlight = tru_col_current >= block_left && tru_col_current < block_right
+					}
+					
+					if tru_col_current >= edit.leftchar && cells < text_width {
 						if tab_indx == 0 {
-							styles = append(styles, cur_style)
+							emitStr(x+cells, y, cur_style, " ")
 						}else if is_in_highlight {
-							styles = append(styles, HIGHLIGHT_STYLE)
+							emitStr(x+cells, y, HIGHLIGHT_STYLE, " ")
 						}else{
-							styles = append(styles, DEF_STYLE)
+							emitStr(x+cells, y, DEF_STYLE, " ")
 						}
+						cells ++
+					}
+					tru_col_current ++
+				}
+			}else if tru_col_current >= edit.leftchar {
+				if cells+width > text_width { // a wide character that doesn't fit on the end
+					emitStr(x+cells, y, cur_style, strings.Repeat(" ", text_width-cells))
+					cells = text_width
+				}else{
+					emitCluster(x+cells, y, cur_style, cluster)
+					cells += width
+				}
+				tru_col_current += width
+			}else{
+				for range(width) {
+					if tru_col_current >= edit.leftchar { // the second half of a wide character cut off by the scroll
+						emitStr(x+cells, y, cur_style, " ")
+						cells ++
 					}
 					tru_col_current ++
-					
-					if len(lineToDraw) == edit.width {break}
 				}
 			}
 			
-			charIndx ++
-			
-			if len(lineToDraw) == edit.width {
-				break
-			}
+			charIndx += len(cluster)
 		}
 		
-		x := edit.col+line_num_width
-		emitStrColored(x, y, styles, lineToDraw)
+		if cells < text_width {
+			emitStr(x+cells, y, DEF_STYLE, strings.Repeat(" ", text_width-cells))
+		}
 	}
 }
 
@@ -567,7 +642,8 @@ func drawYesNo() {
 }
 
 func drawOutline(edit *Edit, style tcell.Style, text string) {
-	emitStr(edit.col-2, edit.row-1, style, text+strings.Repeat(" ", edit.width+4-len(text)))
+	text = runewidth.Truncate(text, edit.width+4, "…") // labels with a file name in them can run long
+	emitStr(edit.col-2, edit.row-1, style, runewidth.FillRight(text, edit.width+4))
 	emitStr(edit.col-2, edit.row+edit.height, style, strings.Repeat(" ", edit.width+4))
 	
 	for row := range edit.height {
@@ -589,11 +665,7 @@ func drawSuggestions() {
 		word := SUGGESTIONS[tru_indx]
 		
 		if indx <= 7 {
-			if len(word) > maxLen {
-				word = word[:maxLen]
-			}else if len(word) < maxLen {
-				word += strings.Repeat(" ", maxLen-len(word))
-			}
+			word = runewidth.FillRight(runewidth.Truncate(word, maxLen, ""), maxLen)
 			
 			if indx == 0 {
 				emitStr(CUR_CURS_X, CUR_CURS_Y+1+indx, INVERTED_STYLE, word)
@@ -605,7 +677,12 @@ func drawSuggestions() {
 }
 
 func drawFullEdit() {
-	drawEdit(&MAIN_TEXTEDIT, CURRENT_TEXT_EDIT == "main")
+	drawPanes()
+	
+	if SHOWING_EXPLORER {
+		drawExplorer()
+	}
+	
 	drawSuggestions()
 	
 	if SHOWING_INPUT_MODAL {
@@ -619,10 +696,30 @@ func drawFullEdit() {
 	if SHOWING_FIND {
 		drawEdit(&FIND_TEXTEDIT, CURRENT_TEXT_EDIT == "find")
 		drawEdit(&REPLACE_TEXTEDIT, CURRENT_TEXT_EDIT == "replace")
-		drawOutline(&FIND_TEXTEDIT, TITLE_STYLE, "Find Text")
+		label := runewidth.Truncate(getFindLabel(), getOptionColumns(&FIND_TEXTEDIT, getFindOptions())[0]-FIND_TEXTEDIT.col+1, "…") // room for the options
+		if FIND_ERROR != "" {
+			drawOutline(&FIND_TEXTEDIT, NORMAL_MODE_STYLE, label)
+		}else{
+			drawOutline(&FIND_TEXTEDIT, TITLE_STYLE, label)
+		}
+		drawOptions(&FIND_TEXTEDIT, getFindOptions())
 		drawOutline(&REPLACE_TEXTEDIT, TITLE_STYLE, "Replace With")
 	}
 	
+	if SHOWING_PICKER {
+		drawEdit(&PICKER_TEXTEDIT, false)
+		drawOutline(&PICKER_TEXTEDIT, TITLE_STYLE, PICKER_LABEL)
+	}
+	
+	if SHOWING_FINDER {
+		drawFinder()
+	}
+	
+	if SHOWING_GREP {
+		drawGrep()
+	}
+	
+	drawCommandLine()
 	drawTitleBar()
 }
 
@@ -646,22 +743,43 @@ func drawTitleBar() {
 	}
 	
 	
-	text := "CodeMage V"+version+" - "+title
-	startPoint := int(w/2-len(text)/2)
+	file_title := title
+	if len(OPEN_FILES) > 1 {
+		file_title += " ("+strconv.Itoa(CURRENT_FILE+1)+"/"+strconv.Itoa(len(OPEN_FILES))+")"
+	}
+	
+	text := "CodeMage V"+version+" - "+file_title
+	startPoint := int(w/2-runewidth.StringWidth(text)/2)
 	
 	if startPoint < len(" settings help ") {
-		text = title
-		startPoint = int(w/2-len(text)/2)
+		text = file_title
+		startPoint = int(w/2-runewidth.StringWidth(text)/2)
 	}
 	
 	emitStr(startPoint, 0, TITLE_STYLE, text)
 	
 	text = "ERROR IN MAKING THE TITLEBAR?"
-	if MAIN_TEXTEDIT.current_mode == "n" {
+	recording := ""
+	if RECORDING_REGISTER != 0 {
+		recording = "recording @"+string(RECORDING_REGISTER)+" "
+	}
+	
+	if MAIN_TEXTEDIT.current_mode == "n" && MAIN_TEXTEDIT.number_string+MAIN_TEXTEDIT.pending_command != "" {
+		text = MAIN_TEXTEDIT.number_string+MAIN_TEXTEDIT.pending_command+" NORMAL" // the command typed so far
+	}else if MAIN_TEXTEDIT.current_mode == "n" && MAIN_TEXTEDIT.visual_mode == "v" {
+		text = "VISUAL"
+	}else if MAIN_TEXTEDIT.current_mode == "n" && MAIN_TEXTEDIT.visual_mode == "V" {
+		text = "VISUAL LINE"
+	}else if MAIN_TEXTEDIT.current_mode == "n" && MAIN_TEXTEDIT.visual_mode == "b" {
+		text = "VISUAL BLOCK"
+	}else if MAIN_TEXTEDIT.current_mode == "n" {
 		text = "NORMAL"
+	}else if MAIN_TEXTEDIT.current_mode == "i" && !isModalProfile() {
+		text = strings.ToUpper(KEY_PROFILE) // there are no other modes to tell it from
 	}else if MAIN_TEXTEDIT.current_mode == "i" {
 		text = "INSERT"
 	}
+	text = recording+text
 	emitStr(w-len(text), 0, TITLE_STYLE, text)
 }
 
@@ -682,18 +800,16 @@ func redrawFullScreen() {
 			emitStr(startX, startY, SPECIAL_STYLE, line)
 		}
 	}else if current_window == "edit" {
-		MAIN_TEXTEDIT.width = width
-		
+		EXPLORER_TEXTEDIT.width = min(EXPLORER_WIDTH, width/2)
+		EXPLORER_TEXTEDIT.row = 2
+		EXPLORER_TEXTEDIT.col = 0
+		EXPLORER_TEXTEDIT.height = max(height-3, 1)
 		if SHOWING_FIND {
-			MAIN_TEXTEDIT.height = height-6
-			
-			if MAIN_TEXTEDIT.height < 1 {
-				MAIN_TEXTEDIT.height = 1
-			}
-		}else{
-			MAIN_TEXTEDIT.height = height-1
+			EXPLORER_TEXTEDIT.height = max(height-8, 1)
 		}
 		
+		relayoutPanes()
+		
 		INPT_TEXTEDIT.width = 30
 		INPT_TEXTEDIT.height = 3
 		INPT_TEXTEDIT.row = height/2-1
@@ -709,6 +825,15 @@ func redrawFullScreen() {
 		REPLACE_TEXTEDIT.row = height-2
 		REPLACE_TEXTEDIT.col = 2
 		
+		PICKER_TEXTEDIT.width = min(48, width-4)
+		PICKER_TEXTEDIT.height = max(height-4, 1)
+		PICKER_TEXTEDIT.row = 2
+		PICKER_TEXTEDIT.col = width-PICKER_TEXTEDIT.width-2
+		
+		layoutFinder(width, height)
+		layoutGrep(width, height)
+		layoutCommandLine(width, height)
+		
 		drawFullEdit()
 	}
 	
@@ -740,22 +865,7 @@ func deleteText(mode, repeat int, edit *Edit) {
 			start_col, end_col = end_col, start_col
 		}
 		
-		if start_row == end_row {
-			line := edit.buffer[start_row]
-			
-			start := line.text[:start_col]
-			end := line.text[end_col:]
-			
-			edit.buffer[start_row].text = start + end
-			edit.buffer[start_row].changed = true
-		}else{
-			first_line := edit.buffer[start_row].text[:start_col]
-			last_line := edit.buffer[end_row].text[end_col:]
-			edit.buffer[start_row].text = first_line + last_line
-			edit.buffer[start_row].changed = true
-			
-			edit.buffer = append(edit.buffer[:start_row+1], edit.buffer[end_row+1:]...)
-		}
+		edit.buffer.remove(start_row, start_col, end_row, end_col)
 		
 		edit.cursor.row = start_row
 		edit.cursor.col = start_col
@@ -768,34 +878,17 @@ func deleteText(mode, repeat int, edit *Edit) {
 	
 	for range(repeat){
 		if mode == BACKSPACE {
-			line := edit.buffer[edit.cursor.row].text
-			after_deleted := ""
-			
-			if edit.cursor.col < len(line){
-				after_deleted = line[edit.cursor.col:]
-			}
-			before_deleted := ""
-			if edit.cursor.col > 0{
-				before_deleted = line[:edit.cursor.col-1]
-			}
+			end_row, end_col := edit.cursor.row, edit.cursor.col
 			
 			if edit.cursor.col == 0 && edit.cursor.row != 0 {
 				edit.cursor.row--
-				
-				joining_line := edit.buffer[edit.cursor.row].text
-				
-				edit.cursor.col = len(joining_line)
-				
-				
-				edit.buffer[edit.cursor.row].text += after_deleted
-				edit.buffer[edit.cursor.row].changed = true
-				edit.buffer = append(edit.buffer[:edit.cursor.row+1], edit.buffer[edit.cursor.row+2:]...)
-			}else{
+				edit.cursor.col = edit.buffer.lineLen(edit.cursor.row)
+			}else if edit.cursor.col > 0 {
 				moveCursor(MOVE_LEFT, false, 1, edit)
-				edit.buffer[edit.cursor.row].text = before_deleted+after_deleted
-				edit.buffer[edit.cursor.row].changed = true
 			}
 			
+			edit.buffer.remove(edit.cursor.row, edit.cursor.col, end_row, end_col)
+			
 			edit.cursor.row_anchor = edit.cursor.row
 			edit.cursor.col_anchor = edit.cursor.col
 			edit.cursor.preferencial_col = getTrueCol(edit.cursor.col, edit.cursor.row, edit)
@@ -817,45 +910,9 @@ func insertText(edit *Edit, text string) {
 		deleteText(BACKSPACE, 1, edit) // clear selection
 	}
 	
-	lines_strings := strings.Split(text, "\n")
-	
-	lines := []Line{}
-	for _, str := range(lines_strings) {
-		lines = append(lines, Line{text: strings.ReplaceAll(str, "\r", ""), changed: true})
-	}
-	
-	first_len := len(lines[0].text)
-	end_len := len(lines[len(lines)-1].text)
+	text = strings.ReplaceAll(text, "\r", "")
 	
-	current_line := edit.buffer[edit.cursor.row].text
-	bfrCrs := current_line[:edit.cursor.col]
-	endCrs := current_line[edit.cursor.col:]
-	
-	lines[0].text = bfrCrs + lines[0].text
-	lines[len(lines)-1].text = lines[len(lines)-1].text + endCrs
-	
-	edit.buffer[edit.cursor.row].text = lines[0].text
-	edit.buffer[edit.cursor.row].changed = true
-	
-	end_line := edit.cursor.row
-	end_char := edit.cursor.col + first_len
-	
-	buffer := edit.buffer
-	
-	if len(lines) > 1 {
-		insertionIndex := edit.cursor.row+1
-		
-		start := append([]Line(nil), buffer[:insertionIndex]...) // ensure copy not reference
-		end := buffer[insertionIndex:]
-		
-		newSlice := append(start, lines[1:]...)
-		newSlice = append(newSlice, end...)
-		
-		edit.buffer = newSlice
-		
-		end_line = edit.cursor.row + len(lines)-1
-		end_char = end_len
-	}
+	end_line, end_char := edit.buffer.insert(edit.cursor.row, edit.cursor.col, text)
 	
 	edit.cursor.row = end_line
 	edit.cursor.col = end_char
@@ -865,37 +922,21 @@ func insertText(edit *Edit, text string) {
 }
 
 func getCursorSelection(edit *Edit) string {
-	s_c, s_r := edit.cursor.col, edit.cursor.row
-	e_c, e_r := edit.cursor.col_anchor, edit.cursor.row_anchor
+	if edit.visual_mode == "b" {
+		return getBlockText(edit)
+	}
 	
-	if s_c == e_c && s_r == e_r {
+	if !hasSelection(edit) && edit.visual_mode == "" {
 		return ""
 	}
 	
-	if e_r < s_r {
-		s_r, e_r = e_r, s_r
-		s_c, e_c = e_c, s_c
-	}else if e_r == s_r && s_c > e_c {
-		e_c, s_c = s_c, e_c
-	}
+	s_r, s_c, e_r, e_c := getSelectionRange(edit)
 	
-	if s_r == e_r {
-		return edit.buffer[s_r].text[s_c:e_c]
-	}else{
-		lines := append([]Line(nil), edit.buffer[s_r:e_r+1]...)
-		lines[0].text = lines[0].text[s_c:]
-		lines[len(lines)-1].text = lines[len(lines)-1].text[:e_c]
-		
-		line_str := []string{}
-		for _, ln := range(lines) {
-			line_str = append(line_str, ln.text)
-		}
-		return strings.Join(line_str, "\n")
-	}
+	return edit.buffer.textRange(s_r, s_c, e_r, e_c)
 }
 
 func insertNewLine(edit *Edit) {
-	curLine := edit.buffer[edit.cursor.row].text
+	curLine := edit.buffer.line(edit.cursor.row)
 	
 	tabs := ""
 	for _, char := range(curLine){
@@ -938,78 +979,41 @@ func boolHandleKey(ev *tcell.EventKey) {
 }
 
 func indent(edit *Edit) {
-	start_row := edit.cursor.row
-	end_row := edit.cursor.row_anchor
-	
-	if start_row > end_row {
-		start_row, end_row = end_row, start_row
-	}
-	
-	for indx, line := range edit.buffer {
-		if indx < start_row || indx > end_row {
-			continue
+	trackCursors(edit, func() { // every cursor moves along with its line
+		for _, row := range(getCursorRows(edit)) {
+			edit.buffer.insert(row, 0, "\t")
 		}
-		
-		line.text = "\t"+line.text
-		line.changed = true
-		edit.buffer[indx] = line
-	}
-	
-	edit.cursor.col ++
-	edit.cursor.col_anchor ++
+	})
 }
 
 func deindent(edit *Edit) {
-	start_row := edit.cursor.row
-	end_row := edit.cursor.row_anchor
-	
-	if start_row > end_row {
-		start_row, end_row = end_row, start_row
-	}
-	
-	for indx, line := range edit.buffer {
-		if indx < start_row || indx > end_row {
-			continue
-		}
-		if len(line.text) == 0 {
-			continue
-		}
-		
-		if line.text[0] == '\t' {
-			line.text = line.text[1:]
-			line.changed = true
-			edit.buffer[indx] = line
+	trackCursors(edit, func() {
+		for _, row := range(getCursorRows(edit)) {
+			line := edit.buffer.line(row)
 			
-			if indx == edit.cursor.row {
-				edit.cursor.col --
-			}else if indx == edit.cursor.row_anchor {
-				edit.cursor.col_anchor --
+			if len(line) != 0 && line[0] == '\t' {
+				edit.buffer.remove(row, 0, row, 1)
 			}
 		}
-	}
-	
-	if edit.cursor.col < 0 {
-		edit.cursor.col = 0
-	}
-	if edit.cursor.col_anchor < 0 {
-		edit.cursor.col_anchor = 0
-	}
+	})
 }
 
 func hideSuggestions() {
 	SUGGESTIONS = []string{}
+	SUGGESTING_FOR = ""
 }
 
 func getLastRealSect(edit *Edit) string {
 	startingword := ""
 	
-	ln := edit.buffer[edit.cursor.row].text[:edit.cursor.col]
-	for i := range ln {
-		ti := len(ln)-i-1
-		chr := string(ln[ti])
+	ln := edit.buffer.line(edit.cursor.row)[:edit.cursor.col]
+	for len(ln) > 0 {
+		r, size := utf8.DecodeLastRuneInString(ln)
+		chr := string(r)
 		
 		if !strings.Contains(PUNCTUATION, chr) && !strings.Contains(WHITESPACE, chr) {
 			startingword = chr + startingword
+			ln = ln[:len(ln)-size]
 		}else{
 			break
 		}
@@ -1023,21 +1027,73 @@ func readySuggestion() {
 	startingword := getLastRealSect(&MAIN_TEXTEDIT)
 	SELECTED_SUGGESTION = 0
 	
+	SUGGESTING_FOR = startingword
+	
 	startingwordlen := len(startingword)
 	if startingwordlen == 0 {
 		return
 	}
 	
-	for _, line := range MAIN_TEXTEDIT.buffer {
-		for _, word := range(line.names) {
-			if len(word) <= startingwordlen {continue}
-			
-			strt := word[:startingwordlen]
-			if strt == startingword && !slices.Contains(SUGGESTIONS, word){
-				SUGGESTIONS = append(SUGGESTIONS, word)
-			}
+	// the names are worked out with the highlighting, which is only done as far
+	// down as has been drawn, the rest come from the last scan of the whole file
+	names := []string{}
+	for _, line := range MAIN_TEXTEDIT.lines {
+		names = append(names, line.names...)
+	}
+	if FILE_NAMES_OF == MAIN_TEXTEDIT.buffer {
+		names = append(names, FILE_NAMES...)
+	}
+	
+	for _, word := range(names) {
+		if len(word) <= startingwordlen {continue}
+		
+		strt := word[:startingwordlen]
+		if strt == startingword && !slices.Contains(SUGGESTIONS, word){
+			SUGGESTIONS = append(SUGGESTIONS, word)
 		}
 	}
+	
+	scanFileNames()
+}
+
+// finds the names in the whole of the main edit off the UI goroutine, so
+// typing in a long file doesn't wait on highlighting all of it
+func scanFileNames() {
+	buffer := MAIN_TEXTEDIT.buffer
+	if FILE_NAMES_SCANNING || FILE_NAMES_OF == buffer && FILE_NAMES_VERSION == buffer.version {
+		return
+	}
+	
+	FILE_NAMES_SCANNING = true
+	version := buffer.version
+	text := buffer.text()
+	
+	go func() {
+		scan := &Edit{buffer: newTextBuffer(text)}
+		checkForStyleUpdates(scan, scan.buffer.lineCount())
+		
+		names := []string{}
+		seen := map[string]bool{}
+		for _, line := range(scan.lines) {
+			for _, name := range(line.names) {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+		
+		runOnUI(func() {
+			FILE_NAMES_SCANNING = false
+			FILE_NAMES, FILE_NAMES_OF, FILE_NAMES_VERSION = names, buffer, version
+			
+			if MAIN_TEXTEDIT.current_mode == "i" && SUGGESTING_FOR != "" && SUGGESTING_FOR == getLastRealSect(&MAIN_TEXTEDIT) {
+				selected := SELECTED_SUGGESTION
+				readySuggestion() // with the names further down too
+				SELECTED_SUGGESTION = min(selected, max(len(SUGGESTIONS)-1, 0))
+			}
+		})
+	}()
 }
 
 func activateSuggestion() {
@@ -1056,69 +1112,33 @@ func editHandleKey(ev *tcell.EventKey, edit *Edit) bool {
 	rune := unicode.ToLower(rawrune)
 	
 	control_held := ev.Modifiers()&tcell.ModCtrl  != 0
-	alt_held     := ev.Modifiers()&tcell.ModAlt   != 0
 	shift_held   := ev.Modifiers()&tcell.ModShift != 0 || rune != rawrune
-	keepAnchor   := shift_held
+	keepAnchor   := shift_held || edit.visual_mode != "" // moving in a visual mode drags the selection
 	handled := false
 	
 	if ev.Key() == tcell.KeyCtrlQ {
 		return true
 	}
 	
-	if ev.Key() == tcell.KeyCtrlY {
-		redo(edit)
-		showCursor(edit)
-		return false // only can return here because it is not going to change the undo/redo history
-	}else if ev.Key() == tcell.KeyCtrlZ {
-		undo(edit)
-		showCursor(edit)
-		return false // only can return here because it is not going to change the undo/redo history
-	}else if ev.Key() == tcell.KeyCtrlS {
-		saveFile()
+	if multiCursorHandleKey(ev, edit) {
 		return false
-	}else if rune == 's' && alt_held {
-		saveFileAs()
-		return false
-	}else if ev.Key() == tcell.KeyCtrlG {
-		openFileByUser(filepath.Join(APP_CONFIG_DIR, "allSettings.cdmg"))
-		return false
-	}else if ev.Key() == tcell.KeyCtrlF {
-		openFindMenu()
-		return false
-	}else if rune == '[' && edit.current_mode == "n" {
-		deindent(edit)
-		handled = true
-	}else if rune == ']' && edit.current_mode == "n" {
-		indent(edit)
-		handled = true
-	}else if ev.Key() == tcell.KeyCtrlC {
-		textToCopy := getCursorSelection(edit)
-		if USE_CLIP {
-			clipboard.Write(clipboard.FmtText, []byte(textToCopy))
-		}else{
-			CLIP_BUFF = textToCopy
-		}
-		
-		handled = true
-	}else if ev.Key() == tcell.KeyCtrlX {
-		textToCopy := getCursorSelection(edit)
-		if USE_CLIP {
-			clipboard.Write(clipboard.FmtText, []byte(textToCopy))
-		}else{
-			CLIP_BUFF = textToCopy
-		}
-		
-		insertText(edit, "")
-		handled = true
 	}
 	
+	syncUndoCursor(edit)
+	
+	if edit.is_main && edit.current_mode != "i" {
+		INSERTED_TEXT = "" // a new insert session starts from nothing
+	}
+	
+	beginChangeKey(edit)
+	
 	if SHOWING_INPUT_MODAL { // this is the thing... for alt+s (or general requests for text.)
 		if ((ev.Key() == tcell.KeyEscape || ev.Key() == tcell.KeyEsc) && INPT_TEXTEDIT.current_mode == "n") {
 			INPT_TEXTEDIT.cursor.row = 0
 			INPT_TEXTEDIT.cursor.col = 0
 			INPT_TEXTEDIT.cursor.row_anchor = 0
 			INPT_TEXTEDIT.cursor.col_anchor = 0
-			INPT_TEXTEDIT.buffer = []Line{{text: ""}}
+			setEditText(&INPT_TEXTEDIT, "")
 		}
 		
 		if ev.Key() == tcell.KeyEnter || ((ev.Key() == tcell.KeyEscape || ev.Key() == tcell.KeyEsc) && INPT_TEXTEDIT.current_mode == "n") {
@@ -1169,7 +1189,17 @@ func editHandleKey(ev *tcell.EventKey, edit *Edit) bool {
 		hideSuggestions()
 	}
 	
+	if edit.current_mode == "n" && !handled && visualHandleKey(ev, edit) {
+		handled = true
+	}
+	
+	if edit.current_mode == "n" && !handled && normalCommandHandleKey(ev, edit) {
+		handled = true
+	}
+	
 	if edit.current_mode == "n" && !handled {
+		start_cursor := edit.cursor
+		
 		if strings.Contains(NUMBERS, string(rune)) {
 			edit.number_string += string(rune)
 		}else {
@@ -1208,10 +1238,6 @@ func editHandleKey(ev *tcell.EventKey, edit *Edit) bool {
 			moveCursor(MOVE_LEFT, keepAnchor, repeatCount, edit)
 		}else if rune == 'l' {
 			moveCursor(MOVE_RIGHT, keepAnchor, repeatCount, edit)
-		}else if rune == 'e' {
-			moveCursor(WORD_RIGHT, keepAnchor, repeatCount, edit)
-		}else if rune == 'w' {
-			moveCursor(WORD_LEFT, keepAnchor, repeatCount, edit)
 		}else if ev.Key() == tcell.KeyCtrlA {
 			edit.cursor.row_anchor = 0
 			edit.cursor.col_anchor = 0
@@ -1221,51 +1247,16 @@ func editHandleKey(ev *tcell.EventKey, edit *Edit) bool {
 			edit.current_mode = "i"
 			edit.number_string = ""
 			drawTitleBar()
-		}else if rune == '^' {
-			moveCursor(START_OF_LINE, false, 1, edit)
 		}else if rune == 'o' {
 			moveCursor(END_OF_LINE, false, 1, edit)
 			insertNewLine(edit)
 			edit.current_mode = "i"
 			edit.number_string = ""
 			drawTitleBar()
-		}else if rune == 'v' {
-			if USE_CLIP {
-				insertText(edit, string(clipboard.Read(clipboard.FmtText)))
-			}else{
-				insertText(edit, CLIP_BUFF)
-			}
-		}else if rune == 'c' {
-			textToCopy := getCursorSelection(edit)
-			if USE_CLIP {
-				clipboard.Write(clipboard.FmtText, []byte(textToCopy))
-			}else{
-				CLIP_BUFF = textToCopy
-			}
-		}else if rune == 'x' {
-			textToCopy := getCursorSelection(edit)
-			if USE_CLIP {
-				clipboard.Write(clipboard.FmtText, []byte(textToCopy))
-			}else{
-				CLIP_BUFF = textToCopy
-			}
-			deleteText(BACKSPACE, 1, edit)
 		}else if rune == 'i' {
 			edit.current_mode = "i"
 			edit.number_string = ""
 			drawTitleBar()
-		}else if rune == 'g' {
-			if repeatCount <= 0{
-				repeatCount = 1
-			}else if repeatCount > len(edit.buffer) {
-				repeatCount = len(edit.buffer)
-			}
-			
-			edit.cursor.col = 0
-			edit.cursor.row = repeatCount-1
-			edit.cursor.row_anchor = repeatCount-1
-			edit.cursor.col_anchor = 0
-			
 		}else if ev.Key() == tcell.KeyLeft {
 			if control_held {
 				moveCursor(WORD_LEFT, keepAnchor, 1, edit)
@@ -1292,19 +1283,34 @@ func editHandleKey(ev *tcell.EventKey, edit *Edit) bool {
 			}
 		}else if ev.Key() == tcell.KeyEnter && !SHOWING_FIND {
 			insertText(edit, "\n")
-		}else if rune == '\t' {
+		}else if rune == '\t' || ev.Key() == tcell.KeyTab {
 			if edit.is_main && len(SUGGESTIONS) != 0{
 				activateSuggestion()
-			}else{
+			}else if edit.is_main && !walkJumpList(1, repeatCount) { // Tab is Ctrl+I
+				failMacro()
+			}else if !edit.is_main {
 				insertText(edit, "\t")
 			}
-		}else if rune == 'f' {
+		}else if ev.Key() == tcell.KeyCtrlO && edit.is_main {
+			if !walkJumpList(-1, repeatCount) {
+				failMacro()
+			}
+		}else if rune == '/' {
 			openFindMenu()
+		}else if rune == ':' && edit.is_main {
+			openCommandLine(edit, repeatCount)
 		}else if rune == ' '{
 			insertText(edit, " ")
 		}
+		
+		if ev.Key() == tcell.KeyRune && strings.ContainsRune("hjkl", rune) && edit.cursor == start_cursor {
+			failMacro() // a motion that couldn't move
+		}
 	}else if edit.current_mode == "i" && !handled{
+		recordInsertKey(ev, edit)
+		
 		if ev.Key() == tcell.KeyEscape {
+			finishBlockInsert(edit)
 			edit.current_mode = "n"
 			edit.number_string = ""
 			drawTitleBar()
@@ -1353,7 +1359,7 @@ func editHandleKey(ev *tcell.EventKey, edit *Edit) bool {
 		}else if ev.Key() == tcell.KeyEnd {
 			moveCursor(END_OF_LINE, keepAnchor, 1, edit)
 		}else if ev.Key() == tcell.KeyHome {
-			moveCursor(START_OF_LINE, false, 1, edit)
+			moveCursor(START_OF_LINE, keepAnchor, 1, edit)
 		}else if ev.Key() == tcell.KeyEnter && !SHOWING_FIND {
 			insertNewLine(edit)
 			hideSuggestions()
@@ -1377,101 +1383,31 @@ func editHandleKey(ev *tcell.EventKey, edit *Edit) bool {
 	
 	showCursor(edit)
 	
+	endChangeKey(ev, edit)
 	readyUndoHistory(edit)
 	
 	return false
 }
 
-func runFind(backwards bool) {
-	searchingfor := strings.ToLower(getPlainText(&FIND_TEXTEDIT))
-	if searchingfor == ""{
-		return
-	}
-	
-	realline := MAIN_TEXTEDIT.cursor.row
+// lowercases text without changing its byte length, so indexes found in the
+// result can be used on the original line
+func lowerSameLength(text string) string {
+	out := []byte{}
 	
-	for fakeline := range len(MAIN_TEXTEDIT.buffer)+1 {
-		linetext := strings.ToLower(MAIN_TEXTEDIT.buffer[realline].text)
-		
-		if strings.Contains(linetext, searchingfor) {
-			indx := -1
-			
-			if fakeline == 0 {
-				if !backwards{
-					if MAIN_TEXTEDIT.cursor.col < len(linetext) {
-						textAftrIndx := linetext[MAIN_TEXTEDIT.cursor.col_anchor+1:]
-						if strings.Contains(textAftrIndx, searchingfor) {
-							indx = strings.Index(textAftrIndx, searchingfor) + MAIN_TEXTEDIT.cursor.col_anchor+1
-						}
-					}
-				}else{
-					if MAIN_TEXTEDIT.cursor.col_anchor > 0 {
-						textBfrIndx := linetext[:MAIN_TEXTEDIT.cursor.col-1]
-						if strings.Contains(textBfrIndx, searchingfor) {
-							indx = strings.LastIndex(textBfrIndx, searchingfor)
-						}
-					}
-				}
-			}else{
-				if !backwards{
-					indx = strings.Index(linetext, searchingfor)
-				}else{
-					indx = strings.LastIndex(linetext, searchingfor)
-				}
-			}
-			
-			if indx != -1 {
-				MAIN_TEXTEDIT.cursor.row = realline
-				MAIN_TEXTEDIT.cursor.row_anchor = realline
-				MAIN_TEXTEDIT.cursor.col = indx+len(searchingfor)
-				MAIN_TEXTEDIT.cursor.col_anchor = indx
-				showCursor(&MAIN_TEXTEDIT)
-				return
-			}
-		}
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		lower := unicode.ToLower(r)
 		
-		if !backwards{
-			realline ++
-			if realline >= len(MAIN_TEXTEDIT.buffer) {
-				realline = 0
-			}
+		if r != utf8.RuneError && utf8.RuneLen(lower) == size {
+			out = utf8.AppendRune(out, lower)
 		}else{
-			realline --
-			if realline < 0 {
-				realline = len(MAIN_TEXTEDIT.buffer)-1
-			}
-		}
-	}
-}
-
-func runReplace(backwards bool) {
-	searchingfor := strings.ToLower(getPlainText(&FIND_TEXTEDIT))
-	
-	if searchingfor == "" {
-		return
-	}
-	
-	selected := strings.ToLower(getCursorSelection(&MAIN_TEXTEDIT))
-	repText := getPlainText(&REPLACE_TEXTEDIT)
-	
-	if searchingfor == selected {
-		insertText(&MAIN_TEXTEDIT, repText)
-		if backwards {
-			MAIN_TEXTEDIT.cursor.col -= len(repText)
-			MAIN_TEXTEDIT.cursor.col_anchor -= len(repText)
-			
-			if MAIN_TEXTEDIT.cursor.col < 0 { // this shouldn't ever be true... but might as well?
-				MAIN_TEXTEDIT.cursor.col = 0
-				MAIN_TEXTEDIT.cursor.col_anchor = 0
-			}
+			out = append(out, text[:size]...)
 		}
+		
+		text = text[size:]
 	}
 	
-	runFind(backwards)
-	
-	readyUndoHistory(&MAIN_TEXTEDIT)
-	
-	showCursor(&MAIN_TEXTEDIT)
+	return string(out)
 }
 
 func findMenuTriggered(backwards bool) {
@@ -1483,6 +1419,7 @@ func findMenuTriggered(backwards bool) {
 }
 
 func closeFindMenu() {
+	endFindSession()
 	SHOWING_FIND = false
 	CURRENT_TEXT_EDIT = "main"
 	redrawFullScreen()
@@ -1490,13 +1427,17 @@ func closeFindMenu() {
 
 func openFindMenu() {
 	txt := getCursorSelection(&MAIN_TEXTEDIT)
+	if !SHOWING_FIND {
+		startFindSession()
+	}
+	setFindScope()
 	
-	if txt != "" {
-		FIND_TEXTEDIT.buffer = []Line{{text: txt, changed: true}}
+	if txt != "" && !FIND_IN_SELECTION {
+		setEditText(&FIND_TEXTEDIT, txt)
 	}
 	
-	FIND_TEXTEDIT.cursor.row = len(FIND_TEXTEDIT.buffer)-1
-	FIND_TEXTEDIT.cursor.col = len(FIND_TEXTEDIT.buffer[FIND_TEXTEDIT.cursor.row].text)
+	FIND_TEXTEDIT.cursor.row = FIND_TEXTEDIT.buffer.lineCount()-1
+	FIND_TEXTEDIT.cursor.col = FIND_TEXTEDIT.buffer.lineLen(FIND_TEXTEDIT.cursor.row)
 	FIND_TEXTEDIT.cursor.col_anchor = 0
 	FIND_TEXTEDIT.cursor.row_anchor = 0
 	
@@ -1516,7 +1457,7 @@ func showCursor(edit *Edit) {
 	showing_col_start := edit.leftchar
 	sub := 0
 	if edit.use_line_numbers {
-		sub = len(strconv.Itoa(len(edit.buffer)))
+		sub = len(strconv.Itoa(edit.buffer.lineCount()))
 	}
 	
 	showing_col_end := edit.leftchar+edit.width-sub-1 // minus 1 because cursor can be on the very end of the line.
@@ -1534,133 +1475,95 @@ func showCursor(edit *Edit) {
 		}
 	}else if real_row > showing_row_end {
 		edit.toprow += real_row-showing_row_end+7
-		if edit.toprow+edit.height > len(edit.buffer) {
-			edit.toprow = len(edit.buffer)-edit.height
+		if edit.toprow+edit.height > edit.buffer.lineCount() {
+			edit.toprow = edit.buffer.lineCount()-edit.height
 		}
 	}
 }
 
-func copyBuffer(buffer []Line) []Line {
-	copied := make([]Line, len(buffer))
-	for i, line := range buffer {
-		copied[i].text = line.text
-		copied[i].changed = line.changed
-		copied[i].styles = append([]tcell.Style{}, line.styles...)
-		copied[i].end_str = line.end_str
-		copied[i].end_str_type = line.end_str_type
-		copied[i].start_str = line.end_str
-		copied[i].start_str_type = line.end_str_type
-	}
-	return copied
-}
-
-func applyEditState(state Snapshot, edit *Edit) {
-	edit.cursor.row = state.cursor.row
-	edit.cursor.row_anchor = state.cursor.row_anchor
-	edit.cursor.col = state.cursor.col
-	edit.cursor.col_anchor = state.cursor.col_anchor
-	edit.cursor.preferencial_col = state.cursor.preferencial_col
-	
-	edit.buffer = copyBuffer(state.buffer)
-}
-
-func undo(edit *Edit) {
-	curText := getPlainText(edit)
-	
-	if len(edit.UNDO_HISTORY) > 0 {
-		last_edit := edit.UNDO_HISTORY[len(edit.UNDO_HISTORY)-1]
-		edit.UNDO_HISTORY = edit.UNDO_HISTORY[:len(edit.UNDO_HISTORY)-1]
-		edit.REDO_HISTORY = append(edit.REDO_HISTORY, last_edit)
-		
-		if last_edit.fulltext == curText && len(edit.UNDO_HISTORY) > 0 {
-			last_edit = edit.UNDO_HISTORY[len(edit.UNDO_HISTORY)-1]
-			edit.UNDO_HISTORY = edit.UNDO_HISTORY[:len(edit.UNDO_HISTORY)-1]
-			edit.REDO_HISTORY = append(edit.REDO_HISTORY, last_edit)
-		}
-		
-		applyEditState(last_edit, edit)
-	}
-}
-
-func redo(edit *Edit) {
-	curText := getPlainText(edit)
-	
-	if len(edit.REDO_HISTORY) > 0 {
-		last_edit := edit.REDO_HISTORY[len(edit.REDO_HISTORY)-1]
-		edit.REDO_HISTORY = edit.REDO_HISTORY[:len(edit.REDO_HISTORY)-1]
-		edit.UNDO_HISTORY = append(edit.UNDO_HISTORY, last_edit)
-		
-		if last_edit.fulltext == curText && len(edit.REDO_HISTORY) > 0 {
-			last_edit = edit.REDO_HISTORY[len(edit.REDO_HISTORY)-1]
-			edit.REDO_HISTORY = edit.REDO_HISTORY[:len(edit.REDO_HISTORY)-1]
-			edit.UNDO_HISTORY = append(edit.UNDO_HISTORY, last_edit)
-		}
-		
-		applyEditState(last_edit, edit)
-	}
+func setEditText(edit *Edit, text string) {
+	edit.buffer = newTextBuffer(text)
+	edit.extra_cursors = nil
+	clearUndoHistory(edit)
 }
 
 func getPlainText(edit *Edit) string {
-	out := make([]string, len(edit.buffer))
-	
-	for indx, line := range(edit.buffer){
-		out[indx] = line.text
-	}
-	
-	return strings.Join(out, "\n")
+	return edit.buffer.text()
 }
 
-func readyUndoHistory(edit *Edit) {
-	cur_time_millis := time.Now().UnixNano() / 1e6
-	
-	overwrite := false
-	
-	cur_string := getPlainText(edit)
+func handleKey(ev *tcell.EventKey) bool { // called in edit mode
+	recordMacroKey(ev)
+	COMMAND_MESSAGE = "" // shown until the next key
 	
-	if len(edit.UNDO_HISTORY) > 0 {
-		last_snap := edit.UNDO_HISTORY[len(edit.UNDO_HISTORY)-1]
-		if last_snap.fulltext == cur_string {
-			return
-		}
-		
-		tm := last_snap.time_taken
-		
-		if cur_time_millis-tm < 300 {
-			overwrite = true
-		}
+	keepInsertMode()
+	quit := false
+	if !keymapHandleKey(ev) {
+		quit = routeKey(ev)
 	}
+	keepInsertMode()
 	
-	copied := copyBuffer(edit.buffer)
-	
-	cop_cursor := Cursor{row: edit.cursor.row, col: edit.cursor.col, row_anchor: edit.cursor.row_anchor, col_anchor: edit.cursor.col_anchor, preferencial_col: edit.cursor.preferencial_col}
-	
-	this_snap := Snapshot{buffer: copied, cursor: cop_cursor, time_taken: cur_time_millis, fulltext: cur_string}
-	
-	if overwrite {
-		edit.UNDO_HISTORY[len(edit.UNDO_HISTORY)-1] = this_snap
-	}else{
-		edit.UNDO_HISTORY = append(edit.UNDO_HISTORY, this_snap)
+	if SHOWING_FIND {
+		searchAsYouType()
 	}
 	
-	edit.REDO_HISTORY = []Snapshot{}
+	return quit
 }
 
-func handleKey(ev *tcell.EventKey) bool { // called in edit mode
+// passes the key to whatever has the focus
+func routeKey(ev *tcell.EventKey) bool {
+	LAST_KEY_COMMAND = "" // a key handled as it is ends a run of kills or yanks, and the mark
+	MARK_ACTIVE = false
+	
 	if SHOWING_INPUT_MODAL {
 		CURRENT_TEXT_EDIT = "inpt"
 		return editHandleKey(ev, &INPT_TEXTEDIT)
 	}else if SHOWING_INPUT_BOOL {
 		CURRENT_TEXT_EDIT = "bool"
 		boolHandleKey(ev)
+	}else if SHOWING_COMMAND_LINE {
+		if ev.Key() == tcell.KeyCtrlQ {
+			return true
+		}
+		CURRENT_TEXT_EDIT = "command"
+		commandLineHandleKey(ev)
+	}else if SHOWING_PICKER {
+		if ev.Key() == tcell.KeyCtrlQ {
+			return true
+		}
+		CURRENT_TEXT_EDIT = "picker"
+		pickerHandleKey(ev)
+	}else if SHOWING_FINDER {
+		if ev.Key() == tcell.KeyCtrlQ {
+			return true
+		}
+		CURRENT_TEXT_EDIT = "finder"
+		finderHandleKey(ev)
+	}else if SHOWING_GREP {
+		if ev.Key() == tcell.KeyCtrlQ {
+			return true
+		}
+		CURRENT_TEXT_EDIT = "grep"
+		grepHandleKey(ev)
+	}else if EXPLORER_FOCUSED {
+		if ev.Key() == tcell.KeyCtrlQ {
+			return true
+		}
+		CURRENT_TEXT_EDIT = "explorer"
+		explorerHandleKey(ev)
 	}else if SHOWING_FIND {
 		if USING_REPLACE {
 			CURRENT_TEXT_EDIT = "replace"
 			return editHandleKey(ev, &REPLACE_TEXTEDIT)
 		}
 		CURRENT_TEXT_EDIT = "find"
-		return editHandleKey(ev, &FIND_TEXTEDIT)
+		quit := editHandleKey(ev, &FIND_TEXTEDIT)
+		getFindPattern() // so a mistake in the pattern shows as it is typed
+		return quit
 	}else{
 		CURRENT_TEXT_EDIT = "main"
+		if paneHandleKey(ev) {
+			return false
+		}
 		return editHandleKey(ev, &MAIN_TEXTEDIT)
 	}
 	
@@ -1668,66 +1571,60 @@ func handleKey(ev *tcell.EventKey) bool { // called in edit mode
 }
 
 func getTrueCol(x, y int, edit *Edit) int {
-	tru_col := 0
-	line := edit.buffer[y]
+	line := edit.buffer.line(y)
 	
-	for indx := range(x){
-		char := line.text[indx]
-		
-		if char != '\t' {
-			tru_col ++
-		} else {
-			tru_col += 4
-		}
+	if x > len(line) {
+		x = len(line)
 	}
 	
-	return tru_col
+	return stringWidth(line[:x])
 }
 
 func getFalseCol(x, y int, edit *Edit) int {
 	fal_col := 0
-	line := edit.buffer[y].text
+	line := edit.buffer.line(y)
 	
-	if x == 0 {
+	if x <= 0 {
 		return 0
 	}
 	
-	for indx := range(line) {
-		char := line[indx]
+	indx := 0
+	state := -1
+	rest := line
+	
+	for len(rest) > 0 {
+		var cluster string
+		cluster, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
 		
-		if char == '\t' {
-			pos_col := fal_col + 4
-			if pos_col == x {
-				return indx+1
-			}else if pos_col < x {
-				fal_col = pos_col
-				continue
-			} else { // we are around it. fal_col < x < pos_col
-				if x-fal_col < pos_col-x {
-					return indx
-				}else{
-					return indx+1
-				}
-			}
-		}else {
-			fal_col ++
-			if fal_col == x {
-				return indx+1
+		pos_col := fal_col + clusterWidth(cluster)
+		
+		if pos_col == x {
+			return indx+len(cluster)
+		}else if pos_col > x { // we are around it. fal_col < x < pos_col
+			if x-fal_col < pos_col-x {
+				return indx
+			}else{
+				return indx+len(cluster)
 			}
 		}
+		
+		fal_col = pos_col
+		indx += len(cluster)
 	}
 	
 	return len(line)
 }
 
 func movePointInText(x, y, action, repeat int, edit *Edit) (int, int) {
+	line_count := edit.buffer.lineCount()
+	
 	if action == END_OF_LINE {
-		x = len(edit.buffer[y].text)
+		x = edit.buffer.lineLen(y)
 	}else if action == START_OF_LINE {
 		x = 0
 	}else if action == FULL_END {
-		y = len(edit.buffer)-1
-		x = len(edit.buffer[y].text)
+		y = line_count-1
+		x = edit.buffer.lineLen(y)
 	}
 	
 	for range(repeat){
@@ -1735,7 +1632,7 @@ func movePointInText(x, y, action, repeat int, edit *Edit) (int, int) {
 			tru_col := getTrueCol(x, y, edit)
 			
 			changed := false
-			if action == MOVE_DOWN && y < len(edit.buffer)-1 {
+			if action == MOVE_DOWN && y < line_count-1 {
 				y ++
 				changed = true
 			}else if action == MOVE_UP && y > 0 {
@@ -1752,21 +1649,21 @@ func movePointInText(x, y, action, repeat int, edit *Edit) (int, int) {
 			if x == 0 {
 				if y != 0 {
 					y --
-					x = len(edit.buffer[y].text)
+					x = edit.buffer.lineLen(y)
 				}
 			}else{
-				x--
+				x = prevGrapheme(edit.buffer.line(y), x)
 			}
 		}
 		
 		if action == MOVE_RIGHT {
-			if x == len(edit.buffer[y].text) {
-				if y != len(edit.buffer)-1 {
+			if x == edit.buffer.lineLen(y) {
+				if y != line_count-1 {
 					y ++
 					x = 0
 				}
 			}else{
-				x++
+				x = nextGrapheme(edit.buffer.line(y), x)
 			}
 		}
 		
@@ -1776,46 +1673,39 @@ func movePointInText(x, y, action, repeat int, edit *Edit) (int, int) {
 				continue
 			}
 			
-			curline := edit.buffer[y].text
-			
-			char := curline[x-1]
+			curline := edit.buffer.line(y)
 			
-			strtype := getCharType(char)
+			x = prevGrapheme(curline, x)
+			strtype := getCharType(firstRune(curline[x:]))
 			
-			for range(x) {
-				x -= 1
-				if x == 0 {
-					break
-				}
-				
-				c := curline[x-1]
-				typ := getCharType(c)
+			for x > 0 {
+				prev := prevGrapheme(curline, x)
+				typ := getCharType(firstRune(curline[prev:]))
 				
 				if (strtype == NORMAL_CHAR_TYPE) != (typ == NORMAL_CHAR_TYPE) {
 					break
 				}
+				
+				x = prev
 			}
 		}
 		
 		if action == WORD_RIGHT {
-			curline := edit.buffer[y].text
+			curline := edit.buffer.line(y)
 			if x == len(curline) {
 				x, y = movePointInText(x, y, MOVE_RIGHT, 1, edit)
 				continue
 			}
 			
-			char := curline[x]
-			
-			strtype := getCharType(char)
+			strtype := getCharType(firstRune(curline[x:]))
 			
-			for range(len(curline)-x) {
-				x += 1
+			for x < len(curline) {
+				x = nextGrapheme(curline, x)
 				if x == len(curline) {
 					break
 				}
 				
-				c := curline[x]
-				typ := getCharType(c)
+				typ := getCharType(firstRune(curline[x:]))
 				
 				if (strtype == NORMAL_CHAR_TYPE) != (typ == NORMAL_CHAR_TYPE) {
 					break
@@ -1827,7 +1717,12 @@ func movePointInText(x, y, action, repeat int, edit *Edit) (int, int) {
 	return x, y
 }
 
-func getCharType(char byte) int {
+func firstRune(text string) rune {
+	r, _ := utf8.DecodeRuneInString(text)
+	return r
+}
+
+func getCharType(char rune) int {
 	strype := NORMAL_CHAR_TYPE
 	chr := string(char)
 	if strings.Contains(WHITESPACE, chr) {
@@ -1846,8 +1741,8 @@ func moveCursor(action int, keepAnchor bool, repeat int, edit *Edit) {
 	
 	if action == MOVE_DOWN || action == MOVE_UP {
 		nx = getFalseCol(edit.cursor.preferencial_col, ny, edit)
-		if nx > len(edit.buffer[ny].text) {
-			nx = len(edit.buffer[ny].text)
+		if nx > edit.buffer.lineLen(ny) {
+			nx = edit.buffer.lineLen(ny)
 		}
 	}
 	
@@ -1902,16 +1797,20 @@ func handleMouse(ev *tcell.EventMouse) bool {
 		BUTTON_DOWN = false
 	}
 	
-	if buttons&tcell.WheelUp != 0 {
+	if grepHandleMouse(ev) || explorerHandleMouse(ev) {
+		return false
+	}
+	
+	if buttons&tcell.WheelUp != 0 && !scrollPaneAt(x, y, -SCROLL_SENSITIVITY) {
 		MAIN_TEXTEDIT.toprow -= SCROLL_SENSITIVITY
 		if MAIN_TEXTEDIT.toprow < 0 {
 			MAIN_TEXTEDIT.toprow = 0
 		}
 	}
-	if buttons&tcell.WheelDown != 0 {
+	if buttons&tcell.WheelDown != 0 && !scrollPaneAt(x, y, SCROLL_SENSITIVITY) {
 		MAIN_TEXTEDIT.toprow += SCROLL_SENSITIVITY
-		if MAIN_TEXTEDIT.toprow >= len(MAIN_TEXTEDIT.buffer)-MAIN_TEXTEDIT.height {
-			MAIN_TEXTEDIT.toprow = len(MAIN_TEXTEDIT.buffer)-MAIN_TEXTEDIT.height
+		if MAIN_TEXTEDIT.toprow >= MAIN_TEXTEDIT.buffer.lineCount()-MAIN_TEXTEDIT.height {
+			MAIN_TEXTEDIT.toprow = MAIN_TEXTEDIT.buffer.lineCount()-MAIN_TEXTEDIT.height
 			
 			if MAIN_TEXTEDIT.toprow < 0 {
 				MAIN_TEXTEDIT.toprow = 0
@@ -1919,17 +1818,47 @@ func handleMouse(ev *tcell.EventMouse) bool {
 		}
 	}
 	
+	if buttons&tcell.Button1 != 0 && !BUTTON_DOWN && SHOWING_FIND && optionsHandleMouse(&FIND_TEXTEDIT, getFindOptions(), x, y) {
+		BUTTON_DOWN = true
+		searchAsYouType()
+		return false
+	}
+	
+	if buttons&tcell.Button1 != 0 && !BUTTON_DOWN && y > 0 {
+		if pane := getPaneAt(x, y); pane != nil {
+			if EXPLORER_FOCUSED {
+				unfocusExplorer()
+			}
+			focusPane(pane)
+			
+			if y < pane.row || x >= pane.col+pane.width { // the header or the separator
+				BUTTON_DOWN = true
+				return false
+			}
+		}
+	}
+	
 	if buttons&tcell.Button1 != 0 {
 		row := MAIN_TEXTEDIT.toprow+y-MAIN_TEXTEDIT.row
-		if row >= len(MAIN_TEXTEDIT.buffer) {
-			row = len(MAIN_TEXTEDIT.buffer)-1
+		if row >= MAIN_TEXTEDIT.buffer.lineCount() {
+			row = MAIN_TEXTEDIT.buffer.lineCount()-1
 		}else if row < 0 {
 			row = 0
 		}
 		
-		col := getFalseCol(x-len(strconv.Itoa(len(MAIN_TEXTEDIT.buffer))), row, &MAIN_TEXTEDIT)
+		col := getFalseCol(x-MAIN_TEXTEDIT.col-len(strconv.Itoa(MAIN_TEXTEDIT.buffer.lineCount()))+MAIN_TEXTEDIT.leftchar, row, &MAIN_TEXTEDIT)
 		
-		if !BUTTON_DOWN {
+		if !BUTTON_DOWN && ev.Modifiers()&tcell.ModAlt != 0 {
+			MAIN_TEXTEDIT.visual_mode = ""
+			toggleCursorAt(&MAIN_TEXTEDIT, row, col)
+		}else if !BUTTON_DOWN && ev.Modifiers()&tcell.ModShift != 0 {
+			clearExtraCursors(&MAIN_TEXTEDIT) // shift+click selects from the cursor to the click
+			MAIN_TEXTEDIT.cursor.col = col
+			MAIN_TEXTEDIT.cursor.row = row
+		}else if !BUTTON_DOWN {
+			MAIN_TEXTEDIT.visual_mode = "" // clicking drops a visual selection, dragging makes a new one
+			MARK_ACTIVE = false
+			clearExtraCursors(&MAIN_TEXTEDIT)
 			MAIN_TEXTEDIT.cursor.col = col
 			MAIN_TEXTEDIT.cursor.row = row
 			MAIN_TEXTEDIT.cursor.col_anchor = col
@@ -1942,6 +1871,8 @@ func handleMouse(ev *tcell.EventMouse) bool {
 		BUTTON_DOWN = true
 	}
 	
+	readyUndoHistory(&MAIN_TEXTEDIT)
+	
 	return false
 }
 
@@ -1961,6 +1892,14 @@ func saveFile() bool {
 	
 	LAST_SAVED = plaintext
 	
+	if isKeymapFile(file_name) {
+		reloadKeymap()
+	}else if isSettingsFile(file_name) {
+		loadSettings() // for KEY_PROFILE, the bindings are read again with it
+		loadKeymap()
+		showKeymapError()
+	}
+	
 	if SAVE_CALLBACK != nil {
 		SAVE_CALLBACK()
 		SAVE_CALLBACK = nil
@@ -1970,7 +1909,7 @@ func saveFile() bool {
 }
 
 func getTextInput(text string) {
-	INPT_TEXTEDIT.buffer = []Line{{text: "", changed: true}} // clear old text.
+	setEditText(&INPT_TEXTEDIT, "") // clear old text.
 	INPT_TEXTEDIT.cursor.row = 0
 	INPT_TEXTEDIT.cursor.col = 0
 	INPT_TEXTEDIT.cursor.row_anchor = 0
@@ -2030,58 +1969,64 @@ func adjustToFileName() {
 	title = filepath.Base(cleanedPath)
 }
 
-func openFile() {
-	setupUI()
+func openFile(path string) {
+	if indx := findOpenFile(path); indx != -1 {
+		switchToFile(indx)
+		return
+	}
 	
-	file, err := os.Open(file_name)
+	contents, err := os.ReadFile(path)
 	if err != nil {
+		if CURRENT_FILE < 0 {
+			newUntitledFile()
+		}
 		displayError("Error opening file: " + err.Error())
 		return
 	}
-	defer file.Close()
-	
-	scanner := bufio.NewScanner(file)
 	
-	MAIN_TEXTEDIT.buffer = []Line{}
+	text := strings.ReplaceAll(string(contents), "\r\n", "\n")
+	text = strings.TrimSuffix(text, "\n")
 	
-	for scanner.Scan() {
-		line := scanner.Text()
-		MAIN_TEXTEDIT.buffer = append(MAIN_TEXTEDIT.buffer, Line{text: line, changed: true})
+	if !isThrowawayFile() {
+		recordJump()
+		storeCurrentFile()
+		OPEN_FILES = append(OPEN_FILES, &OpenFile{})
+		CURRENT_FILE = len(OPEN_FILES)-1
 	}
 	
-	LAST_SAVED = getPlainText(&MAIN_TEXTEDIT)
-
-	if err := scanner.Err(); err != nil {
-		displayError("Error reading lines: " + err.Error())
-	}
+	MAIN_TEXTEDIT = createEdit()
+	MAIN_TEXTEDIT.is_main = true
+	fitFocusedPane()
+	file_name = path
+	
+	setEditText(&MAIN_TEXTEDIT, text)
+	
+	LAST_SAVED = text
 	
 	adjustToFileName()
+	loadUndoHistory(text)
+	loadFileMarks()
 	getSavedPlace()
+	storeCurrentFile()
+	
+	redrawFullScreen()
 }
 
 func openFileByUser(file_to_open string) {
-	opening_file = file_to_open
-	
-	if LAST_SAVED != getPlainText(&MAIN_TEXTEDIT) {
-		CHECK_FOR_SAVE_CALLBACK = nextOpenFileByUser
-		checkForSave()
-	}else{
-		nextOpenFileByUser()
-	}
+	openFile(file_to_open)
 }
 
-func closeOnCheckDone() {
-	SAVE_CALLBACK = nil
-	CHECK_FOR_SAVE_CALLBACK = nil
-	NEED_TO_EXIT = true
+func continueOpenFileByName() {
+	name := getPlainText(&INPT_TEXTEDIT)
+	
+	if name != "" {
+		openFileByUser(name)
+	}
 }
 
-func nextOpenFileByUser() {
-	CHECK_FOR_SAVE_CALLBACK = nil
-	SAVE_CALLBACK = nil
-	
-	file_name = opening_file
-	openFile()
+func openFileByName() {
+	INPUT_MODAL_CALLBACK = continueOpenFileByName
+	getTextInput("File name?")
 }
 
 func checkForSave() {
@@ -2112,7 +2057,7 @@ func displayError(errorMessage string) {
 	
 	INPUT_MODAL_LABEL = ""
 	INPUT_MODAL_CALLBACK = nil
-	INPT_TEXTEDIT.buffer = []Line{{text: errorMessage, changed: true}}
+	setEditText(&INPT_TEXTEDIT, errorMessage)
 }
 
 func getConfigDir() {
@@ -2208,6 +2153,18 @@ func loadSettings() {
 	colorCOMMENT = getTcellColor(getSpecificVar(known,"colorCOMMENT"), tcell.NewRGBColor(127, 132, 142))
 	colorLITTERAL = getTcellColor(getSpecificVar(known,"colorLITTERAL"), tcell.NewRGBColor(194, 127, 64))
 	SCROLL_SENSITIVITY = getInt(getSpecificVar(known,"SCROLL_SENSITIVITY"), 3)
+	UNDO_MEMORY_LIMIT_KB = getInt(getSpecificVar(known,"UNDO_MEMORY_LIMIT_KB"), 65536)
+	EXPLORER_WIDTH = getInt(getSpecificVar(known,"EXPLORER_WIDTH"), 30)
+	
+	KEY_PROFILE = strings.ToLower(strings.TrimSpace(getSpecificVar(known,"KEY_PROFILE")))
+	if KEY_PROFILE == "" {
+		KEY_PROFILE = "codemage"
+	}
+}
+
+func isSettingsFile(path string) bool {
+	abs_path, err := filepath.Abs(path)
+	return err == nil && abs_path == filepath.Join(APP_CONFIG_DIR, "allSettings.cdmg")
 }
 
 func getcolorSTRING(col tcell.Color) string {
@@ -2284,29 +2241,32 @@ func getSavedPlace() {
 				
 				if nums[0] < 0{
 					nums[0] = 0
-				}else if nums[0] >= len(MAIN_TEXTEDIT.buffer) {
-					nums[0] = len(MAIN_TEXTEDIT.buffer)-1
+				}else if nums[0] >= MAIN_TEXTEDIT.buffer.lineCount() {
+					nums[0] = MAIN_TEXTEDIT.buffer.lineCount()-1
 				}
 				
 				if nums[2] < 0{
 					nums[2] = 0
-				}else if nums[2] >= len(MAIN_TEXTEDIT.buffer) {
-					nums[2] = len(MAIN_TEXTEDIT.buffer)-1
+				}else if nums[2] >= MAIN_TEXTEDIT.buffer.lineCount() {
+					nums[2] = MAIN_TEXTEDIT.buffer.lineCount()-1
 				}
 				
 				if nums[1] < 0{
 					nums[1] = 0
-				}else if nums[1] > len(MAIN_TEXTEDIT.buffer[nums[0]].text) {
-					nums[1] = len(MAIN_TEXTEDIT.buffer[nums[0]].text)
+				}else if nums[1] > MAIN_TEXTEDIT.buffer.lineLen(nums[0]) {
+					nums[1] = MAIN_TEXTEDIT.buffer.lineLen(nums[0])
 				}
 				
 				if nums[3] < 0{
 					nums[3] = 0
-				}else if nums[3] > len(MAIN_TEXTEDIT.buffer[nums[2]].text) {
-					nums[3] = len(MAIN_TEXTEDIT.buffer[nums[2]].text)
+				}else if nums[3] > MAIN_TEXTEDIT.buffer.lineLen(nums[2]) {
+					nums[3] = MAIN_TEXTEDIT.buffer.lineLen(nums[2])
 				}
 				
 				MAIN_TEXTEDIT.cursor.row = nums[0]
+				nums[1] = snapToGrapheme(MAIN_TEXTEDIT.buffer.line(nums[0]), nums[1])
+				nums[3] = snapToGrapheme(MAIN_TEXTEDIT.buffer.line(nums[2]), nums[3])
+				
 				MAIN_TEXTEDIT.cursor.col = nums[1]
 				MAIN_TEXTEDIT.cursor.row_anchor = nums[2]
 				MAIN_TEXTEDIT.cursor.col_anchor = nums[3]
@@ -2319,7 +2279,7 @@ func getSavedPlace() {
 
 func writeHelp() {
 	settings_path := filepath.Join(APP_CONFIG_DIR, "help.cdmg")
-	os.WriteFile(settings_path, []byte("# CodeMage V"+version+"\n\n# A terminal editor designed by Adam Mather.\n\n# Multi-modality:\n\t# CodeMage is designed with a multimodal setup from the start. It's designed to be similar to the CodeWizard 'VIM' mode. Help is available in CodeWizard.\n\n# Keybindings:\n\t# In Normal mode, you may use '[' and ']'  to deindent, and indent the text respectively.\n\t# Ctrl+Q to exit.\n\n# For any more help contact Adam Mather (lol). adamjosephmather@gmail.com"), 0644)
+	os.WriteFile(settings_path, []byte("# CodeMage V"+version+"\n\n# A terminal editor designed by Adam Mather.\n\n# Multi-modality:\n\t# CodeMage is designed with a multimodal setup from the start. It's designed to be similar to the CodeWizard 'VIM' mode. Help is available in CodeWizard.\n\n# Keybindings:\n\t# In Normal mode, you may use '[' and ']'  to deindent, and indent the text respectively.\n\t# Ctrl+Q to exit.\n\n# Normal mode commands:\n\t# Commands follow the vim grammar, [count] operator [count] motion. The operators are d (delete), y (yank), c (change), > (indent) and < (deindent), typing one twice works on whole lines (dd, 3yy, >>).\n\t# Motions are h j k l, w e b (with shift they select instead), $ 0 ^, gg and G (to line [count]), f/t{char} forwards and F/T{char} backwards in the line, ; and , to repeat the last of those. For example 3dw, d2j, ct(, y$.\n\t# An operator on a selection acts on the selection. x deletes a character (or cuts the selection), D C and Y are d$ c$ and yy, p and P paste after and before the cursor. / opens find.\n\t# Text objects work with an operator in place of a motion, or with a selection showing they select the object. i{object} is its inside and a{object} takes in its surroundings: w word, s sentence, p paragraph, \" ' ` quoted text, ( b [ { B < the brackets around the cursor (a count picks the outer ones), i the lines at the same indentation (ai adds the line above). For example diw, ci\", ya(, >ip.\n\n# Visual modes:\n\t# v selects by character, V by whole lines and Ctrl+V a block of columns. Motions and text objects move the end of the selection, o jumps to its other end, pressing the same key again or Esc leaves it.\n\t# An operator (d y c > <) acts on the selection, x deletes it, X D C Y work on its whole lines and p replaces it with what was yanked.\n\t# In block mode I and A insert before or after the block on every row: type on the first row and the text is copied to the others on Esc. A yanked block is pasted back as columns.\n\n# Registers:\n\t# Put \"{register} before a command to yank into or paste from that register, like \"ayy or \"ap. \"a to \"z are yours, \"A to \"Z add on to the end of them.\n\t# \"0 has the last yank, \"1 to \"9 the last deletes of whole lines (newest first) and \"- the last smaller delete. \"+ is the system clipboard and \"_ throws the text away.\n\t# \". (the last inserted text), \"% (the file name) and \"/ (the last search) can only be pasted from.\n\t# Alt+V shows the clipboard history, everything yanked, cut or copied, to pick something to paste.\n\n# Repeating changes:\n\t# . does the last change again at the cursor: an operator with its motion (dw, ci\"), a paste, or everything typed in one go in insert mode. A count before it replaces the count the change was made with.\n\t# Each repeat is undone in one step.\n\n# Macros:\n\t# q{register} starts recording keys into a register and q stops it. @{register} plays them back, with a count in front to play them more than once, and @@ plays the last macro again.\n\t# Playback stops when a motion or find fails, or on Esc or Ctrl+C. The keys are kept as text (<Esc>, <C-Left>...) so a macro can be pasted, changed and yanked back into its register, and macros are remembered between sessions, yanked back ones too.\n\n# Command line:\n\t# : opens the command line at the bottom. :w saves (:w {file} writes a copy to another file), :wq and :x save and close, :q closes the pane or file (:q! throws away its changes, :qa closes everything), :e {file} opens a file and :e! reads the current one again.\n\t# A number goes to that line. A range in front of a command picks the lines it works on: 5,10 . (the cursor line) $ (the last line) % (every line), with +n or -n after any of them (.,+5). Pressing : with a selection fills in '<,'> for its lines.\n\t# :[range]s/pattern/replacement/[flags] replaces matches of a regular expression (written the Go way, (\\w+) not \\(\\w\\+\\)). & or \\0 in the replacement is the whole match, \\1 or $1 a group. g replaces every match on a line instead of the first, i ignores case. It is undone in one step.\n\t# :set shows the options, :set tabstop=8 (ts) scroll=5 explorerwidth=40 undolimit=1024 changes them for this session, :set hidden or nohidden shows hidden files in the explorer.\n\t# Up and Down go through the commands run before, Tab completes command names, file names and options.\n\n# Marks and jumps:\n\t# m{a-z} marks the cursor position in the file, m{A-Z} marks it for all files. '{mark} goes to the start of the mark's line and `{mark} to the mark itself, from another file too for A-Z. Both work after an operator (d'a, y`b) and in a range (:'a,'bs/x/y/).\n\t# '' goes back to where the cursor was before the last jump, '. to the last change, '< and '> to the ends of the last selection.\n\t# G, gg, finds, marks, :{n} and opening or switching files are jumps. Ctrl+O goes back through them (across files) and Ctrl+I or Tab forwards again.\n\t# g; goes back through the places the file was changed and g, forwards.\n\t# Marks and the jump list are remembered between sessions.\n\n# Multiple cursors:\n\t# Ctrl+D selects the word under the cursor, pressing it again adds a cursor selecting the next place that text is found. Alt+D adds one on every place it is found at once.\n\t# Alt+J and Alt+K (or Alt+Down and Alt+Up) add a cursor on the line below or above, Alt+click adds one where you click (or removes the one that is there).\n\t# Typing, deleting, motions, operators and pasting happen at every cursor together and are undone in one step. Ctrl+C copies every selection, one per line. Esc in normal mode goes back to a single cursor.\n\n# Keymap:\n\t# The keys that run commands (saving, switching files, undo, copy...) are bound in keymap.cdmg next to this file, :keymap opens it. Each line is modes keys command, like normal,visual <C-s> save or insert jk keys <Esc>.\n\t# The modes are normal, insert, visual, find and prompt (the command line and other questions). Keys are written like macros and can be a sequence (gq, <C-k><C-c>), which waits a second for the rest before the keys go through as they are.\n\t# The file lists every command and the built in bindings. A binding to nothing takes a key away. Saving the file reads it again, and any line that can't be read is shown.\n\n# Key profiles:\n\t# KEY_PROFILE in the settings picks the keys to start from, keymap.cdmg still changes them on top. Saving the settings switches to it.\n\t# codemage is the modal scheme described here. vim adds the rest of vim to it: u and Ctrl+R undo and redo, n N * # search again, a A I O s S J ~, H M L and zz, ZZ and ZQ, Ctrl+D/U/F/B/E/Y scroll and Ctrl+A/X add to a number.\n\t# emacs is not modal: C-a C-e C-f C-b C-n C-p M-f M-b move, C-k M-d C-w cut onto the kill ring (kills in a row are joined), M-w copies, C-y pastes and M-y right after swaps in the older kills. C-space sets the mark and the selection follows the cursor from it, C-g drops it. C-x C-s saves, C-x C-f opens, C-x b lists the files, C-x 2/3/o/0 split and move between panes.\n\t# cua is not modal, like most editors: Ctrl+C/X/V copy, cut and paste, Ctrl+Z/Y undo and redo, Ctrl+A selects everything, Ctrl+S/O/N/W save, open, make and close files, Ctrl+F finds and Ctrl+G goes to a line. Shift with the arrows, Home, End or a click selects, Tab and Shift+Tab indent a selection.\n\n# Find and replace:\n\t# Ctrl+F (or / in normal mode) opens find with the selection in it. Enter finds the next match and Shift+Enter the one before, Ctrl+R switches to the replace box where Enter replaces the selected match and finds the next. Alt+Enter replaces every match at once (only in the selection with Alt+L), undone in one step. A match can run across lines.\n\t# Typing in the find box goes to the nearest match after the cursor and marks every match on screen, above the box shows which match is selected out of how many. Esc without going to a match with Enter (or replacing one) puts the cursor back where it was.\n\t# Alt+R in the find panel switches to regular expressions, written the Go way: (\\w+) not \\(\\w\\+\\), \\n for a line break, ^ and $ for the ends of lines. In the replacement $1 or ${name} puts in what a group matched ($$ is a $). A pattern that is not valid shows why above the find box.\n\t# The options at the right above the find box switch with a click or a key: Alt+C matches case (it is ignored otherwise), Alt+W only finds whole words, Alt+P replaces keeping the case of the match (foo, Foo and FOO become bar, Bar and BAR) and Alt+L only looks in what was selected when find was opened. Opening find with a selection over several lines turns that on by itself.\n\n# Open files:\n\t# Alt+O opens another file by name, it is added to the open files instead of replacing the current one.\n\t# Alt+N and Alt+P switch to the next and previous open file, Alt+B lists them to pick from (x closes the highlighted one).\n\t# Alt+W closes the current file, asking to save it first if it has changes. Ctrl+Q asks for every file with changes before exiting.\n\n# Panes:\n\t# Ctrl+W then v splits the current pane side by side, Ctrl+W then s splits it one above the other. Both halves start on the same file and scroll separately.\n\t# Ctrl+W then h/j/k/l (or the arrows) moves to the pane in that direction, Ctrl+W then w goes to the next one. Clicking a pane also moves to it.\n\t# Ctrl+W then +/- makes the pane taller or shorter, >/< wider or narrower, = makes them all even.\n\t# Ctrl+W then q closes the pane (the file stays open).\n\n# Explorer:\n\t# Run cdmg with a folder to open it in the explorer sidebar, or press Alt+E to show it for the folder of the current file. Alt+E again (or q) hides it, esc goes back to the text.\n\t# j/k move, enter or l opens a file or expands/collapses a folder, h collapses or goes up to the parent folder. Clicking a row selects it, clicking it again opens it.\n\t# a creates a file in the selected folder (end the name with / for a folder), A creates a folder, r renames and d deletes, each asks to confirm first.\n\t# . shows or hides hidden files, R reads the folder again. Files matched by .gitignore are left out.\n\n# Finding files:\n\t# Ctrl+P lists the files under the folder CodeMage was started in, type any part of a path to narrow it down (the letters only need to be in order, ma/cm finds main/CodeMage.go).\n\t# Up/Down (or Tab) move through the results with a preview of each file on the right, enter opens it and esc or Ctrl+P closes the finder.\n\t# Files matched by .gitignore and binary files are left out, and the list keeps filling in while the folder is still being read.\n\n# Searching in files:\n\t# Alt+F searches the text of every file under the folder CodeMage was started in, with the selection in the box to start. The lines found are listed by file as they come in, Up/Down move through them and enter (or clicking a selected line) opens the file at that line. Esc closes it.\n\t# Alt+C matches case and Alt+R takes the text as a regular expression, the same as in the find panel (clicking them above the box works too).\n\t# Tab moves to the boxes for the files to include and exclude, globs split by commas or spaces like *.go, src/** or vendor. One without a / matches the name of a file or any folder it is in, one with a / the path from the start folder.\n\t# Files matched by .gitignore and binary files are left out.\n\n# Undo:\n\t# Ctrl+Z and Ctrl+Y undo and redo along the current branch. Typing after an undo starts a new branch, nothing is thrown away.\n\t# Alt+Z and Alt+Y step back and forward through every state in the order they were made, across branches.\n\t# Alt+U shows the undo tree, moving through it previews each state, enter keeps it and esc goes back.\n\t# Alt+T travels through the history by time or steps, -5m is the text as it was five minutes earlier, +30s goes forward, -3 goes back three states.\n\t# The undo history of each file is saved when it is closed and comes back the next time it is opened, as long as the file wasn't changed by something else in between.\n\n# For any more help contact Adam Mather (lol). adamjosephmather@gmail.com"), 0644)
 }
 
 func saveSettings() {
@@ -2343,6 +2303,12 @@ func saveSettings() {
 	settings_lines = append(settings_lines, "colorLITTERAL: "+getcolorSTRING(colorLITTERAL))
 	settings_lines = append(settings_lines, "\nDecreasing scroll sensitivity helps make the scrolling look better (lesser changes), but it must be an int >= 0.")
 	settings_lines = append(settings_lines, "SCROLL_SENSITIVITY: "+strconv.Itoa(SCROLL_SENSITIVITY))
+	settings_lines = append(settings_lines, "\nMemory the undo history of each file may use (in KB) before the oldest steps are dropped.")
+	settings_lines = append(settings_lines, "UNDO_MEMORY_LIMIT_KB: "+strconv.Itoa(UNDO_MEMORY_LIMIT_KB))
+	settings_lines = append(settings_lines, "\nWidth of the explorer sidebar in columns (it never takes more than half the screen).")
+	settings_lines = append(settings_lines, "EXPLORER_WIDTH: "+strconv.Itoa(EXPLORER_WIDTH))
+	settings_lines = append(settings_lines, "\nKeys to start from: codemage (the modal keys), vim, emacs or cua (not modal, Ctrl+C/V/Z and shift to select). Saving this file switches to it.")
+	settings_lines = append(settings_lines, "KEY_PROFILE: "+KEY_PROFILE)
 	
 	os.WriteFile(settings_path, []byte(strings.Join(settings_lines, "\n")), 0644)
 }
@@ -2352,6 +2318,13 @@ func main() {
 	loadSettings()
 	saveSettings()
 	writeHelp()
+	loadMacros()
+	loadMarks()
+	setupExCommands()
+	setupKeyCommands()
+	loadKeymap()
+	
+	opening_dir := ""
 	
 	if len(os.Args) > 1 {
 		file_name = os.Args[1]
@@ -2372,8 +2345,7 @@ func main() {
 			return
 		} else {
 			if fileInfo.IsDir() {
-				fmt.Printf("Specified file was a directory.")
-				return
+				opening_dir = absPath
 			}
 		}
 
@@ -2421,14 +2393,18 @@ func main() {
 	if file_name == ""{
 		current_window = "blank"
 		redrawFullScreen()
+	}else if opening_dir != "" {
+		current_window = "edit"
+		createNew()
+		openExplorer(opening_dir)
 	}else{
 		current_window = "edit"
-		openFile()
-		
+		setupUI()
+		openFile(file_name)
 	}
 	
 	for {
-		ev := s.PollEvent()
+		ev := nextEvent()
 		
 		switch ev := ev.(type) {
 		case *tcell.EventKey:
@@ -2438,12 +2414,7 @@ func main() {
 			}
 			
 			if handleKey(ev) { // exit condition
-				if LAST_SAVED == getPlainText(&MAIN_TEXTEDIT) {
-					savePlace()
-					return
-				}
-				CHECK_FOR_SAVE_CALLBACK = closeOnCheckDone
-				checkForSave()
+				quitEditor()
 			}
 			
 			
@@ -2451,26 +2422,28 @@ func main() {
 		case *tcell.EventMouse:
 			if current_window == "edit" {
 				if handleMouse(ev) {
-					if LAST_SAVED == getPlainText(&MAIN_TEXTEDIT) {
-						savePlace()
-						return
-					}
-					CHECK_FOR_SAVE_CALLBACK = closeOnCheckDone
-					checkForSave()
+					quitEditor()
 				}
 				
 				drawFullEdit()
 			}
 		case *tcell.EventResize:
 			redrawFullScreen()
+		case *tcell.EventInterrupt:
+			if fn, ok := ev.Data().(func()); ok { // work from another goroutine that has to finish on this one
+				fn()
+			}
+			
+			if current_window == "edit" {
+				drawFullEdit()
+			}
 		
 		default:
 			// You can choose to log or ignore other event types
 		}
 		
 		if NEED_TO_EXIT {
-			savePlace()
-			return // this is the exit condition
+			return // this is the exit condition, every file was already closed
 		}
 		
 		s.Show()
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Every open file keeps its own Edit (text, undo tree, cursor) and file
+// details here. The rest of the editor only ever works on the current one
+// through MAIN_TEXTEDIT, file_name, absolute_path, title and LAST_SAVED, so
+// switching files stores those globals back into OPEN_FILES and loads the
+// next file's into them.
+
+type OpenFile struct {
+	edit Edit
+	file_name string
+	absolute_path string
+	title string
+	last_saved string
+}
+
+var OPEN_FILES []*OpenFile
+var CURRENT_FILE int = -1
+var QUITTING bool // closing every file one after the other, then exiting
+
+func storeCurrentFile() {
+	if CURRENT_FILE < 0 || CURRENT_FILE >= len(OPEN_FILES) {
+		return
+	}
+
+	file := OPEN_FILES[CURRENT_FILE]
+	file.edit = MAIN_TEXTEDIT
+	file.file_name = file_name
+	file.absolute_path = absolute_path
+	file.title = title
+	file.last_saved = LAST_SAVED
+}
+
+func loadOpenFile(indx int) {
+	file := OPEN_FILES[indx]
+	CURRENT_FILE = indx
+
+	MAIN_TEXTEDIT = file.edit
+	fitFocusedPane()
+	file_name = file.file_name
+	absolute_path = file.absolute_path
+	title = file.title
+	LAST_SAVED = file.last_saved
+
+	hideSuggestions()
+}
+
+func switchToFile(indx int) {
+	if indx < 0 || indx >= len(OPEN_FILES) {
+		return
+	}
+
+	recordJump()
+	storeCurrentFile()
+	loadOpenFile(indx)
+	showCursor(&MAIN_TEXTEDIT)
+	redrawFullScreen()
+}
+
+func cycleFiles(step int) {
+	if len(OPEN_FILES) == 0 {
+		return
+	}
+
+	switchToFile((CURRENT_FILE+step+len(OPEN_FILES)) % len(OPEN_FILES))
+}
+
+// adds an empty, unsaved file and makes it the current one
+func newUntitledFile() {
+	storeCurrentFile()
+
+	MAIN_TEXTEDIT = createEdit()
+	MAIN_TEXTEDIT.is_main = true
+	fitFocusedPane()
+	file_name = ""
+	absolute_path = ""
+	title = "Untitled"
+	LAST_SAVED = ""
+
+	OPEN_FILES = append(OPEN_FILES, &OpenFile{})
+	CURRENT_FILE = len(OPEN_FILES)-1
+	storeCurrentFile()
+}
+
+func findOpenFile(path string) int {
+	storeCurrentFile()
+	abs_path, _ := filepath.Abs(filepath.Clean(path))
+
+	for indx, file := range(OPEN_FILES) {
+		if file.absolute_path == abs_path && file.absolute_path != "" {
+			return indx
+		}
+	}
+
+	return -1
+}
+
+// an Untitled file nobody has typed in yet gets replaced by the next file opened
+func isThrowawayFile() bool {
+	return CURRENT_FILE >= 0 && file_name == "" && LAST_SAVED == "" && MAIN_TEXTEDIT.buffer.textLength() == 0 && len(MAIN_TEXTEDIT.undo_nodes) <= 1 && !isFileInOtherPane(OPEN_FILES[CURRENT_FILE])
+}
+
+// asks to save the current file if it needs it, then closes it
+func closeCurrentFile() {
+	if LAST_SAVED != getPlainText(&MAIN_TEXTEDIT) {
+		CHECK_FOR_SAVE_CALLBACK = finishCloseCurrentFile
+		checkForSave()
+	}else{
+		finishCloseCurrentFile()
+	}
+}
+
+func finishCloseCurrentFile() {
+	CHECK_FOR_SAVE_CALLBACK = nil
+	SAVE_CALLBACK = nil
+
+	if absolute_path != "" {
+		savePlace()
+		saveUndoHistory()
+		storeFileMarks()
+	}
+	saveMarks()
+
+	closed := OPEN_FILES[CURRENT_FILE]
+	OPEN_FILES = append(OPEN_FILES[:CURRENT_FILE], OPEN_FILES[CURRENT_FILE+1:]...)
+	next := min(CURRENT_FILE, len(OPEN_FILES)-1)
+	CURRENT_FILE = -1
+
+	if QUITTING {
+		if len(OPEN_FILES) == 0 {
+			NEED_TO_EXIT = true
+			return
+		}
+
+		loadOpenFile(0)
+		redrawFullScreen()
+		closeCurrentFile()
+		return
+	}
+
+	closePanesShowing(closed)
+
+	if len(OPEN_FILES) == 0 {
+		newUntitledFile()
+	}else{
+		loadOpenFile(next)
+	}
+
+	showCursor(&MAIN_TEXTEDIT)
+	redrawFullScreen()
+}
+
+func quitEditor() {
+	QUITTING = true
+	closeCurrentFile()
+}
+
+func getFileListRows() []string {
+	storeCurrentFile()
+	rows := []string{}
+
+	for indx, file := range(OPEN_FILES) {
+		text := strconv.Itoa(indx+1)+" "+file.title
+		if file.last_saved != getPlainText(&file.edit) {
+			text += " *"
+		}
+		if file.absolute_path != "" {
+			text += "  "+filepath.Dir(file.absolute_path)
+		}
+
+		rows = append(rows, text)
+	}
+
+	return rows
+}
+
+func fileListHandleKey(ev *tcell.EventKey, indx int) bool {
+	if ev.Key() != tcell.KeyDelete && ev.Rune() != 'x' {
+		return false
+	}
+
+	closePicker()
+	switchToFile(indx)
+	closeCurrentFile()
+
+	return true
+}
+
+func openFileList() {
+	showPicker("Open Files (enter switches, x closes)", getFileListRows(), CURRENT_FILE)
+	PICKER_CHOOSE_CALLBACK = switchToFile
+	PICKER_KEY_CALLBACK = fileListHandleKey
+}
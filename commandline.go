@@ -0,0 +1,923 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// : opens the command line on the bottom row. What is typed there is a line
+// range followed by a command, run when enter is pressed:
+//
+//	:w [file]  :wq  :x  :q  :q!  :qa  :e {file}  :e!  :set {option}
+//	:[range]s/pattern/replacement/[gi]  :{n} goes to line n
+//
+// A range is one line or two split by a comma: a number, . for the cursor
+// line, $ for the last one, '{mark} for the line of a mark ('< and '> are
+// the ends of the last selection), any of them followed by +n or -n, or %
+// for every line (.,+5 or '<,'>).
+// Up and down go back through the commands run before (those starting with
+// what is typed so far), tab completes command names, file names and options.
+//
+// Commands are kept in EX_COMMANDS, anything can add one with addExCommand.
+// The result of a command, or what went wrong, is shown where it was typed
+// until the next key.
+
+type ExCommand struct {
+	name string // the full name
+	short string // the shortest it can be typed as
+	run func(call ExCall)
+	complete func(arg string) []string // what the argument typed so far could become, nil when it can't be completed
+}
+
+type ExCall struct {
+	edit *Edit
+	bang bool // ! after the name
+	arg string
+	has_range bool
+	start int // the rows of the range, both the cursor row when there wasn't one
+	end int
+}
+
+var EX_COMMANDS []*ExCommand
+
+var COMMAND_TEXTEDIT Edit
+var SHOWING_COMMAND_LINE bool
+var COMMAND_MESSAGE string // shown on the bottom row until the next key
+var COMMAND_FAILED_MESSAGE bool
+
+var COMMAND_HISTORY []string // oldest first
+var COMMAND_HISTORY_SIZE = 100
+var COMMAND_HISTORY_INDX int // being looked at with up and down, len(COMMAND_HISTORY) for the line being typed
+var COMMAND_TYPED string // the line being typed, kept while going through the history
+
+var COMMAND_COMPLETIONS []string // whole lines tab goes through
+var COMMAND_COMPLETION_LABELS []string // the part of each that was completed, to list them
+var COMMAND_COMPLETION_INDX int
+
+var LAST_SUBSTITUTE_PATTERN string
+var LAST_SUBSTITUTE_REPLACEMENT string
+
+func addExCommand(name, short string, run func(call ExCall), complete func(arg string) []string) {
+	EX_COMMANDS = append(EX_COMMANDS, &ExCommand{name: name, short: short, run: run, complete: complete})
+}
+
+func setupExCommands() {
+	addExCommand("write", "w", exWrite, completeFilePath)
+	addExCommand("wq", "wq", exWriteQuit, completeFilePath)
+	addExCommand("xit", "x", exExit, completeFilePath)
+	addExCommand("quit", "q", exQuit, nil)
+	addExCommand("qall", "qa", exQuitAll, nil)
+	addExCommand("edit", "e", exEdit, completeFilePath)
+	addExCommand("set", "se", exSet, completeOption)
+	addExCommand("substitute", "s", exSubstitute, nil)
+	addExCommand("keymap", "keym", exKeymap, nil)
+}
+
+// the command typed as name, which can be any part of its full name at least as long as its short one
+func findExCommand(name string) *ExCommand {
+	for _, command := range(EX_COMMANDS) {
+		if strings.HasPrefix(command.name, name) && strings.HasPrefix(name, command.short) {
+			return command
+		}
+	}
+	return nil
+}
+
+func commandMessage(text string) {
+	COMMAND_MESSAGE = text
+	COMMAND_FAILED_MESSAGE = false
+}
+
+// shows what went wrong, and stops a macro that ran the command
+func commandError(text string) {
+	COMMAND_MESSAGE = text
+	COMMAND_FAILED_MESSAGE = true
+	failMacro()
+}
+
+func openCommandLine(edit *Edit, count int) {
+	text := ""
+
+	if edit.visual_mode != "" || hasSelection(edit) {
+		exitVisualMode(edit) // which sets the < and > marks
+		text = "'<,'>"
+	}else if count > 1 {
+		text = ".,.+"+strconv.Itoa(count-1)
+	}
+
+	SHOWING_COMMAND_LINE = true
+	CURRENT_TEXT_EDIT = "command"
+	COMMAND_HISTORY_INDX = len(COMMAND_HISTORY)
+	COMMAND_COMPLETIONS = nil
+	hideSuggestions()
+
+	setCommandText(text)
+}
+
+func closeCommandLine() {
+	SHOWING_COMMAND_LINE = false
+	COMMAND_COMPLETIONS = nil
+	CURRENT_TEXT_EDIT = "main"
+}
+
+func setCommandText(text string) {
+	setEditText(&COMMAND_TEXTEDIT, text)
+	COMMAND_TEXTEDIT.current_mode = "i"
+	COMMAND_TEXTEDIT.cursor = Cursor{col: len(text), col_anchor: len(text)}
+	showCursor(&COMMAND_TEXTEDIT)
+}
+
+func commandLineHandleKey(ev *tcell.EventKey) {
+	text := getPlainText(&COMMAND_TEXTEDIT)
+
+	if ev.Key() == tcell.KeyEscape || ev.Key() == tcell.KeyCtrlC {
+		closeCommandLine()
+		return
+	}else if ev.Key() == tcell.KeyEnter {
+		closeCommandLine()
+		addCommandHistory(text)
+		runExCommand(text)
+		return
+	}else if (ev.Key() == tcell.KeyBackspace || ev.Key() == tcell.KeyBackspace2) && text == "" {
+		closeCommandLine()
+		return
+	}else if ev.Key() == tcell.KeyUp {
+		browseCommandHistory(-1)
+		return
+	}else if ev.Key() == tcell.KeyDown {
+		browseCommandHistory(1)
+		return
+	}else if ev.Key() == tcell.KeyTab {
+		completeCommand(1)
+		return
+	}else if ev.Key() == tcell.KeyBacktab {
+		completeCommand(-1)
+		return
+	}
+
+	editHandleKey(ev, &COMMAND_TEXTEDIT)
+	COMMAND_TEXTEDIT.current_mode = "i" // always being typed
+	COMMAND_HISTORY_INDX = len(COMMAND_HISTORY)
+	COMMAND_COMPLETIONS = nil
+}
+
+func addCommandHistory(text string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+
+	history := []string{}
+	for _, old := range(COMMAND_HISTORY) {
+		if old != text {
+			history = append(history, old)
+		}
+	}
+	history = append(history, text)
+
+	if len(history) > COMMAND_HISTORY_SIZE {
+		history = history[len(history)-COMMAND_HISTORY_SIZE:]
+	}
+	COMMAND_HISTORY = history
+}
+
+// steps through the commands run before that start with what was typed
+func browseCommandHistory(step int) {
+	if COMMAND_HISTORY_INDX == len(COMMAND_HISTORY) {
+		COMMAND_TYPED = getPlainText(&COMMAND_TEXTEDIT)
+	}
+	COMMAND_COMPLETIONS = nil
+
+	for indx := COMMAND_HISTORY_INDX+step; indx >= 0 && indx <= len(COMMAND_HISTORY); indx += step {
+		if indx == len(COMMAND_HISTORY) {
+			COMMAND_HISTORY_INDX = indx
+			setCommandText(COMMAND_TYPED)
+			return
+		}
+		if strings.HasPrefix(COMMAND_HISTORY[indx], COMMAND_TYPED) {
+			COMMAND_HISTORY_INDX = indx
+			setCommandText(COMMAND_HISTORY[indx])
+			return
+		}
+	}
+}
+
+// splits a command line into its range, command name, ! and argument without working any of them out
+func splitCommandLine(text string) (string, string, bool, string) {
+	end := 0
+	for end < len(text) && strings.ContainsRune(" \t0123456789.,;$%+-'", rune(text[end])) {
+		if text[end] == '\'' && end+1 < len(text) {
+			end ++ // the mark name
+		}
+		end ++
+	}
+	range_text := text[:end]
+	text = text[end:]
+
+	end = 0
+	for end < len(text) && unicode.IsLetter(rune(text[end])) {
+		end ++
+	}
+	name := text[:end]
+	text = text[end:]
+
+	bang := strings.HasPrefix(text, "!")
+	if bang {
+		text = text[1:]
+	}
+
+	return range_text, name, bang, strings.TrimSpace(text)
+}
+
+// reads a line address from the start of text, returning its row and the text after it
+func parseAddress(edit *Edit, text string) (int, string, bool) {
+	row := edit.cursor.row
+	found := false
+
+	if strings.HasPrefix(text, ".") {
+		text = text[1:]
+		found = true
+	}else if strings.HasPrefix(text, "$") {
+		row = edit.buffer.lineCount()-1
+		text = text[1:]
+		found = true
+	}else if strings.HasPrefix(text, "'") && len(text) > 1 {
+		mark_row, _, ok := getMarkPosition(edit, rune(text[1]))
+		if !ok {
+			commandError("Mark not set: "+text[:2])
+			return 0, text, false
+		}
+
+		row = mark_row
+		text = text[2:]
+		found = true
+	}else if len(text) > 0 && unicode.IsDigit(rune(text[0])) {
+		digits := strings.TrimLeftFunc(text, unicode.IsDigit)
+		number, _ := strconv.Atoi(text[:len(text)-len(digits)])
+		row = number-1
+		text = digits
+		found = true
+	}
+
+	for len(text) > 0 && (text[0] == '+' || text[0] == '-') {
+		sign := 1
+		if text[0] == '-' {
+			sign = -1
+		}
+
+		digits := strings.TrimLeftFunc(text[1:], unicode.IsDigit)
+		offset := 1
+		if len(digits) < len(text)-1 {
+			offset, _ = strconv.Atoi(text[1:len(text)-len(digits)])
+		}
+
+		row += sign*offset
+		text = digits
+		found = true
+	}
+
+	return row, text, found
+}
+
+// works out the rows of a range, false when it isn't one
+func parseRange(edit *Edit, text string) (int, int, bool, bool) {
+	text = strings.ReplaceAll(strings.ReplaceAll(text, " ", ""), "\t", "")
+	if text == "" {
+		return edit.cursor.row, edit.cursor.row, false, true
+	}
+	if text == "%" {
+		return 0, edit.buffer.lineCount()-1, true, true
+	}
+
+	start, rest, found := parseAddress(edit, text)
+	if !found {
+		if COMMAND_MESSAGE == "" {
+			commandError("Invalid range: "+text)
+		}
+		return 0, 0, false, false
+	}
+
+	end := start
+	if strings.HasPrefix(rest, ",") || strings.HasPrefix(rest, ";") {
+		end, rest, found = parseAddress(edit, rest[1:])
+		if !found {
+			if COMMAND_MESSAGE == "" {
+				commandError("Invalid range: "+text)
+			}
+			return 0, 0, false, false
+		}
+	}
+
+	if rest != "" {
+		commandError("Invalid range: "+text)
+		return 0, 0, false, false
+	}
+
+	if start > end {
+		start, end = end, start
+	}
+	if start < 0 || end >= edit.buffer.lineCount() {
+		commandError("Range goes past the text: "+text)
+		return 0, 0, false, false
+	}
+
+	return start, end, true, true
+}
+
+// runs a command line as if it was typed after :
+func runExCommand(text string) {
+	edit := &MAIN_TEXTEDIT
+	COMMAND_MESSAGE = ""
+	COMMAND_FAILED_MESSAGE = false
+
+	range_text, name, bang, arg := splitCommandLine(strings.TrimSpace(text))
+	if range_text+name == "" && !bang && arg == "" {
+		return
+	}
+
+	start, end, has_range, ok := parseRange(edit, range_text)
+	if !ok {
+		return
+	}
+
+	if name == "" && !bang && arg == "" { // just a line number
+		recordJump()
+		moveToTarget(edit, MotionTarget{end, getFirstNonBlank(edit, end), MOTION_EXCLUSIVE}, false)
+		showCursor(edit)
+		return
+	}
+
+	command := findExCommand(name)
+	if command == nil {
+		commandError("Not an editor command: "+strings.TrimSpace(text))
+		return
+	}
+
+	command.run(ExCall{edit: edit, bang: bang, arg: arg, has_range: has_range, start: start, end: end})
+}
+
+// tab: fills in the command name, or its argument, going through what it could be on each press
+func completeCommand(step int) {
+	text := getPlainText(&COMMAND_TEXTEDIT)
+
+	if len(COMMAND_COMPLETIONS) > 0 && text == COMMAND_COMPLETIONS[COMMAND_COMPLETION_INDX] {
+		COMMAND_COMPLETION_INDX = (COMMAND_COMPLETION_INDX+step+len(COMMAND_COMPLETIONS))%len(COMMAND_COMPLETIONS)
+		setCommandText(COMMAND_COMPLETIONS[COMMAND_COMPLETION_INDX])
+		return
+	}
+
+	range_text, name, bang, arg := splitCommandLine(text)
+	completions := []string{}
+	labels := []string{}
+
+	if !bang && arg == "" && !strings.HasSuffix(text, " ") {
+		for _, command := range(EX_COMMANDS) {
+			if strings.HasPrefix(command.name, name) {
+				completions = append(completions, range_text+command.name)
+				labels = append(labels, command.name)
+			}
+		}
+	}else if command := findExCommand(name); command != nil && command.complete != nil {
+		start := range_text+name
+		if bang {
+			start += "!"
+		}
+
+		for _, completion := range(command.complete(arg)) {
+			completions = append(completions, start+" "+completion)
+
+			// just the last word or file name of it
+			label := strings.TrimSuffix(completion, "/")
+			label = label[strings.LastIndexAny(label, " /")+1:]+completion[len(strings.TrimSuffix(completion, "/")):]
+			labels = append(labels, label)
+		}
+	}
+
+	COMMAND_COMPLETIONS = nil
+	if len(completions) == 0 {
+		return
+	}
+
+	COMMAND_COMPLETIONS = completions
+	COMMAND_COMPLETION_LABELS = labels
+	COMMAND_COMPLETION_INDX = 0
+	if step < 0 {
+		COMMAND_COMPLETION_INDX = len(completions)-1
+	}
+	setCommandText(completions[COMMAND_COMPLETION_INDX])
+}
+
+// the files and folders arg could be the start of, folders ending in /
+func completeFilePath(arg string) []string {
+	dir, base := filepath.Split(arg)
+
+	look_in := dir
+	if look_in == "" {
+		look_in = "."
+	}
+
+	entries, err := os.ReadDir(look_in)
+	if err != nil {
+		return nil
+	}
+
+	paths := []string{}
+	for _, entry := range(entries) {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) || strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+
+		if entry.IsDir() {
+			name += "/"
+		}
+		paths = append(paths, dir+name)
+	}
+
+	return paths
+}
+
+func layoutCommandLine(width, height int) {
+	COMMAND_TEXTEDIT.row = height-1
+	COMMAND_TEXTEDIT.col = 1
+	COMMAND_TEXTEDIT.width = max(width-1, 1)
+	COMMAND_TEXTEDIT.height = 1
+}
+
+func drawCommandLine() {
+	width, height := s.Size()
+
+	if SHOWING_COMMAND_LINE {
+		emitStr(0, height-1, DEF_STYLE, ":")
+		drawEdit(&COMMAND_TEXTEDIT, CURRENT_TEXT_EDIT == "command")
+
+		if len(COMMAND_COMPLETIONS) > 1 { // what else tab could give, on the row above
+			emitStr(0, height-2, TITLE_STYLE, strings.Repeat(" ", width))
+
+			x := 1
+			for indx, label := range(COMMAND_COMPLETION_LABELS) {
+				if x+runewidth.StringWidth(label) >= width {
+					emitStr(x, height-2, TITLE_STYLE, "…")
+					break
+				}
+
+				style := TITLE_STYLE
+				if indx == COMMAND_COMPLETION_INDX {
+					style = INVERTED_STYLE
+				}
+				emitStr(x, height-2, style, label)
+				x += runewidth.StringWidth(label)+2
+			}
+		}
+	}else if COMMAND_MESSAGE != "" {
+		style := DEF_STYLE
+		if COMMAND_FAILED_MESSAGE {
+			style = NORMAL_MODE_STYLE
+		}
+
+		emitStr(0, height-1, style, runewidth.FillRight(runewidth.Truncate(COMMAND_MESSAGE, width, "…"), width))
+	}
+}
+
+func exWrite(call ExCall) {
+	if call.arg == "" || call.arg == file_name {
+		saveFile()
+		return
+	}
+
+	if file_name == "" { // the unnamed file takes the name it is written with
+		file_name = call.arg
+		if !saveFile() {
+			file_name = ""
+			return
+		}
+		adjustToFileName()
+		commandMessage("Written to "+call.arg)
+		return
+	}
+
+	if _, err := os.Stat(call.arg); err == nil && !call.bang {
+		commandError(call.arg+" already exists (add ! to write over it)")
+		return
+	}
+
+	err := os.WriteFile(call.arg, []byte(getPlainText(call.edit)), 0644)
+	if err != nil {
+		commandError("Error writing file: "+err.Error())
+		return
+	}
+	commandMessage("Written to "+call.arg)
+}
+
+// closes the current pane, or when there is only one the current file, and
+// the editor with it if it was the last one
+func quitFile(force bool) {
+	if ROOT_PANE.pane == nil {
+		closePane() // the file stays open
+		return
+	}
+
+	if !force && LAST_SAVED != getPlainText(&MAIN_TEXTEDIT) {
+		commandError("No write since last change (add ! to override)")
+		return
+	}
+
+	if len(OPEN_FILES) <= 1 {
+		QUITTING = true
+	}
+	finishCloseCurrentFile()
+}
+
+func exQuit(call ExCall) {
+	quitFile(call.bang)
+}
+
+func exQuitAll(call ExCall) {
+	if call.bang { // every file counts as saved, so nothing asks
+		storeCurrentFile()
+		for _, file := range(OPEN_FILES) {
+			file.last_saved = getPlainText(&file.edit)
+		}
+		LAST_SAVED = getPlainText(&MAIN_TEXTEDIT)
+	}
+	quitEditor()
+}
+
+// writes the file (to call.arg if given) then quits, which still asks with ! missing if it was written somewhere else
+func exWriteQuit(call ExCall) {
+	if file_name == "" && call.arg == "" {
+		SAVE_CALLBACK = func() { quitFile(false) }
+		saveFile() // asks for a name first, and quits once it is written with it
+		return
+	}
+
+	exWrite(call)
+	if !COMMAND_FAILED_MESSAGE {
+		quitFile(call.bang)
+	}
+}
+
+// like :wq, but only writes if there are changes
+func exExit(call ExCall) {
+	if LAST_SAVED == getPlainText(call.edit) && call.arg == "" {
+		quitFile(true)
+		return
+	}
+	exWriteQuit(call)
+}
+
+func exEdit(call ExCall) {
+	if call.arg != "" {
+		openFileByUser(call.arg)
+		return
+	}
+
+	// no name reads the current file again
+	if file_name == "" {
+		commandError("No file name")
+		return
+	}
+	if !call.bang && LAST_SAVED != getPlainText(call.edit) {
+		commandError("No write since last change (add ! to override)")
+		return
+	}
+
+	contents, err := os.ReadFile(file_name)
+	if err != nil {
+		commandError("Error opening file: "+err.Error())
+		return
+	}
+
+	text := strings.ReplaceAll(string(contents), "\r\n", "\n")
+	text = strings.TrimSuffix(text, "\n")
+
+	edit := call.edit
+	if text != getPlainText(edit) { // as one change, so it can be undone
+		syncUndoCursor(edit)
+		last := edit.buffer.lineCount()-1
+		edit.buffer.remove(0, 0, last, edit.buffer.lineLen(last))
+		edit.buffer.insert(0, 0, text)
+
+		row := min(edit.cursor.row, edit.buffer.lineCount()-1)
+		moveToTarget(edit, MotionTarget{row, min(edit.cursor.col, edit.buffer.lineLen(row)), MOTION_EXCLUSIVE}, false)
+		showCursor(edit)
+		readyUndoHistory(edit)
+	}
+
+	LAST_SAVED = text
+	commandMessage("Read "+file_name)
+}
+
+// turns a vim replacement (& \1 \n) into one regexp can expand, leaving $1 and ${name} as they are
+func convertReplacement(replacement string) string {
+	result := ""
+
+	for indx := 0; indx < len(replacement); indx++ {
+		char := replacement[indx]
+
+		if char == '&' {
+			result += "${0}"
+		}else if char == '\\' && indx+1 < len(replacement) {
+			indx ++
+			next := replacement[indx]
+
+			if next >= '0' && next <= '9' {
+				result += "${"+string(next)+"}"
+			}else if next == 'n' || next == 'r' {
+				result += "\n"
+			}else if next == 't' {
+				result += "\t"
+			}else if next == '$' {
+				result += "$$"
+			}else{
+				result += string(next) // \& \\ and the like are the character itself
+			}
+		}else{
+			result += string(char)
+		}
+	}
+
+	return result
+}
+
+// splits s/pattern/replacement/flags on its separator, which can be any punctuation
+func parseSubstitute(arg string) ([]string, bool) {
+	if arg == "" {
+		return []string{"", "", ""}, true
+	}
+
+	sep := arg[0]
+	if !strings.ContainsRune(PUNCTUATION, rune(sep)) || sep == '\\' || sep == '"' {
+		return nil, false
+	}
+
+	parts := []string{""}
+	for indx := 1; indx < len(arg); indx++ {
+		if arg[indx] == '\\' && indx+1 < len(arg) && arg[indx+1] == sep {
+			parts[len(parts)-1] += string(sep)
+			indx ++
+		}else if arg[indx] == '\\' && indx+1 < len(arg) {
+			parts[len(parts)-1] += arg[indx:indx+2]
+			indx ++
+		}else if arg[indx] == sep && len(parts) < 3 {
+			parts = append(parts, "")
+		}else{
+			parts[len(parts)-1] += string(arg[indx])
+		}
+	}
+
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return parts, true
+}
+
+func exSubstitute(call ExCall) {
+	parts, ok := parseSubstitute(call.arg)
+	if !ok {
+		commandError("The pattern has to start with a separator like /")
+		return
+	}
+	pattern, replacement, flags := parts[0], parts[1], strings.TrimSpace(parts[2])
+
+	if call.arg == "" { // :s on its own does the last one again
+		replacement = LAST_SUBSTITUTE_REPLACEMENT
+	}
+	if pattern == "" {
+		pattern = LAST_SUBSTITUTE_PATTERN
+	}
+	if pattern == "" {
+		commandError("No previous pattern")
+		return
+	}
+
+	global := false
+	prefix := ""
+	for _, flag := range(flags) {
+		if flag == 'g' {
+			global = true
+		}else if flag == 'i' {
+			prefix = "(?i)"
+		}else if flag == 'I' {
+			prefix = ""
+		}else{
+			commandError("Unknown flag: "+string(flag))
+			return
+		}
+	}
+
+	// \< and \> are word edges in vim
+	re, err := regexp.Compile(prefix+strings.NewReplacer(`\<`, `\b`, `\>`, `\b`).Replace(pattern))
+	if err != nil {
+		commandError("Invalid pattern: "+err.Error())
+		return
+	}
+
+	LAST_SUBSTITUTE_PATTERN = pattern
+	LAST_SUBSTITUTE_REPLACEMENT = replacement
+
+	edit := call.edit
+	syncUndoCursor(edit)
+
+	count, lines, last_row := substituteLines(edit, call.start, call.end, re, convertReplacement(replacement), global)
+	if count == 0 {
+		commandError("Pattern not found: "+pattern)
+		return
+	}
+
+	moveToTarget(edit, MotionTarget{last_row, getFirstNonBlank(edit, last_row), MOTION_EXCLUSIVE}, false)
+	showCursor(edit)
+	readyUndoHistory(edit) // all of it is one step to undo
+
+	commandMessage(pluralize(count, "substitution")+" on "+pluralize(lines, "line"))
+}
+
+// replaces re in rows start to end, returning how many were replaced, on how many lines, and the last row changed
+func substituteLines(edit *Edit, start, end int, re *regexp.Regexp, replacement string, global bool) (int, int, int) {
+	count, lines, last_row := 0, 0, start
+
+	for row := start; row <= end && row < edit.buffer.lineCount(); row++ {
+		line := edit.buffer.line(row)
+
+		matches := re.FindAllStringSubmatchIndex(line, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		if !global {
+			matches = matches[:1]
+		}
+
+		result := []byte{}
+		last := 0
+		for _, match := range(matches) {
+			result = append(result, line[last:match[0]]...)
+			result = re.ExpandString(result, replacement, line, match)
+			last = match[1]
+		}
+		result = append(result, line[last:]...)
+
+		if string(result) != line {
+			edit.buffer.remove(row, 0, row, len(line))
+			edit.buffer.insert(row, 0, string(result))
+		}
+
+		added := strings.Count(string(result), "\n") // the replacement can break the line
+		count += len(matches)
+		lines ++
+		last_row = row+added
+		row += added
+		end += added
+	}
+
+	return count, lines, last_row
+}
+
+func pluralize(count int, word string) string {
+	if count == 1 {
+		return "1 "+word
+	}
+	return strconv.Itoa(count)+" "+word+"s"
+}
+
+// Options :set can change. A number option is set with name=value, a flag
+// with name, noname to turn it off or name! to flip it, name? shows either.
+
+type ExOption struct {
+	name string
+	short string // another name for it, "" when it has none
+	number *int
+	min int // the lowest a number can be
+	flag *bool
+	changed func() // called after it is set, nil when nothing needs doing
+}
+
+var EX_OPTIONS = []*ExOption{
+	{name: "tabstop", short: "ts", number: &TAB_WIDTH, min: 1, changed: redrawFullScreen},
+	{name: "scroll", short: "scr", number: &SCROLL_SENSITIVITY, min: 0},
+	{name: "explorerwidth", short: "ew", number: &EXPLORER_WIDTH, min: 1, changed: redrawFullScreen},
+	{name: "undolimit", short: "ul", number: &UNDO_MEMORY_LIMIT_KB, min: 0},
+	{name: "hidden", short: "", flag: &SHOW_HIDDEN_FILES, changed: refreshOpenExplorer},
+}
+
+func refreshOpenExplorer() {
+	if EXPLORER_ROOT != "" {
+		refreshExplorer()
+	}
+}
+
+func findExOption(name string) *ExOption {
+	for _, option := range(EX_OPTIONS) {
+		if option.name == name || option.short != "" && option.short == name {
+			return option
+		}
+	}
+	return nil
+}
+
+func formatOption(option *ExOption) string {
+	if option.flag != nil && *option.flag {
+		return option.name
+	}else if option.flag != nil {
+		return "no"+option.name
+	}
+	return option.name+"="+strconv.Itoa(*option.number)
+}
+
+func exSet(call ExCall) {
+	if call.arg == "" {
+		shown := []string{}
+		for _, option := range(EX_OPTIONS) {
+			shown = append(shown, formatOption(option))
+		}
+		commandMessage(strings.Join(shown, "  "))
+		return
+	}
+
+	shown := []string{}
+
+	for _, setting := range(strings.Fields(call.arg)) {
+		name, value, has_value := strings.Cut(setting, "=")
+		show := strings.HasSuffix(name, "?")
+		flip := strings.HasSuffix(name, "!")
+		name = strings.TrimRight(name, "?!")
+
+		option := findExOption(name)
+		turn_off := false
+		if option == nil && strings.HasPrefix(name, "no") {
+			option = findExOption(name[2:])
+			turn_off = true
+		}else if option == nil && strings.HasPrefix(name, "inv") {
+			option = findExOption(name[3:])
+			flip = true
+		}
+
+		if option == nil || (turn_off || flip) && option.flag == nil {
+			commandError("Unknown option: "+setting)
+			return
+		}
+
+		if show || option.number != nil && !has_value {
+			shown = append(shown, formatOption(option))
+			continue
+		}
+
+		if option.flag != nil {
+			if has_value {
+				commandError("Not a number option: "+setting)
+				return
+			}
+			if flip {
+				*option.flag = !*option.flag
+			}else{
+				*option.flag = !turn_off
+			}
+		}else{
+			number, err := strconv.Atoi(value)
+			if err != nil || number < option.min {
+				commandError("Invalid value: "+setting)
+				return
+			}
+			*option.number = number
+		}
+
+		if option.changed != nil {
+			option.changed()
+		}
+	}
+
+	commandMessage(strings.Join(shown, "  "))
+}
+
+// the options the last word of arg could be, with the words before it kept
+func completeOption(arg string) []string {
+	before := ""
+	word := arg
+	if indx := strings.LastIndexAny(arg, " \t"); indx != -1 {
+		before, word = arg[:indx+1], arg[indx+1:]
+	}
+
+	names := []string{}
+	for _, option := range(EX_OPTIONS) {
+		names = append(names, option.name)
+		if option.flag != nil {
+			names = append(names, "no"+option.name)
+		}
+	}
+	sort.Strings(names)
+
+	completions := []string{}
+	for _, name := range(names) {
+		if strings.HasPrefix(name, word) {
+			completions = append(completions, before+name)
+		}
+	}
+
+	return completions
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// The explorer is the sidebar on the left with the tree of a directory. The
+// rows are kept as text in EXPLORER_TEXTEDIT so drawEdit can draw it like any
+// other list, EXPLORER_ENTRIES says which file or folder each row is.
+
+type ExplorerEntry struct {
+	path string
+	name string
+	is_dir bool
+	depth int
+}
+
+var EXPLORER_TEXTEDIT Edit
+var SHOWING_EXPLORER bool
+var EXPLORER_FOCUSED bool
+var EXPLORER_ROOT string
+var EXPLORER_ENTRIES []ExplorerEntry
+var EXPLORER_EXPANDED map[string]bool = map[string]bool{}
+var EXPLORER_IGNORES *IgnoreCache
+var SHOW_HIDDEN_FILES bool
+var EXPLORER_WIDTH int = 30
+
+func openExplorer(root string) {
+	if root == "" {
+		root = EXPLORER_ROOT
+	}
+	if root == "" && absolute_path != "" {
+		root = filepath.Dir(absolute_path)
+	}
+	if root == "" {
+		root, _ = os.Getwd()
+	}
+
+	if root != EXPLORER_ROOT {
+		EXPLORER_ROOT = root
+		EXPLORER_EXPANDED = map[string]bool{root: true}
+		refreshExplorer()
+		selectExplorerRow(0)
+	}
+
+	SHOWING_EXPLORER = true
+	focusExplorer()
+}
+
+func focusExplorer() {
+	EXPLORER_FOCUSED = true
+	CURRENT_TEXT_EDIT = "explorer"
+	hideSuggestions()
+	redrawFullScreen()
+}
+
+func unfocusExplorer() {
+	EXPLORER_FOCUSED = false
+	CURRENT_TEXT_EDIT = "main"
+	redrawFullScreen()
+}
+
+func hideExplorer() {
+	SHOWING_EXPLORER = false
+	unfocusExplorer()
+}
+
+func toggleExplorer() {
+	if !SHOWING_EXPLORER || !EXPLORER_FOCUSED {
+		openExplorer("")
+	}else{
+		hideExplorer()
+	}
+}
+
+func listExplorerDir(dir string, depth int) {
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].IsDir() != items[j].IsDir() {
+			return items[i].IsDir() // folders first
+		}
+		return strings.ToLower(items[i].Name()) < strings.ToLower(items[j].Name())
+	})
+
+	for _, item := range(items) {
+		full_path := filepath.Join(dir, item.Name())
+		is_dir := item.IsDir()
+
+		if !SHOW_HIDDEN_FILES && strings.HasPrefix(item.Name(), ".") {
+			continue
+		}
+		if EXPLORER_IGNORES.isIgnored(full_path, is_dir) {
+			continue
+		}
+
+		EXPLORER_ENTRIES = append(EXPLORER_ENTRIES, ExplorerEntry{path: full_path, name: item.Name(), is_dir: is_dir, depth: depth})
+
+		if is_dir && EXPLORER_EXPANDED[full_path] {
+			listExplorerDir(full_path, depth+1)
+		}
+	}
+}
+
+// reads the tree again from disk, keeping the same row selected if it is still there
+func refreshExplorer() {
+	selected := ""
+	if row := EXPLORER_TEXTEDIT.cursor.row; row < len(EXPLORER_ENTRIES) {
+		selected = EXPLORER_ENTRIES[row].path
+	}
+
+	EXPLORER_IGNORES = newIgnoreCache(EXPLORER_ROOT)
+	EXPLORER_ENTRIES = []ExplorerEntry{{path: EXPLORER_ROOT, name: filepath.Base(EXPLORER_ROOT), is_dir: true, depth: 0}}
+	listExplorerDir(EXPLORER_ROOT, 1)
+
+	rows := []string{}
+	for _, entry := range(EXPLORER_ENTRIES) {
+		text := strings.Repeat("  ", entry.depth)
+		if entry.is_dir && EXPLORER_EXPANDED[entry.path] {
+			text += "▾ "+entry.name+"/"
+		}else if entry.is_dir {
+			text += "▸ "+entry.name+"/"
+		}else{
+			text += "  "+entry.name
+		}
+		rows = append(rows, text)
+	}
+
+	setEditText(&EXPLORER_TEXTEDIT, strings.Join(rows, "\n"))
+
+	row := 0
+	for indx, entry := range(EXPLORER_ENTRIES) {
+		if entry.path == selected {
+			row = indx
+		}
+	}
+	selectExplorerRow(row)
+}
+
+func selectExplorerRow(row int) {
+	selectListRow(&EXPLORER_TEXTEDIT, row)
+}
+
+func getExplorerEntry() ExplorerEntry {
+	return EXPLORER_ENTRIES[EXPLORER_TEXTEDIT.cursor.row]
+}
+
+// the folder new files go in: the selected folder, or the one holding the selected file
+func getExplorerDir() string {
+	entry := getExplorerEntry()
+	if entry.is_dir {
+		return entry.path
+	}
+	return filepath.Dir(entry.path)
+}
+
+func activateExplorerEntry() {
+	entry := getExplorerEntry()
+
+	if entry.is_dir {
+		if entry.path != EXPLORER_ROOT {
+			EXPLORER_EXPANDED[entry.path] = !EXPLORER_EXPANDED[entry.path]
+			refreshExplorer()
+		}
+		return
+	}
+
+	unfocusExplorer()
+	openFileByUser(entry.path)
+}
+
+func collapseExplorerEntry() {
+	entry := getExplorerEntry()
+
+	if entry.is_dir && EXPLORER_EXPANDED[entry.path] && entry.path != EXPLORER_ROOT {
+		EXPLORER_EXPANDED[entry.path] = false
+		refreshExplorer()
+		return
+	}
+
+	// otherwise go up to the folder it is in
+	parent := filepath.Dir(entry.path)
+	for indx, other := range(EXPLORER_ENTRIES) {
+		if other.path == parent {
+			selectExplorerRow(indx)
+		}
+	}
+}
+
+var EXPLORER_PENDING_PATH string // the path waiting on the yes/no confirmation
+var EXPLORER_PENDING_TARGET string
+var EXPLORER_PENDING_DIR bool
+
+func afterExplorerInput() {
+	EXPLORER_FOCUSED = true
+	CURRENT_TEXT_EDIT = "explorer"
+}
+
+func createExplorerEntry(as_dir bool) {
+	EXPLORER_PENDING_DIR = as_dir
+	INPUT_MODAL_CALLBACK = continueCreateExplorerEntry
+
+	if as_dir {
+		getTextInput("New folder name?")
+	}else{
+		getTextInput("New file? (name/ for a folder)")
+	}
+}
+
+func continueCreateExplorerEntry() {
+	afterExplorerInput()
+	name := getPlainText(&INPT_TEXTEDIT)
+	if name == "" {
+		return
+	}
+
+	if strings.HasSuffix(name, "/") {
+		EXPLORER_PENDING_DIR = true
+	}
+
+	EXPLORER_PENDING_PATH = filepath.Join(getExplorerDir(), name)
+	INPUT_MODAL_CALLBACK = finishCreateExplorerEntry
+	getBoolInput("Create "+filepath.Base(EXPLORER_PENDING_PATH)+"?")
+}
+
+func finishCreateExplorerEntry() {
+	afterExplorerInput()
+	if !CURRENT_SELECTED_BOOL {
+		return
+	}
+
+	var err error
+	if EXPLORER_PENDING_DIR {
+		err = os.MkdirAll(EXPLORER_PENDING_PATH, 0755)
+	}else{
+		err = os.MkdirAll(filepath.Dir(EXPLORER_PENDING_PATH), 0755)
+		if err == nil {
+			var file *os.File
+			file, err = os.OpenFile(EXPLORER_PENDING_PATH, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err == nil {
+				file.Close()
+			}
+		}
+	}
+
+	if err != nil {
+		displayError("Error creating: "+err.Error())
+		return
+	}
+
+	// show where it went
+	for dir := filepath.Dir(EXPLORER_PENDING_PATH); strings.HasPrefix(dir, EXPLORER_ROOT); dir = filepath.Dir(dir) {
+		EXPLORER_EXPANDED[dir] = true
+		if dir == EXPLORER_ROOT {
+			break
+		}
+	}
+	refreshExplorer()
+	selectExplorerPath(EXPLORER_PENDING_PATH)
+}
+
+func selectExplorerPath(full_path string) {
+	for indx, entry := range(EXPLORER_ENTRIES) {
+		if entry.path == full_path {
+			selectExplorerRow(indx)
+		}
+	}
+}
+
+func renameExplorerEntry() {
+	entry := getExplorerEntry()
+	if entry.path == EXPLORER_ROOT {
+		return
+	}
+
+	EXPLORER_PENDING_PATH = entry.path
+	INPUT_MODAL_CALLBACK = continueRenameExplorerEntry
+	getTextInput("Rename to?")
+
+	insertText(&INPT_TEXTEDIT, entry.name)
+}
+
+func continueRenameExplorerEntry() {
+	afterExplorerInput()
+	name := getPlainText(&INPT_TEXTEDIT)
+	if name == "" || name == filepath.Base(EXPLORER_PENDING_PATH) {
+		return
+	}
+
+	EXPLORER_PENDING_TARGET = filepath.Join(filepath.Dir(EXPLORER_PENDING_PATH), name)
+	INPUT_MODAL_CALLBACK = finishRenameExplorerEntry
+	getBoolInput("Rename to "+name+"?")
+}
+
+func finishRenameExplorerEntry() {
+	afterExplorerInput()
+	if !CURRENT_SELECTED_BOOL {
+		return
+	}
+
+	if _, err := os.Stat(EXPLORER_PENDING_TARGET); err == nil {
+		displayError(filepath.Base(EXPLORER_PENDING_TARGET)+" already exists")
+		return
+	}
+
+	err := os.Rename(EXPLORER_PENDING_PATH, EXPLORER_PENDING_TARGET)
+	if err != nil {
+		displayError("Error renaming: "+err.Error())
+		return
+	}
+
+	renameOpenFiles(EXPLORER_PENDING_PATH, EXPLORER_PENDING_TARGET)
+
+	if EXPLORER_EXPANDED[EXPLORER_PENDING_PATH] {
+		EXPLORER_EXPANDED[EXPLORER_PENDING_TARGET] = true
+	}
+	refreshExplorer()
+	selectExplorerPath(EXPLORER_PENDING_TARGET)
+}
+
+// open files that were in a renamed file or folder follow it to the new name
+func renameOpenFiles(old_path, new_path string) {
+	storeCurrentFile()
+
+	for _, file := range(OPEN_FILES) {
+		if file.absolute_path == old_path || strings.HasPrefix(file.absolute_path, old_path+string(filepath.Separator)) {
+			file.absolute_path = new_path+strings.TrimPrefix(file.absolute_path, old_path)
+			file.file_name = file.absolute_path
+			file.title = filepath.Base(file.absolute_path)
+		}
+	}
+
+	if CURRENT_FILE >= 0 {
+		file := OPEN_FILES[CURRENT_FILE]
+		file_name = file.file_name
+		absolute_path = file.absolute_path
+		title = file.title
+	}
+}
+
+func deleteExplorerEntry() {
+	entry := getExplorerEntry()
+	if entry.path == EXPLORER_ROOT {
+		return
+	}
+
+	EXPLORER_PENDING_PATH = entry.path
+	INPUT_MODAL_CALLBACK = finishDeleteExplorerEntry
+
+	if entry.is_dir {
+		getBoolInput("Delete "+entry.name+"/ and all in it?")
+	}else{
+		getBoolInput("Delete "+entry.name+"?")
+	}
+}
+
+func finishDeleteExplorerEntry() {
+	afterExplorerInput()
+	if !CURRENT_SELECTED_BOOL {
+		return
+	}
+
+	err := os.RemoveAll(EXPLORER_PENDING_PATH)
+	if err != nil {
+		displayError("Error deleting: "+err.Error())
+	}
+
+	refreshExplorer()
+}
+
+func explorerHandleKey(ev *tcell.EventKey) {
+	rawrune := ev.Rune()
+	alt_held := ev.Modifiers()&tcell.ModAlt != 0
+	row := EXPLORER_TEXTEDIT.cursor.row
+
+	if ev.Key() == tcell.KeyEscape {
+		unfocusExplorer()
+	}else if rawrune == 'e' && alt_held || rawrune == 'q' {
+		hideExplorer()
+	}else if ev.Key() == tcell.KeyEnter || rawrune == 'l' || rawrune == 'o' || ev.Key() == tcell.KeyRight {
+		activateExplorerEntry()
+	}else if rawrune == 'h' || ev.Key() == tcell.KeyLeft {
+		collapseExplorerEntry()
+	}else if rawrune == 'j' || ev.Key() == tcell.KeyDown {
+		selectExplorerRow(row+1)
+	}else if rawrune == 'k' || ev.Key() == tcell.KeyUp {
+		selectExplorerRow(row-1)
+	}else if ev.Key() == tcell.KeyPgDn {
+		selectExplorerRow(row+EXPLORER_TEXTEDIT.height)
+	}else if ev.Key() == tcell.KeyPgUp {
+		selectExplorerRow(row-EXPLORER_TEXTEDIT.height)
+	}else if rawrune == 'g' || ev.Key() == tcell.KeyHome {
+		selectExplorerRow(0)
+	}else if rawrune == 'G' || ev.Key() == tcell.KeyEnd {
+		selectExplorerRow(len(EXPLORER_ENTRIES)-1)
+	}else if rawrune == 'a' {
+		createExplorerEntry(false)
+	}else if rawrune == 'A' {
+		createExplorerEntry(true)
+	}else if rawrune == 'r' {
+		renameExplorerEntry()
+	}else if rawrune == 'd' || ev.Key() == tcell.KeyDelete {
+		deleteExplorerEntry()
+	}else if rawrune == '.' {
+		SHOW_HIDDEN_FILES = !SHOW_HIDDEN_FILES
+		refreshExplorer()
+	}else if rawrune == 'R' {
+		refreshExplorer()
+	}else if ev.Key() == tcell.KeyCtrlP {
+		openFinder()
+	}
+}
+
+// returns true if the mouse was over the explorer
+func explorerHandleMouse(ev *tcell.EventMouse) bool {
+	x, y := ev.Position()
+	buttons := ev.Buttons()
+
+	if !SHOWING_EXPLORER || x > EXPLORER_TEXTEDIT.width || y < 1 {
+		return false
+	}
+
+	if buttons&tcell.WheelUp != 0 {
+		EXPLORER_TEXTEDIT.toprow = max(EXPLORER_TEXTEDIT.toprow-SCROLL_SENSITIVITY, 0)
+	}
+	if buttons&tcell.WheelDown != 0 {
+		EXPLORER_TEXTEDIT.toprow = max(min(EXPLORER_TEXTEDIT.toprow+SCROLL_SENSITIVITY, len(EXPLORER_ENTRIES)-EXPLORER_TEXTEDIT.height), 0)
+	}
+
+	if buttons&tcell.Button1 != 0 && !BUTTON_DOWN {
+		BUTTON_DOWN = true
+		row := EXPLORER_TEXTEDIT.toprow+y-EXPLORER_TEXTEDIT.row
+
+		if !EXPLORER_FOCUSED {
+			focusExplorer()
+		}
+
+		if y >= EXPLORER_TEXTEDIT.row && row < len(EXPLORER_ENTRIES) && x < EXPLORER_TEXTEDIT.width {
+			if row == EXPLORER_TEXTEDIT.cursor.row { // clicking the selected row again opens it
+				activateExplorerEntry()
+			}else{
+				selectExplorerRow(row)
+			}
+		}
+	}
+
+	return true
+}
+
+func drawExplorer() {
+	style := TITLE_STYLE
+	if EXPLORER_FOCUSED {
+		style = HIGHLIGHT_STYLE
+	}
+
+	width := EXPLORER_TEXTEDIT.width
+	emitStr(0, EXPLORER_TEXTEDIT.row-1, style, runewidth.FillRight(runewidth.Truncate(" Explorer", width, ""), width))
+
+	drawEdit(&EXPLORER_TEXTEDIT, false)
+
+	for y := EXPLORER_TEXTEDIT.row-1; y < EXPLORER_TEXTEDIT.row+EXPLORER_TEXTEDIT.height; y++ {
+		emitStr(width, y, LINE_NUMBER_STYLE, "│")
+	}
+}
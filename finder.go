@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Ctrl+P opens the finder: type part of a path and pick from the files of the
+// working directory that fuzzily match it. The file list is walked on its own
+// goroutine and handed over in batches, so the results fill in while typing.
+
+var FINDER_TEXTEDIT Edit // the query
+var FINDER_LIST_TEXTEDIT Edit
+var FINDER_PREVIEW_TEXTEDIT Edit
+var SHOWING_FINDER bool
+
+var FINDER_ROOT string
+var FINDER_FILES []string // relative to FINDER_ROOT, filled in by the indexer
+var FINDER_INDEXING bool
+var FINDER_GENERATION int // bumped on every new index so an old walk knows to stop
+var FINDER_LOCK sync.Mutex
+
+var FINDER_REFRESH_PENDING bool // a batch is waiting on the UI, later ones don't need to ask again
+
+var FINDER_RESULTS []string
+var FINDER_LIST_LABEL string
+var FINDER_QUERY string
+var FINDER_PREVIEWING string
+
+var FINDER_MAX_RESULTS = 500
+var FINDER_BATCH_SIZE = 1024
+
+// runs fn on the UI goroutine, for work that finishes off in the background.
+// It waits for room when the event queue is full rather than losing fn, so it
+// is only called off the UI goroutine and never holding a lock the UI takes.
+func runOnUI(fn func()) {
+	s.PostEventWait(tcell.NewEventInterrupt(fn))
+}
+
+// true if the start of the file has a zero byte, the same guess git makes
+func isBinaryFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+
+	head := make([]byte, 8000)
+	n, _ := io.ReadFull(file, head)
+
+	return bytes.IndexByte(head[:n], 0) != -1
+}
+
+func indexFinderFiles(root string) {
+	FINDER_LOCK.Lock()
+	FINDER_GENERATION ++
+	generation := FINDER_GENERATION
+	FINDER_ROOT = root
+	FINDER_FILES = []string{}
+	FINDER_INDEXING = true
+	FINDER_LOCK.Unlock()
+
+	go func() {
+		ignores := newIgnoreCache(root)
+		batch := []string{}
+
+		flush := func() bool {
+			FINDER_LOCK.Lock()
+			if generation != FINDER_GENERATION {
+				FINDER_LOCK.Unlock()
+				return false
+			}
+
+			FINDER_FILES = append(FINDER_FILES, batch...)
+			batch = []string{}
+
+			refresh := !FINDER_REFRESH_PENDING
+			FINDER_REFRESH_PENDING = true
+			FINDER_LOCK.Unlock()
+
+			if refresh {
+				runOnUI(refreshFinderResults) // outside the lock, it can wait on the UI
+			}
+
+			return true
+		}
+
+		filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || path == root {
+				return nil
+			}
+
+			if ignores.isIgnored(path, entry.IsDir()) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if entry.IsDir() || !entry.Type().IsRegular() || isBinaryFile(path) {
+				return nil
+			}
+
+			rel, _ := filepath.Rel(root, path)
+			batch = append(batch, filepath.ToSlash(rel))
+
+			if len(batch) >= FINDER_BATCH_SIZE && !flush() {
+				return filepath.SkipAll
+			}
+
+			return nil
+		})
+
+		flush()
+
+		FINDER_LOCK.Lock()
+		if generation == FINDER_GENERATION {
+			FINDER_INDEXING = false
+		}
+		FINDER_LOCK.Unlock()
+
+		runOnUI(refreshFinderResults)
+	}()
+}
+
+// the first letter of a folder, file name or word, counting camelCase humps as words
+func isSegmentStart(path string, indx int) bool {
+	if indx == 0 || strings.ContainsRune("/_-. ", rune(path[indx-1])) {
+		return true
+	}
+
+	return unicode.IsUpper(rune(path[indx])) && unicode.IsLower(rune(path[indx-1]))
+}
+
+// scores how well query fuzzily matches path, -1 when it doesn't. Every query
+// character has to appear in order, characters that start a path segment or
+// word and runs of characters in a row count for more, as does matching in
+// the file name rather than the folders. Shorter paths win ties.
+func scoreFuzzyMatch(query, path string) int {
+	if query == "" {
+		return 0
+	}
+
+	lower := lowerSameLength(path)
+	base_start := strings.LastIndex(lower, "/")+1
+
+	// match backwards first so the characters land as far right (into the
+	// file name) as they can, then forwards again from there to tighten it up
+	end := len(lower)
+	for qi := len(query)-1; qi >= 0; qi-- {
+		end = strings.LastIndexByte(lower[:end], query[qi])
+		if end == -1 {
+			return -1
+		}
+	}
+
+	score := 0
+	pos := end
+	last := -2
+
+	for qi := 0; qi < len(query); qi++ {
+		found := strings.IndexByte(lower[pos:], query[qi])
+		if found == -1 {
+			return -1
+		}
+		indx := pos+found
+
+		score += 1
+		if indx == last+1 {
+			score += 6
+		}
+		if isSegmentStart(path, indx) {
+			score += 8
+		}
+		if indx >= base_start {
+			score += 3
+		}
+
+		last = indx
+		pos = indx+1
+	}
+
+	if strings.HasPrefix(lower[base_start:], query) {
+		score += 20
+	}
+
+	return score*16-len(path)
+}
+
+func refreshFinderResults() {
+	if !SHOWING_FINDER {
+		return
+	}
+
+	query := strings.ToLower(strings.ReplaceAll(getPlainText(&FINDER_TEXTEDIT), " ", ""))
+
+	FINDER_LOCK.Lock()
+	files := FINDER_FILES
+	indexing := FINDER_INDEXING
+	FINDER_REFRESH_PENDING = false
+	FINDER_LOCK.Unlock()
+
+	type Scored struct {
+		path string
+		score int
+	}
+
+	scored := []Scored{}
+	for _, path := range(files) {
+		score := scoreFuzzyMatch(query, path)
+		if score >= 0 {
+			scored = append(scored, Scored{path, score})
+		}
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		if scored[i].score != scored[j].score {
+			return scored[i].score > scored[j].score
+		}
+		return scored[i].path < scored[j].path
+	})
+
+	selected := ""
+	if FINDER_QUERY == query && len(FINDER_RESULTS) > 0 {
+		selected = FINDER_RESULTS[getFinderRow()] // keep the same file selected as more come in
+	}
+	FINDER_QUERY = query
+
+	FINDER_RESULTS = []string{}
+	row := 0
+	for indx, result := range(scored) {
+		if indx >= FINDER_MAX_RESULTS {
+			break
+		}
+		if result.path == selected {
+			row = indx
+		}
+		FINDER_RESULTS = append(FINDER_RESULTS, result.path)
+	}
+
+	setEditText(&FINDER_LIST_TEXTEDIT, strings.Join(FINDER_RESULTS, "\n"))
+	selectListRow(&FINDER_LIST_TEXTEDIT, row)
+
+	label := strconv.Itoa(len(scored))+" of "+strconv.Itoa(len(files))+" files"
+	if indexing {
+		label += " (indexing)"
+	}
+	FINDER_LIST_LABEL = label
+
+	previewFinderResult()
+}
+
+func getFinderRow() int {
+	return min(FINDER_LIST_TEXTEDIT.cursor.row, len(FINDER_RESULTS)-1)
+}
+
+func previewFinderResult() {
+	path := ""
+	if len(FINDER_RESULTS) > 0 {
+		path = FINDER_RESULTS[getFinderRow()]
+	}
+
+	if path == FINDER_PREVIEWING {
+		return
+	}
+	FINDER_PREVIEWING = path
+
+	text := ""
+	if path != "" {
+		file, err := os.Open(filepath.Join(FINDER_ROOT, path))
+		if err == nil {
+			head := make([]byte, 32*1024) // enough for the part that fits on screen
+			n, _ := io.ReadFull(file, head)
+			file.Close()
+
+			text = strings.ReplaceAll(string(head[:n]), "\r\n", "\n")
+			lines := strings.Split(text, "\n")
+			if len(lines) > FINDER_PREVIEW_TEXTEDIT.height {
+				lines = lines[:FINDER_PREVIEW_TEXTEDIT.height]
+			}
+			text = strings.Join(lines, "\n")
+		}
+	}
+
+	setEditText(&FINDER_PREVIEW_TEXTEDIT, text)
+	FINDER_PREVIEW_TEXTEDIT.toprow = 0
+	FINDER_PREVIEW_TEXTEDIT.leftchar = 0
+}
+
+func openFinder() {
+	root, _ := os.Getwd()
+
+	SHOWING_FINDER = true
+	CURRENT_TEXT_EDIT = "finder"
+	hideSuggestions()
+
+	setEditText(&FINDER_TEXTEDIT, "")
+	FINDER_TEXTEDIT.cursor = Cursor{}
+	FINDER_TEXTEDIT.current_mode = "i"
+	FINDER_QUERY = ""
+	FINDER_PREVIEWING = ""
+
+	redrawFullScreen() // lays out the preview before anything goes in it
+	indexFinderFiles(root)
+	refreshFinderResults()
+	redrawFullScreen()
+}
+
+func closeFinder() {
+	SHOWING_FINDER = false
+	CURRENT_TEXT_EDIT = "main"
+	if EXPLORER_FOCUSED {
+		CURRENT_TEXT_EDIT = "explorer"
+	}
+
+	FINDER_LOCK.Lock()
+	FINDER_GENERATION ++ // stops the walk if it is still going
+	FINDER_LOCK.Unlock()
+
+	redrawFullScreen()
+}
+
+func finderHandleKey(ev *tcell.EventKey) {
+	row := getFinderRow()
+
+	if ev.Key() == tcell.KeyEscape || ev.Key() == tcell.KeyCtrlP {
+		closeFinder()
+		return
+	}else if ev.Key() == tcell.KeyEnter {
+		if len(FINDER_RESULTS) == 0 {
+			return
+		}
+		path := filepath.Join(FINDER_ROOT, FINDER_RESULTS[row])
+
+		closeFinder()
+		if EXPLORER_FOCUSED {
+			unfocusExplorer()
+		}
+		openFileByUser(path)
+		return
+	}else if ev.Key() == tcell.KeyDown || ev.Key() == tcell.KeyCtrlN || ev.Key() == tcell.KeyTab {
+		selectListRow(&FINDER_LIST_TEXTEDIT, row+1)
+	}else if ev.Key() == tcell.KeyUp || ev.Key() == tcell.KeyBacktab {
+		selectListRow(&FINDER_LIST_TEXTEDIT, row-1)
+	}else if ev.Key() == tcell.KeyPgDn {
+		selectListRow(&FINDER_LIST_TEXTEDIT, row+FINDER_LIST_TEXTEDIT.height)
+	}else if ev.Key() == tcell.KeyPgUp {
+		selectListRow(&FINDER_LIST_TEXTEDIT, row-FINDER_LIST_TEXTEDIT.height)
+	}else{
+		editHandleKey(ev, &FINDER_TEXTEDIT)
+		FINDER_TEXTEDIT.current_mode = "i" // the query is always being typed
+
+		if strings.ToLower(strings.ReplaceAll(getPlainText(&FINDER_TEXTEDIT), " ", "")) != FINDER_QUERY {
+			refreshFinderResults()
+		}
+		return
+	}
+
+	previewFinderResult()
+}
+
+func layoutFinder(width, height int) {
+	list_width := max((width-8)/2, 1)
+
+	FINDER_TEXTEDIT.row = 2
+	FINDER_TEXTEDIT.col = 2
+	FINDER_TEXTEDIT.width = list_width
+	FINDER_TEXTEDIT.height = 1
+
+	FINDER_LIST_TEXTEDIT.row = 4
+	FINDER_LIST_TEXTEDIT.col = 2
+	FINDER_LIST_TEXTEDIT.width = list_width
+	FINDER_LIST_TEXTEDIT.height = max(height-6, 1)
+
+	FINDER_PREVIEW_TEXTEDIT.row = 2
+	FINDER_PREVIEW_TEXTEDIT.col = list_width+6
+	FINDER_PREVIEW_TEXTEDIT.width = max(width-list_width-8, 1)
+	FINDER_PREVIEW_TEXTEDIT.height = max(height-4, 1)
+}
+
+func drawFinder() {
+	drawEdit(&FINDER_PREVIEW_TEXTEDIT, false)
+	drawOutline(&FINDER_PREVIEW_TEXTEDIT, TITLE_STYLE, FINDER_PREVIEWING)
+
+	drawEdit(&FINDER_TEXTEDIT, CURRENT_TEXT_EDIT == "finder")
+	drawEdit(&FINDER_LIST_TEXTEDIT, false)
+	drawOutline(&FINDER_TEXTEDIT, TITLE_STYLE, "Find File")
+	drawOutline(&FINDER_LIST_TEXTEDIT, TITLE_STYLE, FINDER_LIST_LABEL)
+}
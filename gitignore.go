@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A small .gitignore reader shared by everything that walks the project.
+// Each directory's rules are its parent's plus its own .gitignore, later
+// rules win, and .git itself is always skipped.
+
+type IgnoreRule struct {
+	base string // directory of the .gitignore, patterns are relative to it
+	pattern string
+	negate bool
+	dir_only bool
+	anchored bool // has a slash in it, so it matches from base instead of any level
+}
+
+type IgnoreCache struct {
+	root string
+	rules map[string][]IgnoreRule
+}
+
+func newIgnoreCache(root string) *IgnoreCache {
+	return &IgnoreCache{root: root, rules: map[string][]IgnoreRule{}}
+}
+
+func readIgnoreFile(dir string) []IgnoreRule {
+	rules := []IgnoreRule{}
+
+	file, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return rules
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := IgnoreRule{base: dir}
+
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, "\\")
+
+		if strings.HasSuffix(line, "/") {
+			rule.dir_only = true
+			line = strings.TrimSuffix(line, "/")
+		}
+
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+
+		if line == "" {
+			continue
+		}
+
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// the rules that apply to the entries of dir
+func (cache *IgnoreCache) getRules(dir string) []IgnoreRule {
+	if rules, ok := cache.rules[dir]; ok {
+		return rules
+	}
+
+	rules := []IgnoreRule{}
+
+	parent := filepath.Dir(dir)
+	if dir != cache.root && parent != dir && strings.HasPrefix(dir, cache.root) {
+		rules = append(rules, cache.getRules(parent)...)
+	}
+
+	rules = append(rules, readIgnoreFile(dir)...)
+	cache.rules[dir] = rules
+
+	return rules
+}
+
+func (cache *IgnoreCache) isIgnored(full_path string, is_dir bool) bool {
+	if filepath.Base(full_path) == ".git" {
+		return true
+	}
+
+	ignored := false
+
+	for _, rule := range(cache.getRules(filepath.Dir(full_path))) {
+		if rule.dir_only && !is_dir {
+			continue
+		}
+
+		rel, err := filepath.Rel(rule.base, full_path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+
+		matched := false
+		if rule.anchored {
+			matched = matchGlobPath(rule.pattern, rel)
+		}else{
+			matched = matchGlobPath(rule.pattern, path.Base(rel))
+		}
+
+		if matched {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
+
+// matches slash separated paths where ** stands for any number of directories
+func matchGlobPath(pattern, name string) bool {
+	return matchGlobParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobParts(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	if pattern[0] == "**" {
+		for skip := 0; skip <= len(name); skip++ {
+			if matchGlobParts(pattern[1:], name[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+
+	matched, err := path.Match(pattern[0], name[0])
+	if err != nil || !matched {
+		return false
+	}
+
+	return matchGlobParts(pattern[1:], name[1:])
+}
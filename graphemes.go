@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/uniseg"
+)
+
+// Cursor columns are byte offsets into the line, but they only ever sit on
+// grapheme cluster boundaries, so accents, emoji and CJK text move, select and
+// delete as one character. Display columns (getTrueCol) count terminal cells.
+
+var TAB_WIDTH = 4
+var ZERO_WIDTH_GLYPH = '·' // drawn in place of zero width / control characters that stand on their own
+
+func nextGrapheme(text string, col int) int {
+	if col >= len(text) {
+		return len(text)
+	}
+
+	cluster, _, _, _ := uniseg.FirstGraphemeClusterInString(text[col:], -1)
+	return col+len(cluster)
+}
+
+func prevGrapheme(text string, col int) int {
+	last := 0
+	pos := 0
+	state := -1
+	rest := text
+
+	for pos < col && len(rest) > 0 {
+		last = pos
+
+		var cluster string
+		cluster, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		pos += len(cluster)
+	}
+
+	return last
+}
+
+// returns the closest grapheme boundary at or before col
+func snapToGrapheme(text string, col int) int {
+	if col >= len(text) {
+		return len(text)
+	}
+	if col <= 0 {
+		return 0
+	}
+
+	next := nextGrapheme(text, prevGrapheme(text, col))
+	if next == col {
+		return col
+	}
+
+	return prevGrapheme(text, col)
+}
+
+func clusterWidth(cluster string) int {
+	if cluster == "\t" {
+		return TAB_WIDTH
+	}
+
+	width := uniseg.StringWidth(cluster) // the whole cluster, a flag or an emoji with a variation selector is wider than its first rune
+
+	if width == 0 {
+		return 1 // shown as ZERO_WIDTH_GLYPH, so the cursor still has somewhere to sit
+	}
+
+	return width
+}
+
+func stringWidth(text string) int {
+	width := 0
+	state := -1
+
+	for len(text) > 0 {
+		var cluster string
+		cluster, text, _, state = uniseg.FirstGraphemeClusterInString(text, state)
+		width += clusterWidth(cluster)
+	}
+
+	return width
+}
+
+func emitCluster(x, y int, style tcell.Style, cluster string) {
+	runes := []rune(cluster)
+
+	if uniseg.StringWidth(cluster) == 0 {
+		s.SetContent(x, y, ZERO_WIDTH_GLYPH, nil, style)
+		return
+	}
+
+	s.SetContent(x, y, runes[0], runes[1:], style)
+}
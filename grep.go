@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// Alt+F searches in files: every line under the working directory with the
+// text typed in it, grouped by file. One goroutine walks the folder (leaving
+// out what .gitignore does) and hands the paths to GREP_WORKERS more that
+// read and search the files, skipping binary ones. What they find comes into
+// the list while typing, the same way the finder's files do. Enter on a line
+// opens its file there.
+//
+// Alt+C matches case and Alt+R takes the text as a regular expression, like
+// in the find panel. Tab goes to the boxes for the files to search and to
+// leave out, globs split by commas or spaces (*.go, src/**, *_test.go). A
+// glob without a / matches the name of a file or of any folder it is in, one
+// with a / the path from the working directory.
+
+type GrepLine struct {
+	row int
+	col int // of the first match
+	text string // the line, trimmed to show
+}
+
+type GrepFile struct {
+	path string // relative to GREP_ROOT
+	lines []GrepLine
+}
+
+// a row of the list, the one naming the file has line -1
+type GrepRow struct {
+	file int
+	line int
+}
+
+var GREP_TEXTEDIT Edit // the text to look for
+var GREP_INCLUDE_TEXTEDIT Edit
+var GREP_EXCLUDE_TEXTEDIT Edit
+var GREP_LIST_TEXTEDIT Edit
+var SHOWING_GREP bool
+var GREP_FOCUS int // the box being typed in, an index into getGrepBoxes
+
+var GREP_REGEX bool
+var GREP_MATCH_CASE bool
+
+var GREP_ROOT string
+var GREP_FOUND []GrepFile // filled in by the workers
+var GREP_MATCHES int // lines in GREP_FOUND
+var GREP_SEARCHED_FILES int
+var GREP_SEARCHING bool
+var GREP_GENERATION int // bumped on every new search so the old one knows to stop
+var GREP_LOCK sync.Mutex
+
+var GREP_REFRESH_PENDING bool // results are waiting on the UI, later ones don't need to ask again
+
+var GREP_FILES []GrepFile // as listed, in order of path
+var GREP_ROWS []GrepRow
+var GREP_LIST_LABEL string
+var GREP_QUERY string // the boxes and options the last search was started with
+var GREP_ERROR string
+
+var GREP_WORKERS = runtime.NumCPU()
+var GREP_MAX_MATCHES = 10000
+var GREP_MAX_FILE_SIZE int64 = 8*1024*1024
+var GREP_PREVIEW_LENGTH = 200
+
+func getGrepBoxes() []*Edit {
+	return []*Edit{&GREP_TEXTEDIT, &GREP_INCLUDE_TEXTEDIT, &GREP_EXCLUDE_TEXTEDIT}
+}
+
+func getGrepOptions() []FindOption {
+	return []FindOption{
+		{"case", &GREP_MATCH_CASE, func() { GREP_MATCH_CASE = !GREP_MATCH_CASE }},
+		{"regex", &GREP_REGEX, func() { GREP_REGEX = !GREP_REGEX }},
+	}
+}
+
+// the pattern for the search box, false when it is empty or doesn't compile
+func getGrepPattern() (*regexp.Regexp, bool) {
+	text := getPlainText(&GREP_TEXTEDIT)
+	GREP_ERROR = ""
+	if text == "" {
+		return nil, false
+	}
+
+	if !GREP_REGEX {
+		text = regexp.QuoteMeta(text)
+	}
+
+	flags := "(?m)" // ^ and $ at the ends of lines, the file is matched as a whole before its lines are
+	if !GREP_MATCH_CASE {
+		flags = "(?im)"
+	}
+
+	re, err := regexp.Compile(flags+text)
+	if err != nil {
+		GREP_ERROR = describePatternError(err, text)
+		return nil, false
+	}
+	return re, true
+}
+
+func splitGlobs(text string) []string {
+	return strings.FieldsFunc(text, func(char rune) bool { return char == ',' || char == ' ' })
+}
+
+// whether rel (a slash separated path) is matched by any of globs
+func matchesGlobs(globs []string, rel string) bool {
+	parts := strings.Split(rel, "/")
+
+	for _, glob := range(globs) {
+		if strings.Contains(glob, "/") {
+			if matchGlobPath(strings.Trim(glob, "/")+"/**", rel) {
+				return true
+			}
+			continue
+		}
+
+		for _, part := range(parts) {
+			if matched, _ := path.Match(glob, part); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getGrepQuery() string {
+	parts := []string{strconv.FormatBool(GREP_REGEX), strconv.FormatBool(GREP_MATCH_CASE)}
+	for _, box := range(getGrepBoxes()) {
+		parts = append(parts, getPlainText(box))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// the lines of the file at root/rel that re matches, false when it can't be
+// read or is binary
+func grepFile(re *regexp.Regexp, root, rel string) (GrepFile, bool) {
+	found := GrepFile{path: rel}
+
+	contents, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+	if err != nil || bytes.IndexByte(contents[:min(len(contents), 8000)], 0) != -1 { // the same guess isBinaryFile makes
+		return found, false
+	}
+	if !re.Match(contents) {
+		return found, true
+	}
+
+	for row, line := range(strings.Split(string(contents), "\n")) {
+		line = strings.TrimSuffix(line, "\r")
+
+		for _, match := range(re.FindAllStringIndex(line, -1)) {
+			if match[0] == match[1] {
+				continue // an empty match can't be seen
+			}
+
+			text := strings.ReplaceAll(strings.TrimLeft(line, WHITESPACE), "\t", " ")
+			text = runewidth.Truncate(text, GREP_PREVIEW_LENGTH, "…")
+			found.lines = append(found.lines, GrepLine{row, match[0], text})
+			break
+		}
+	}
+	return found, true
+}
+
+// searches every file under GREP_ROOT again, for what the boxes have in them now
+func startGrepSearch() {
+	GREP_QUERY = getGrepQuery()
+
+	GREP_LOCK.Lock()
+	GREP_GENERATION ++
+	generation := GREP_GENERATION
+	GREP_FOUND = []GrepFile{}
+	GREP_MATCHES = 0
+	GREP_SEARCHED_FILES = 0
+	GREP_SEARCHING = false
+	GREP_REFRESH_PENDING = false
+	GREP_LOCK.Unlock()
+
+	re, ok := getGrepPattern()
+	if !ok {
+		refreshGrepResults()
+		return
+	}
+
+	GREP_LOCK.Lock()
+	GREP_SEARCHING = true
+	GREP_LOCK.Unlock()
+
+	root := GREP_ROOT
+	include := splitGlobs(getPlainText(&GREP_INCLUDE_TEXTEDIT))
+	exclude := splitGlobs(getPlainText(&GREP_EXCLUDE_TEXTEDIT))
+
+	stopped := func() bool {
+		GREP_LOCK.Lock()
+		defer GREP_LOCK.Unlock()
+		return generation != GREP_GENERATION || GREP_MATCHES >= GREP_MAX_MATCHES
+	}
+
+	paths := make(chan string, 256)
+
+	go func() {
+		defer close(paths)
+		ignores := newIgnoreCache(root)
+
+		filepath.WalkDir(root, func(full_path string, entry fs.DirEntry, err error) error {
+			if err != nil || full_path == root {
+				return nil
+			}
+			if stopped() {
+				return filepath.SkipAll
+			}
+
+			rel, _ := filepath.Rel(root, full_path)
+			rel = filepath.ToSlash(rel)
+
+			if ignores.isIgnored(full_path, entry.IsDir()) || matchesGlobs(exclude, rel) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if entry.IsDir() || !entry.Type().IsRegular() {
+				return nil
+			}
+			if len(include) > 0 && !matchesGlobs(include, rel) {
+				return nil
+			}
+			if info, err := entry.Info(); err != nil || info.Size() > GREP_MAX_FILE_SIZE {
+				return nil
+			}
+
+			paths <- rel
+			return nil
+		})
+	}()
+
+	var workers sync.WaitGroup
+	for range(GREP_WORKERS) {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			for rel := range(paths) {
+				if stopped() {
+					continue // let the walk see it and finish
+				}
+
+				found, ok := grepFile(re, root, rel)
+				if ok {
+					addGrepResult(generation, found)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		workers.Wait()
+
+		GREP_LOCK.Lock()
+		if generation == GREP_GENERATION {
+			GREP_SEARCHING = false
+		}
+		GREP_LOCK.Unlock()
+
+		runOnUI(refreshGrepResults)
+	}()
+}
+
+// called by the workers for every file they searched
+func addGrepResult(generation int, found GrepFile) {
+	GREP_LOCK.Lock()
+	if generation != GREP_GENERATION {
+		GREP_LOCK.Unlock()
+		return
+	}
+
+	GREP_SEARCHED_FILES ++
+	refresh := false
+
+	if len(found.lines) > 0 {
+		GREP_FOUND = append(GREP_FOUND, found)
+		GREP_MATCHES += len(found.lines)
+
+		refresh = !GREP_REFRESH_PENDING
+		GREP_REFRESH_PENDING = true
+	}
+	GREP_LOCK.Unlock()
+
+	if refresh {
+		runOnUI(refreshGrepResults) // outside the lock, it can wait on the UI
+	}
+}
+
+func refreshGrepResults() {
+	if !SHOWING_GREP {
+		return
+	}
+
+	GREP_LOCK.Lock()
+	files := append([]GrepFile{}, GREP_FOUND...)
+	matches := GREP_MATCHES
+	searched := GREP_SEARCHED_FILES
+	searching := GREP_SEARCHING
+	GREP_REFRESH_PENDING = false
+	GREP_LOCK.Unlock()
+
+	// the workers finish in any order
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+
+	selected_path, selected_line := "", -1
+	if len(GREP_ROWS) > 0 {
+		row := GREP_ROWS[getGrepRow()]
+		selected_path, selected_line = GREP_FILES[row.file].path, row.line // keep it selected as more come in
+	}
+
+	GREP_FILES = files
+	GREP_ROWS = []GrepRow{}
+	lines := []string{}
+	selected := 0
+
+	for file_indx, file := range(files) {
+		if file.path == selected_path && selected_line == -1 {
+			selected = len(GREP_ROWS)
+		}
+		GREP_ROWS = append(GREP_ROWS, GrepRow{file_indx, -1})
+		lines = append(lines, file.path+" ("+strconv.Itoa(len(file.lines))+")")
+
+		for line_indx, line := range(file.lines) {
+			if file.path == selected_path && line_indx == selected_line {
+				selected = len(GREP_ROWS)
+			}
+			GREP_ROWS = append(GREP_ROWS, GrepRow{file_indx, line_indx})
+			lines = append(lines, "  "+strconv.Itoa(line.row+1)+":"+strconv.Itoa(line.col+1)+"  "+line.text)
+		}
+	}
+
+	setEditText(&GREP_LIST_TEXTEDIT, strings.Join(lines, "\n"))
+	selectListRow(&GREP_LIST_TEXTEDIT, selected)
+
+	label := pluralize(matches, "line")+" in "+pluralize(len(files), "file")
+	if GREP_ERROR != "" {
+		label = GREP_ERROR
+	}else if searching {
+		label += " (searching, "+pluralize(searched, "file")+" read)"
+	}else if matches >= GREP_MAX_MATCHES {
+		label += " (stopped there)"
+	}
+	GREP_LIST_LABEL = label
+}
+
+func getGrepRow() int {
+	return min(GREP_LIST_TEXTEDIT.cursor.row, len(GREP_ROWS)-1)
+}
+
+// opens the file of the selected row at its line, or at the first line
+// found in it for the row naming the file
+func openGrepResult() {
+	if len(GREP_ROWS) == 0 {
+		return
+	}
+
+	row := GREP_ROWS[getGrepRow()]
+	file := GREP_FILES[row.file]
+	line := file.lines[max(row.line, 0)]
+
+	closeGrep()
+	if EXPLORER_FOCUSED {
+		unfocusExplorer()
+	}
+
+	openFileByUser(filepath.Join(GREP_ROOT, filepath.FromSlash(file.path)))
+	if SHOWING_INPUT_MODAL {
+		return // it couldn't be opened
+	}
+
+	edit := &MAIN_TEXTEDIT
+	target_row := min(line.row, edit.buffer.lineCount()-1) // the file might have changed since
+	target_col := min(line.col, edit.buffer.lineLen(target_row))
+	moveToTarget(edit, MotionTarget{target_row, target_col, MOTION_EXCLUSIVE}, false)
+	showCursor(edit)
+}
+
+func openGrep() {
+	root, _ := os.Getwd()
+	GREP_ROOT = root
+
+	txt := getCursorSelection(&MAIN_TEXTEDIT)
+	if txt != "" && !strings.Contains(txt, "\n") {
+		setEditText(&GREP_TEXTEDIT, txt)
+	}
+
+	for _, box := range(getGrepBoxes()) {
+		box.current_mode = "i"
+	}
+	GREP_TEXTEDIT.cursor.row = 0
+	GREP_TEXTEDIT.cursor.col = GREP_TEXTEDIT.buffer.lineLen(0)
+	GREP_TEXTEDIT.cursor.row_anchor = 0
+	GREP_TEXTEDIT.cursor.col_anchor = 0
+	GREP_FOCUS = 0
+
+	SHOWING_GREP = true
+	CURRENT_TEXT_EDIT = "grep"
+	hideSuggestions()
+	GREP_ROWS = nil
+
+	redrawFullScreen()
+	startGrepSearch() // the files may have changed since the last time
+	redrawFullScreen()
+}
+
+func closeGrep() {
+	SHOWING_GREP = false
+	CURRENT_TEXT_EDIT = "main"
+	if EXPLORER_FOCUSED {
+		CURRENT_TEXT_EDIT = "explorer"
+	}
+
+	GREP_LOCK.Lock()
+	GREP_GENERATION ++ // stops the search if it is still going
+	GREP_LOCK.Unlock()
+
+	redrawFullScreen()
+}
+
+func grepHandleKey(ev *tcell.EventKey) {
+	row := getGrepRow()
+	alt := ev.Modifiers()&tcell.ModAlt != 0
+
+	if ev.Key() == tcell.KeyEscape {
+		closeGrep()
+		return
+	}else if ev.Key() == tcell.KeyEnter {
+		openGrepResult()
+		return
+	}else if ev.Key() == tcell.KeyDown || ev.Key() == tcell.KeyCtrlN {
+		selectListRow(&GREP_LIST_TEXTEDIT, row+1)
+	}else if ev.Key() == tcell.KeyUp {
+		selectListRow(&GREP_LIST_TEXTEDIT, row-1)
+	}else if ev.Key() == tcell.KeyPgDn {
+		selectListRow(&GREP_LIST_TEXTEDIT, row+GREP_LIST_TEXTEDIT.height)
+	}else if ev.Key() == tcell.KeyPgUp {
+		selectListRow(&GREP_LIST_TEXTEDIT, row-GREP_LIST_TEXTEDIT.height)
+	}else if ev.Key() == tcell.KeyTab {
+		GREP_FOCUS = (GREP_FOCUS+1)%len(getGrepBoxes())
+	}else if ev.Key() == tcell.KeyBacktab {
+		GREP_FOCUS = (GREP_FOCUS+len(getGrepBoxes())-1)%len(getGrepBoxes())
+	}else if alt && ev.Rune() == 'c' {
+		GREP_MATCH_CASE = !GREP_MATCH_CASE
+	}else if alt && ev.Rune() == 'r' {
+		GREP_REGEX = !GREP_REGEX
+	}else{
+		box := getGrepBoxes()[GREP_FOCUS]
+		editHandleKey(ev, box)
+		box.current_mode = "i" // the boxes are always being typed in
+	}
+
+	if getGrepQuery() != GREP_QUERY {
+		startGrepSearch()
+	}
+}
+
+// clicking an option switches it, a box types in it and a row of the list
+// selects it, or opens it when it was already selected
+func grepHandleMouse(ev *tcell.EventMouse) bool {
+	if !SHOWING_GREP {
+		return false
+	}
+
+	x, y := ev.Position()
+	buttons := ev.Buttons()
+	list := &GREP_LIST_TEXTEDIT
+
+	if buttons&tcell.WheelUp != 0 {
+		list.toprow = max(list.toprow-SCROLL_SENSITIVITY, 0)
+	}
+	if buttons&tcell.WheelDown != 0 {
+		list.toprow = max(min(list.toprow+SCROLL_SENSITIVITY, len(GREP_ROWS)-list.height), 0)
+	}
+
+	if buttons&tcell.Button1 == 0 || BUTTON_DOWN {
+		return true
+	}
+	BUTTON_DOWN = true
+
+	if optionsHandleMouse(&GREP_TEXTEDIT, getGrepOptions(), x, y) {
+		startGrepSearch()
+		return true
+	}
+
+	for indx, box := range(getGrepBoxes()) {
+		if y == box.row && x >= box.col && x < box.col+box.width {
+			GREP_FOCUS = indx
+			return true
+		}
+	}
+
+	row := list.toprow+y-list.row
+	if y >= list.row && y < list.row+list.height && row < len(GREP_ROWS) {
+		if row == getGrepRow() {
+			openGrepResult()
+		}else{
+			selectListRow(list, row)
+		}
+	}
+	return true
+}
+
+func layoutGrep(width, height int) {
+	half := max((width-8)/2, 1)
+
+	GREP_TEXTEDIT.row = 2
+	GREP_TEXTEDIT.col = 2
+	GREP_TEXTEDIT.width = max(width-4, 1)
+	GREP_TEXTEDIT.height = 1
+
+	GREP_INCLUDE_TEXTEDIT.row = 4
+	GREP_INCLUDE_TEXTEDIT.col = 2
+	GREP_INCLUDE_TEXTEDIT.width = half
+	GREP_INCLUDE_TEXTEDIT.height = 1
+
+	GREP_EXCLUDE_TEXTEDIT.row = 4
+	GREP_EXCLUDE_TEXTEDIT.col = half+6
+	GREP_EXCLUDE_TEXTEDIT.width = max(width-half-8, 1)
+	GREP_EXCLUDE_TEXTEDIT.height = 1
+
+	GREP_LIST_TEXTEDIT.row = 6
+	GREP_LIST_TEXTEDIT.col = 2
+	GREP_LIST_TEXTEDIT.width = max(width-4, 1)
+	GREP_LIST_TEXTEDIT.height = max(height-8, 1)
+}
+
+func drawGrep() {
+	for indx, box := range(getGrepBoxes()) {
+		drawEdit(box, CURRENT_TEXT_EDIT == "grep" && GREP_FOCUS == indx)
+	}
+	drawEdit(&GREP_LIST_TEXTEDIT, false)
+
+	label := "Search in Files"
+	if GREP_ERROR != "" {
+		label += " - "+GREP_ERROR
+	}
+	drawOutline(&GREP_TEXTEDIT, TITLE_STYLE, runewidth.Truncate(label, getOptionColumns(&GREP_TEXTEDIT, getGrepOptions())[0]-GREP_TEXTEDIT.col+1, "…"))
+	drawOptions(&GREP_TEXTEDIT, getGrepOptions())
+	drawOutline(&GREP_INCLUDE_TEXTEDIT, TITLE_STYLE, "Files to Include")
+	drawOutline(&GREP_EXCLUDE_TEXTEDIT, TITLE_STYLE, "Files to Exclude")
+	drawOutline(&GREP_LIST_TEXTEDIT, TITLE_STYLE, GREP_LIST_LABEL)
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Key bindings: every key with a binding in the mode the editor is in runs a
+// named command (or types other keys) before the built-in key handling sees
+// it. The bindings are read from DEFAULT_KEYMAP and then keymap.cdmg in
+// APP_CONFIG_DIR, one per line as
+//
+//	modes keys command
+//
+// with modes one of normal, insert, visual, find, prompt (or several with
+// commas, or all), the keys written like macros (<C-s>, <A-n>, gq, <C-k><C-c>)
+// and the command a name from KEY_COMMANDS, or "keys {keys}" to type other
+// keys in their place. The file is read again whenever it is saved. The
+// bindings of the key profile picked in allSettings.cdmg (profiles.go) come
+// between the two.
+//
+// Keys that start a longer binding wait for the rest of it, up to
+// KEYMAP_TIMEOUT_MS, and go through as they are if it doesn't come. Keys
+// typed by a binding are not looked up again. Ctrl+Q always quits.
+
+type KeyCommand struct {
+	name string
+	about string
+	run func(edit *Edit)
+}
+
+type KeyBinding struct {
+	command *KeyCommand // nil when it types keys instead
+	keys []*tcell.EventKey
+}
+
+var KEY_COMMANDS []*KeyCommand
+var KEYMAP_MODES = []string{"normal", "insert", "visual", "find", "prompt"}
+var KEYMAP = map[string]map[string]KeyBinding{} // mode -> the keys, as getKeysName writes them -> what they do
+var KEYMAP_ERROR string // from the last time keymap.cdmg was read, until it is shown
+
+var KEYMAP_PENDING []*tcell.EventKey // typed so far of a binding that is longer
+var KEYMAP_TIMEOUT_MS = 1000
+var KEYMAP_WAIT_ID int // which wait the timer that resolves the pending keys belongs to
+var KEYMAP_SHIFT_HELD bool // with the last key, when it wasn't a character, for commands that move to select
+
+var DEFAULT_KEYMAP = `
+all <C-z> undo
+all <C-y> redo
+normal,insert,visual,find <A-z> undo-older
+normal,insert,visual,find <A-y> undo-newer
+normal,insert,visual <A-u> undo-tree
+normal,insert,visual <A-t> undo-time-travel
+normal,insert,visual,find <C-s> save
+normal,insert,visual,find <A-s> save-as
+normal,insert,visual <A-o> open-file
+normal,insert,visual <A-n> next-file
+normal,insert,visual <A-p> previous-file
+normal,insert,visual <A-b> file-list
+normal,insert,visual <A-w> close-file
+normal,insert,visual <A-e> explorer
+normal,insert,visual <A-v> clipboard-history
+normal,insert,visual <C-p> find-files
+normal,insert,visual <A-f> search-in-files
+normal,insert,visual,find <C-g> settings
+normal,insert,visual,find <C-f> find
+find <A-c> toggle-find-case
+find <A-w> toggle-find-word
+find <A-r> toggle-find-regex
+find <A-p> toggle-find-keep-case
+find <A-l> toggle-find-in-selection
+find <A-Enter> replace-all
+normal,insert,visual <C-d> add-next-occurrence
+normal,insert,visual <A-d> select-all-occurrences
+normal,insert,visual <A-j> add-cursor-below
+normal,insert,visual <A-Down> add-cursor-below
+normal,insert,visual <A-k> add-cursor-above
+normal,insert,visual <A-Up> add-cursor-above
+normal,visual [ deindent
+normal,visual ] indent
+all <C-c> copy
+all <C-x> cut
+`
+
+func addKeyCommand(name, about string, run func(edit *Edit)) {
+	KEY_COMMANDS = append(KEY_COMMANDS, &KeyCommand{name: name, about: about, run: run})
+}
+
+func findKeyCommand(name string) *KeyCommand {
+	for _, command := range(KEY_COMMANDS) {
+		if command.name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+func setupKeyCommands() {
+	KEY_COMMANDS = nil
+
+	addKeyCommand("undo", "undo the last change", func(edit *Edit) {
+		for range(takeCount(edit)) {
+			undo(edit)
+		}
+	})
+	addKeyCommand("redo", "redo what was undone", func(edit *Edit) {
+		for range(takeCount(edit)) {
+			redo(edit)
+		}
+	})
+	addKeyCommand("undo-older", "step back through every state in the order they were made", func(edit *Edit) { undoChronological(edit, -1) })
+	addKeyCommand("undo-newer", "step forward through every state in the order they were made", func(edit *Edit) { undoChronological(edit, 1) })
+	addKeyCommand("undo-tree", "show the undo tree", func(edit *Edit) { openUndoTree() })
+	addKeyCommand("undo-time-travel", "go back or forward through the history by time", func(edit *Edit) { openUndoTimeTravel() })
+	addKeyCommand("save", "save the file", func(edit *Edit) { saveFile() })
+	addKeyCommand("save-as", "save the file under another name", func(edit *Edit) { saveFileAs() })
+	addKeyCommand("open-file", "open a file by name", func(edit *Edit) { openFileByName() })
+	addKeyCommand("next-file", "switch to the next open file", func(edit *Edit) { cycleFiles(1) })
+	addKeyCommand("previous-file", "switch to the previous open file", func(edit *Edit) { cycleFiles(-1) })
+	addKeyCommand("file-list", "list the open files", func(edit *Edit) { openFileList() })
+	addKeyCommand("close-file", "close the current file", func(edit *Edit) { closeCurrentFile() })
+	addKeyCommand("explorer", "show or hide the explorer", func(edit *Edit) { toggleExplorer() })
+	addKeyCommand("clipboard-history", "pick something from the clipboard history to paste", func(edit *Edit) { openClipboardHistory() })
+	addKeyCommand("find-files", "find a file under the folder CodeMage was started in", func(edit *Edit) { openFinder() })
+	addKeyCommand("search-in-files", "search the text of the files under the folder CodeMage was started in", func(edit *Edit) { openGrep() })
+	addKeyCommand("settings", "open the settings", func(edit *Edit) { openFileByUser(filepath.Join(APP_CONFIG_DIR, "allSettings.cdmg")) })
+	addKeyCommand("help", "open the help", func(edit *Edit) { openFileByUser(filepath.Join(APP_CONFIG_DIR, "help.cdmg")) })
+	addKeyCommand("keymap", "open this file", func(edit *Edit) { openFileByUser(getKeymapPath()) })
+	addKeyCommand("reload-keymap", "read this file again", func(edit *Edit) { reloadKeymap() })
+	addKeyCommand("find", "open find", func(edit *Edit) { openFindMenu() })
+	addKeyCommand("toggle-find-regex", "switch find between plain text and regular expressions", func(edit *Edit) { toggleFindRegex() })
+	addKeyCommand("replace-all", "replace every match of find at once", func(edit *Edit) { runReplaceAll() })
+	addKeyCommand("toggle-find-case", "switch find between matching case and ignoring it", func(edit *Edit) { toggleFindMatchCase() })
+	addKeyCommand("toggle-find-word", "switch find to only take whole words or not", func(edit *Edit) { toggleFindWholeWord() })
+	addKeyCommand("toggle-find-keep-case", "switch replace to keep the case of what it replaces or not", func(edit *Edit) { toggleFindPreserveCase() })
+	addKeyCommand("toggle-find-in-selection", "switch find to only look in what was selected when it opened or not", func(edit *Edit) { toggleFindInSelection() })
+	addKeyCommand("command-line", "open the : command line", func(edit *Edit) {
+		if edit.is_main {
+			openCommandLine(edit, getCount(edit.number_string))
+			edit.number_string = ""
+		}
+	})
+	addKeyCommand("add-next-occurrence", "select the word under the cursor, then add a cursor on the next occurrence of the selection", addNextOccurrence)
+	addKeyCommand("select-all-occurrences", "add a cursor on every occurrence of the selection", selectAllOccurrences)
+	addKeyCommand("add-cursor-below", "add a cursor on the line below", func(edit *Edit) { addCursorOnLine(edit, 1) })
+	addKeyCommand("add-cursor-above", "add a cursor on the line above", func(edit *Edit) { addCursorOnLine(edit, -1) })
+	addKeyCommand("indent", "indent the lines of every cursor", indent)
+	addKeyCommand("deindent", "deindent the lines of every cursor", deindent)
+	addKeyCommand("copy", "copy the selection", copySelection)
+	addKeyCommand("cut", "cut the selection", cutSelection)
+	setupProfileCommands()
+	addKeyCommand("nothing", "do nothing, to take a key away", func(edit *Edit) {})
+}
+
+func getKeymapPath() string {
+	return filepath.Join(APP_CONFIG_DIR, "keymap.cdmg")
+}
+
+// the name of a key as bindings are looked up by. Ctrl with a letter is
+// the control key it makes and shift is already in the case of a character,
+// so <C-s> and <Ctrl-S> are the same key, like <C-Space> and <Ctrl-Space>
+// and <C-_> and <C-/> (which terminals send as the same).
+func getChordName(ev *tcell.EventKey) string {
+	key, char, mods := ev.Key(), ev.Rune(), ev.Modifiers()
+
+	if key == tcell.KeyRune && mods&tcell.ModCtrl != 0 && unicode.ToLower(char) >= 'a' && unicode.ToLower(char) <= 'z' {
+		key = tcell.KeyCtrlA+tcell.Key(unicode.ToLower(char)-'a')
+		char = 0
+		mods &^= tcell.ModShift
+	}else if key == tcell.KeyRune && mods&tcell.ModCtrl != 0 && char == ' ' {
+		key, char = tcell.KeyCtrlSpace, 0
+	}else if key == tcell.KeyRune && mods&tcell.ModCtrl != 0 && (char == '_' || char == '/') {
+		key, char = tcell.KeyCtrlUnderscore, 0
+	}
+	if key == tcell.KeyRune {
+		mods &^= tcell.ModShift
+	}
+
+	return formatKey(tcell.NewEventKey(key, char, mods))
+}
+
+func getKeysName(keys []*tcell.EventKey) string {
+	name := ""
+	for _, ev := range(keys) {
+		name += getChordName(ev)
+	}
+	return name
+}
+
+// the keys of a binding, or the first part of text that isn't a key
+func parseKeymapKeys(text string) ([]*tcell.EventKey, string) {
+	rest := text
+	for len(rest) > 0 {
+		if rest[0] == '<' {
+			end := strings.IndexByte(rest, '>')
+			if end <= 1 {
+				return nil, rest
+			}
+			if len(parseKeys(rest[:end+1])) != 1 { // not a name, it came out as its characters
+				return nil, rest[:end+1]
+			}
+			rest = rest[end+1:]
+			continue
+		}
+
+		_, size := utf8.DecodeRuneInString(rest)
+		rest = rest[size:]
+	}
+
+	return parseKeys(text), ""
+}
+
+func parseKeymapModes(text string) ([]string, string) {
+	if text == "all" {
+		return KEYMAP_MODES, ""
+	}
+
+	modes := strings.Split(text, ",")
+	for _, mode := range(modes) {
+		if !slices.Contains(KEYMAP_MODES, mode) {
+			return nil, mode
+		}
+	}
+	return modes, ""
+}
+
+// adds the bindings in text to KEYMAP, returns what was wrong with the lines that couldn't be read
+func readKeymap(text string) []string {
+	problems := []string{}
+
+	for indx, line := range(strings.Split(text, "\n")) {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		where := "line "+strconv.Itoa(indx+1)+": "
+		fields := strings.Fields(line)
+
+		if len(fields) < 3 {
+			problems = append(problems, where+"expected modes, keys and a command")
+			continue
+		}
+
+		modes, bad_mode := parseKeymapModes(fields[0])
+		if bad_mode != "" {
+			problems = append(problems, where+"no mode called "+bad_mode)
+			continue
+		}
+
+		keys, bad_key := parseKeymapKeys(fields[1])
+		if bad_key != "" {
+			problems = append(problems, where+"unknown key "+bad_key)
+			continue
+		}
+
+		binding := KeyBinding{}
+		if fields[2] == "keys" {
+			if len(fields) != 4 {
+				problems = append(problems, where+"keys takes the keys to type, with no spaces (<Space> is a space)")
+				continue
+			}
+
+			typed, bad_typed := parseKeymapKeys(fields[3])
+			if bad_typed != "" {
+				problems = append(problems, where+"unknown key "+bad_typed)
+				continue
+			}
+			binding.keys = typed
+		}else{
+			binding.command = findKeyCommand(fields[2])
+			if binding.command == nil {
+				problems = append(problems, where+"no command called "+fields[2])
+				continue
+			}else if len(fields) > 3 {
+				problems = append(problems, where+"too much after the command")
+				continue
+			}
+		}
+
+		for _, mode := range(modes) {
+			KEYMAP[mode][getKeysName(keys)] = binding
+		}
+	}
+
+	return problems
+}
+
+func loadKeymap() {
+	KEYMAP = map[string]map[string]KeyBinding{}
+	for _, mode := range(KEYMAP_MODES) {
+		KEYMAP[mode] = map[string]KeyBinding{}
+	}
+	KEYMAP_ERROR = ""
+
+	readKeymap(DEFAULT_KEYMAP)
+
+	if profile := getKeyProfile(); profile != nil {
+		readKeymap(profile.keymap)
+	}else{
+		KEYMAP_ERROR = "allSettings.cdmg has no key profile called "+KEY_PROFILE+" (there are "+strings.Join(getKeyProfileNames(), ", ")+")"
+	}
+
+	data, err := os.ReadFile(getKeymapPath())
+	if err != nil {
+		writeKeymapFile()
+		return
+	}
+
+	problems := readKeymap(string(data))
+	if len(problems) > 0 {
+		KEYMAP_ERROR = "keymap.cdmg "+problems[0]
+		if len(problems) > 1 {
+			KEYMAP_ERROR += " (and "+pluralize(len(problems)-1, "more problem")+")"
+		}
+	}
+}
+
+func showKeymapError() {
+	if KEYMAP_ERROR != "" {
+		displayError(KEYMAP_ERROR)
+		KEYMAP_ERROR = ""
+	}
+}
+
+func reloadKeymap() {
+	loadKeymap()
+	if KEYMAP_ERROR != "" {
+		showKeymapError()
+	}else{
+		commandMessage("keymap.cdmg read again")
+	}
+}
+
+// :keymap opens keymap.cdmg
+func exKeymap(call ExCall) {
+	openFileByUser(getKeymapPath())
+}
+
+func isKeymapFile(path string) bool {
+	abs_path, err := filepath.Abs(path)
+	return err == nil && abs_path == getKeymapPath()
+}
+
+// the file a new user starts with, explaining itself with no bindings of its own
+func writeKeymapFile() {
+	lines := []string{
+		"# Key bindings, added on top of the built in ones and those of the key profile (KEY_PROFILE in allSettings.cdmg). Saving this file reads it again.",
+		"#",
+		"# One binding per line: modes keys command",
+		"#   modes    normal, insert, visual, find (the find and replace boxes) or prompt (the command line and other questions), several with commas (normal,visual) or all",
+		"#   keys     written like macros: plain characters, <C-s> <A-n> <Esc> <Enter> <Tab> <Up> <Space> <lt> and <gt> (for < and >), one after another for a sequence (gq, <C-k><C-c>)",
+		"#   command  one of the commands below, or keys then the keys to type in their place, or nothing to take a key away",
+		"#",
+		"# For example:",
+		"#   normal,visual <C-s> save",
+		"#   insert jk keys <Esc>",
+		"#   normal w keys e",
+		"#",
+		"# Commands:",
+	}
+
+	for _, command := range(KEY_COMMANDS) {
+		lines = append(lines, "#   "+command.name+strings.Repeat(" ", max(24-len(command.name), 1))+command.about)
+	}
+
+	lines = append(lines, "#", "# Built in bindings:")
+	for _, line := range(strings.Split(strings.TrimSpace(DEFAULT_KEYMAP), "\n")) {
+		lines = append(lines, "#   "+line)
+	}
+
+	for _, profile := range(KEY_PROFILES) {
+		if profile.keymap == "" {
+			continue
+		}
+		lines = append(lines, "#", "# Added by the "+profile.name+" profile:")
+		for _, line := range(strings.Split(strings.TrimSpace(profile.keymap), "\n")) {
+			lines = append(lines, "#   "+line)
+		}
+	}
+
+	os.WriteFile(getKeymapPath(), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// the mode bindings are looked up in and the edit a command runs on, no mode
+// when the key shouldn't be looked up at all. Keys that finish a normal mode
+// command can only be bound to other keys, and ones that name a character
+// (f{char}, m{mark}, "{register}...) not at all.
+func getKeymapState() (string, *Edit, bool) {
+	if SHOWING_INPUT_MODAL { // in the order handleKey looks
+		return "prompt", &INPT_TEXTEDIT, false
+	}else if SHOWING_INPUT_BOOL {
+		return "", nil, false
+	}else if SHOWING_COMMAND_LINE {
+		return "prompt", &COMMAND_TEXTEDIT, false
+	}else if SHOWING_PICKER {
+		return "", nil, false
+	}else if SHOWING_FINDER {
+		return "prompt", &FINDER_TEXTEDIT, false
+	}else if SHOWING_GREP {
+		return "prompt", getGrepBoxes()[GREP_FOCUS], false
+	}else if EXPLORER_FOCUSED {
+		return "", nil, false
+	}else if SHOWING_FIND && USING_REPLACE {
+		return "find", &REPLACE_TEXTEDIT, false
+	}else if SHOWING_FIND {
+		return "find", &FIND_TEXTEDIT, false
+	}else if WAITING_FOR_PANE_KEY {
+		return "", nil, false // the key after Ctrl+W
+	}
+
+	edit := &MAIN_TEXTEDIT
+	mode := "normal"
+	if edit.current_mode == "i" {
+		mode = "insert"
+	}else if edit.visual_mode != "" {
+		mode = "visual"
+	}
+
+	if edit.current_mode == "n" && edit.pending_command != "" {
+		last, _ := utf8.DecodeLastRuneInString(edit.pending_command)
+		if strings.ContainsRune("fFtT'`m\"q@ia", last) {
+			return "", nil, false
+		}
+		return mode, edit, true
+	}
+
+	return mode, edit, false
+}
+
+// the binding for keys, and whether a longer one starts with them
+func lookupKeys(mode, keys string, only_typing bool) (KeyBinding, bool, bool) {
+	binding, found := KEYMAP[mode][keys]
+	if found && only_typing && binding.command != nil {
+		found = false
+	}
+
+	longer := false
+	for other, other_binding := range(KEYMAP[mode]) {
+		if len(other) > len(keys) && strings.HasPrefix(other, keys) && !(only_typing && other_binding.command != nil) {
+			longer = true
+			break
+		}
+	}
+
+	return binding, found, longer
+}
+
+// called with every key before it is handled, returns true if it was taken
+// for a binding (or the start of one)
+func keymapHandleKey(ev *tcell.EventKey) bool {
+	mode, edit, only_typing := getKeymapState()
+	KEYMAP_SHIFT_HELD = ev.Key() != tcell.KeyRune && ev.Modifiers()&tcell.ModShift != 0
+
+	if mode == "" || ev.Key() == tcell.KeyCtrlQ {
+		if len(KEYMAP_PENDING) > 0 {
+			resolvePendingKeys()
+		}
+		return false
+	}
+
+	KEYMAP_PENDING = append(KEYMAP_PENDING, ev)
+	binding, found, longer := lookupKeys(mode, getKeysName(KEYMAP_PENDING), only_typing)
+
+	if longer {
+		waitForKeys()
+		return true
+	}
+
+	if len(KEYMAP_PENDING) == 1 {
+		KEYMAP_PENDING = nil
+		KEYMAP_WAIT_ID ++
+		if !found {
+			return false
+		}
+		runKeyBinding(binding, edit)
+		return true
+	}
+
+	resolvePendingKeys()
+	return true
+}
+
+func waitForKeys() {
+	KEYMAP_WAIT_ID ++
+	id := KEYMAP_WAIT_ID
+
+	time.AfterFunc(time.Duration(KEYMAP_TIMEOUT_MS)*time.Millisecond, func() {
+		runOnUI(func() {
+			if id == KEYMAP_WAIT_ID && len(KEYMAP_PENDING) > 0 {
+				resolvePendingKeys()
+			}
+		})
+	})
+}
+
+// runs the longest binding the pending keys start with and feeds the rest
+// back in, or with none the first key goes through as it is
+func resolvePendingKeys() {
+	keys := KEYMAP_PENDING
+	KEYMAP_PENDING = nil
+	KEYMAP_WAIT_ID ++
+
+	mode, edit, only_typing := getKeymapState()
+
+	for count := len(keys); count > 0 && mode != ""; count-- {
+		if binding, found, _ := lookupKeys(mode, getKeysName(keys[:count]), only_typing); found {
+			runKeyBinding(binding, edit)
+			feedKeys(keys[count:])
+			return
+		}
+	}
+
+	typeKeys(keys[:1])
+	feedKeys(keys[1:])
+}
+
+// keys looked up in the bindings again
+func feedKeys(keys []*tcell.EventKey) {
+	for _, ev := range(keys) {
+		if !keymapHandleKey(ev) {
+			routeKey(ev)
+		}
+	}
+}
+
+// keys handled as they are
+func typeKeys(keys []*tcell.EventKey) {
+	for _, ev := range(keys) {
+		routeKey(ev)
+	}
+}
+
+func runKeyBinding(binding KeyBinding, edit *Edit) {
+	if binding.command == nil {
+		typeKeys(binding.keys)
+		return
+	}
+
+	syncUndoCursor(edit)
+	binding.command.run(edit)
+	showCursor(edit)
+	readyUndoHistory(edit)
+
+	LAST_KEY_COMMAND = binding.command.name
+}
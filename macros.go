@@ -0,0 +1,314 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Macros: q{register} records every key after it into the register until q
+// is pressed again, @{register} plays them back ([count] times) and @@ plays
+// the last one played again. The keys are kept as text, plain characters as
+// they are and everything else in angle brackets (<Esc>, <C-Left>, <A-n>,
+// <lt> for a '<'), so a macro can be pasted, fixed and yanked back.
+//
+// Playback stops as soon as a command fails, a motion that can't move or a
+// find that finds nothing, which is what ends a macro that calls itself. A
+// macro calling itself as its last key plays again instead of nesting, so
+// it can go on as long as it has to, up to MACRO_MAX_REPLAYS times. Esc or
+// Ctrl+C stops it between passes.
+// Recorded macros, and anything yanked into a to z, are kept in macros.cdmg
+// in APP_CONFIG_DIR.
+
+var RECORDING_REGISTER rune // 0 when not recording
+var RECORDED_KEYS []string
+var LAST_MACRO_REGISTER rune
+var MACROS = map[rune]string{} // every recorded macro, for saving
+
+var MACRO_DEPTH int // how many macros are playing inside each other
+var MACRO_MAX_DEPTH = 100
+var MACRO_FAILED bool
+var MACRO_TAIL_REGISTER rune // the macro whose last key is being handled
+var MACRO_REPLAY bool // it called itself there, so play it again
+var MACRO_MAX_REPLAYS = 10000
+var MACRO_HELD_EVENTS []tcell.Event // came in while a macro played, handled once it is done
+
+func isMacroRegister(name rune) bool {
+	return name >= 'a' && name <= 'z' || name >= 'A' && name <= 'Z' || name >= '0' && name <= '9' || name == '"'
+}
+
+func getKeyName(key tcell.Key) string {
+	if name, ok := tcell.KeyNames[key]; ok {
+		return name
+	}
+	return ""
+}
+
+func formatKey(ev *tcell.EventKey) string {
+	name := string(ev.Rune())
+	if ev.Key() != tcell.KeyRune {
+		name = getKeyName(ev.Key())
+	}else if ev.Rune() == '<' {
+		name = "lt"
+	}else if ev.Rune() == '>' && ev.Modifiers() != tcell.ModNone {
+		name = "gt" // <A->> would end at the first >
+	}
+
+	mods := ""
+	if ev.Modifiers()&tcell.ModCtrl != 0 && !strings.HasPrefix(name, "Ctrl-") {
+		mods += "C-"
+	}
+	if ev.Modifiers()&tcell.ModAlt != 0 {
+		mods += "A-"
+	}
+	if ev.Modifiers()&tcell.ModShift != 0 {
+		mods += "S-"
+	}
+
+	if mods == "" && ev.Key() == tcell.KeyRune && name != "lt" {
+		return name
+	}
+	return "<"+mods+name+">"
+}
+
+// turns macro text back into the keys it was recorded from
+func parseKeys(text string) []*tcell.EventKey {
+	names := map[string]tcell.Key{}
+	for key, name := range(tcell.KeyNames) {
+		names[name] = key
+	}
+
+	keys := []*tcell.EventKey{}
+
+	for len(text) > 0 {
+		end := strings.IndexByte(text, '>')
+
+		if text[0] == '<' && end > 1 {
+			name := text[1:end]
+			mods := tcell.ModNone
+
+			for len(name) > 2 && name[1] == '-' && strings.ContainsRune("CAS", rune(name[0])) {
+				mods |= map[byte]tcell.ModMask{'C': tcell.ModCtrl, 'A': tcell.ModAlt, 'S': tcell.ModShift}[name[0]]
+				name = name[2:]
+			}
+
+			if key, ok := names[name]; ok {
+				keys = append(keys, tcell.NewEventKey(key, 0, mods))
+				text = text[end+1:]
+				continue
+			}else if name == "lt" || name == "gt" || name == "Space" {
+				keys = append(keys, tcell.NewEventKey(tcell.KeyRune, map[string]rune{"lt": '<', "gt": '>', "Space": ' '}[name], mods))
+				text = text[end+1:]
+				continue
+			}else if utf8.RuneCountInString(name) == 1 && mods != tcell.ModNone {
+				char, _ := utf8.DecodeRuneInString(name)
+				keys = append(keys, tcell.NewEventKey(tcell.KeyRune, char, mods))
+				text = text[end+1:]
+				continue
+			}
+		}
+
+		char, size := utf8.DecodeRuneInString(text) // not a key name, just a character
+		keys = append(keys, tcell.NewEventKey(tcell.KeyRune, char, tcell.ModNone))
+		text = text[size:]
+	}
+
+	return keys
+}
+
+// called with every key while recording, before it is handled
+func recordMacroKey(ev *tcell.EventKey) {
+	if RECORDING_REGISTER != 0 && MACRO_DEPTH == 0 { // keys a macro plays are already in it as the @
+		RECORDED_KEYS = append(RECORDED_KEYS, formatKey(ev))
+	}
+}
+
+func startRecording(name rune) {
+	RECORDING_REGISTER = name
+	RECORDED_KEYS = []string{}
+}
+
+func stopRecording() {
+	name := RECORDING_REGISTER
+	RECORDING_REGISTER = 0
+
+	keys := RECORDED_KEYS
+	if len(keys) > 0 {
+		keys = keys[:len(keys)-1] // the q that stopped it
+	}
+	text := strings.Join(keys, "")
+
+	if name >= 'A' && name <= 'Z' {
+		name = unicode.ToLower(name)
+		text = REGISTERS[name].text+text
+	}
+
+	REGISTERS[name] = Register{text: text}
+	keepMacro(name, text)
+}
+
+// remembers text as the macro in register name, for one recorded there and
+// for anything yanked into a to z, so a macro fixed and yanked back is kept
+func keepMacro(name rune, text string) {
+	MACROS[name] = text
+	saveMacros()
+}
+
+// ends playback of every macro playing, for a command that couldn't do what it was asked
+func failMacro() {
+	if MACRO_DEPTH > 0 {
+		MACRO_FAILED = true
+	}
+}
+
+func playMacro(name rune, count int) {
+	if name == '@' {
+		name = LAST_MACRO_REGISTER
+	}
+	if name == 0 {
+		return
+	}
+	LAST_MACRO_REGISTER = name
+
+	if MACRO_DEPTH > 0 && count == 1 && unicode.ToLower(name) == MACRO_TAIL_REGISTER {
+		MACRO_REPLAY = true // played by the loop below, nesting would run out of depth
+		return
+	}
+
+	if MACRO_DEPTH >= MACRO_MAX_DEPTH {
+		MACRO_FAILED = true
+		commandError("Macros nested too deep, stopped at "+strconv.Itoa(MACRO_MAX_DEPTH))
+		return
+	}
+
+	if MACRO_DEPTH == 0 {
+		MACRO_FAILED = false
+	}
+	MACRO_DEPTH ++
+
+	keys := parseKeys(readRegister(name).text)
+	replays := 0
+
+	for i := 0; i < count; i ++ {
+		if (i > 0 || replays > 0) && macroInterrupted() {
+			commandError("Macro stopped")
+			break
+		}
+
+		buffer, cursor, version := MAIN_TEXTEDIT.buffer, MAIN_TEXTEDIT.cursor, MAIN_TEXTEDIT.buffer.version
+		for j, ev := range(keys) {
+			if MACRO_FAILED || ev.Key() == tcell.KeyCtrlQ {
+				break
+			}
+			MACRO_TAIL_REGISTER = 0
+			if j == len(keys)-1 {
+				MACRO_TAIL_REGISTER = unicode.ToLower(name)
+			}
+			handleKey(ev)
+		}
+		MACRO_TAIL_REGISTER = 0
+		if MACRO_FAILED {
+			break
+		}
+		if MACRO_REPLAY {
+			MACRO_REPLAY = false
+			if buffer == MAIN_TEXTEDIT.buffer && cursor == MAIN_TEXTEDIT.cursor && version == buffer.version {
+				break // nothing changed, it would go on forever
+			}
+			replays ++
+			if replays >= MACRO_MAX_REPLAYS {
+				commandError("Macro stopped after playing "+strconv.Itoa(MACRO_MAX_REPLAYS)+" times")
+				break
+			}
+			i -- // this pass again
+		}
+	}
+	MACRO_REPLAY = false
+
+	MACRO_DEPTH --
+	if MACRO_DEPTH == 0 {
+		MACRO_FAILED = false
+		if len(KEYMAP_PENDING) > 0 { // the start of a binding at the very end doesn't wait for more
+			resolvePendingKeys()
+		}
+	}
+}
+
+// true if Esc or Ctrl+C was pressed while a macro played, anything else
+// that came in is held for after it
+func macroInterrupted() bool {
+	for s.HasPendingEvent() {
+		ev := s.PollEvent()
+		if key, ok := ev.(*tcell.EventKey); ok && (key.Key() == tcell.KeyEscape || key.Key() == tcell.KeyCtrlC) {
+			return true
+		}
+		MACRO_HELD_EVENTS = append(MACRO_HELD_EVENTS, ev)
+	}
+	return false
+}
+
+// the next event for the main loop, the ones held while a macro played first
+func nextEvent() tcell.Event {
+	if len(MACRO_HELD_EVENTS) > 0 {
+		ev := MACRO_HELD_EVENTS[0]
+		MACRO_HELD_EVENTS = MACRO_HELD_EVENTS[1:]
+		return ev
+	}
+	return s.PollEvent()
+}
+
+func saveMacros() {
+	names := []string{}
+	for name := range(MACROS) {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	text := "# Macros recorded with q or yanked into a to z, one per line as register: keys\n"
+	text += "# (register:: followed by a quoted string for one with line breaks in it)\n"
+	for _, name := range(names) {
+		keys := MACROS[rune(name[0])]
+		if strings.Contains(keys, "\n") {
+			text += name+":: "+strconv.Quote(keys)+"\n"
+		}else{
+			text += name+": "+keys+"\n"
+		}
+	}
+
+	os.WriteFile(filepath.Join(APP_CONFIG_DIR, "macros.cdmg"), []byte(text), 0644)
+}
+
+func loadMacros() {
+	data, err := os.ReadFile(filepath.Join(APP_CONFIG_DIR, "macros.cdmg"))
+	if err != nil {
+		return
+	}
+
+	for _, line := range(strings.Split(string(data), "\n")) {
+		line = strings.TrimRight(line, "\r")
+		if len(line) < 3 || line[0] == '#' || !isMacroRegister(rune(line[0])) {
+			continue
+		}
+
+		name := rune(line[0])
+		keys := line[3:]
+		if strings.HasPrefix(line[1:], ":: ") {
+			unquoted, err := strconv.Unquote(line[4:])
+			if err != nil {
+				continue
+			}
+			keys = unquoted
+		}else if line[1:3] != ": " {
+			continue
+		}
+
+		MACROS[name] = keys
+		REGISTERS[name] = Register{text: keys}
+	}
+}
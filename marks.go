@@ -0,0 +1,467 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Marks: m{a-z} marks the cursor position in the file, m{A-Z} marks it for
+// every file, so 'A goes back to it from anywhere. '{mark} goes to the first
+// character of the mark's line and `{mark} to the mark itself, and both work
+// as motions after an operator (d'a, y`b). A few marks are set by the editor:
+// ' (or `) where the cursor was before the last jump, . the last change, and
+// < and > the start and end of the last selection.
+//
+// Marks are kept as byte offsets on the TextBuffer and move along with the
+// text around them as it changes. They are saved in marks.cdmg in
+// APP_CONFIG_DIR when a file is closed, along with the jump list.
+//
+// The jump list remembers where the cursor was before each big move (G, gg,
+// a find, a mark, a :{n}, opening or switching files). Ctrl+O goes back
+// along it and Ctrl+I (Tab) forwards again. Every file also keeps a list of
+// where its text was changed, which g; and g, go back and forth through.
+
+type FileMark struct {
+	path string
+	row int
+	col int
+}
+
+type Jump struct {
+	path string // "" for a file that was never saved
+	file *OpenFile
+	row int
+	col int
+}
+
+var FILE_MARKS = map[string]map[rune]FileMark{} // the a-z marks of each file by absolute path, from when it was last closed
+var GLOBAL_MARKS = map[rune]FileMark{} // A-Z
+
+var JUMP_LIST []Jump // oldest first
+var JUMP_INDX int // where Ctrl+O and Ctrl+I are in it, len(JUMP_LIST) when not walking it
+var JUMP_LIST_SIZE = 100
+var JUMPING bool // going to a jump, which isn't one of its own
+
+var CHANGE_LIST_SIZE = 100
+
+func isFileMark(name rune) bool {
+	return name >= 'A' && name <= 'Z'
+}
+
+// keeps the marks and changes on the same text when length bytes are
+// inserted at at, or removed from at when length is negative
+func (b *TextBuffer) shiftMarks(at, length int) {
+	shift := func(offset int) int {
+		if length > 0 && offset >= at {
+			return offset+length
+		}else if length < 0 && offset >= at-length {
+			return offset+length
+		}else if length < 0 && offset > at {
+			return at // the text it was on is gone
+		}
+		return offset
+	}
+
+	for name, offset := range(b.marks) {
+		b.marks[name] = shift(offset)
+	}
+	for indx, offset := range(b.changes) {
+		b.changes[indx] = shift(offset)
+	}
+	for indx, offset := range(b.cursor_offsets) {
+		if length > 0 && offset == at && indx < b.cursors_done {
+			continue // a cursor that is done stays before what the next one types right after it
+		}
+		b.cursor_offsets[indx] = shift(offset)
+	}
+}
+
+// adds a change at offset to the change list, in place of the last one if it was on the same line
+func (b *TextBuffer) recordChange(offset int) {
+	row, _ := b.position(offset)
+
+	if len(b.changes) > 0 {
+		last_row, _ := b.position(b.changes[len(b.changes)-1])
+		if last_row == row {
+			b.changes = b.changes[:len(b.changes)-1]
+		}
+	}
+
+	b.changes = append(b.changes, offset)
+	if len(b.changes) > CHANGE_LIST_SIZE {
+		b.changes = b.changes[len(b.changes)-CHANGE_LIST_SIZE:]
+	}
+	b.change_indx = len(b.changes)
+}
+
+func (b *TextBuffer) clampedOffset(row, col int) int {
+	row = max(min(row, b.lineCount()-1), 0)
+	col = snapToGrapheme(b.line(row), max(min(col, b.lineLen(row)), 0))
+	return b.offset(row, col)
+}
+
+// the position of a mark in the edit's text
+func getMarkPosition(edit *Edit, name rune) (int, int, bool) {
+	if name == '`' {
+		name = '\''
+	}
+
+	if name == '.' {
+		if len(edit.buffer.changes) == 0 {
+			return 0, 0, false
+		}
+		row, col := edit.buffer.position(edit.buffer.changes[len(edit.buffer.changes)-1])
+		return row, col, true
+	}
+
+	offset, ok := edit.buffer.marks[name]
+	if !ok {
+		return 0, 0, false
+	}
+
+	row, col := edit.buffer.position(offset)
+	return row, col, true
+}
+
+func setMark(edit *Edit, name rune) bool {
+	if name == '`' {
+		name = '\''
+	}
+	if !unicode.IsLetter(name) && name != '\'' || name > unicode.MaxASCII {
+		return false
+	}
+
+	cursor := edit.cursor
+
+	if isFileMark(name) { // there is only one of each, so it leaves any other file
+		delete(MAIN_TEXTEDIT.buffer.marks, name)
+		for _, file := range(OPEN_FILES) {
+			delete(file.edit.buffer.marks, name)
+		}
+
+		GLOBAL_MARKS[name] = FileMark{path: absolute_path, row: cursor.row, col: cursor.col}
+		if absolute_path != "" {
+			saveMarks()
+		}
+	}
+
+	edit.buffer.marks[name] = edit.buffer.offset(cursor.row, cursor.col)
+	return true
+}
+
+// sets < and > to the ends of the selection, as it is left
+func setVisualMarks(edit *Edit) {
+	cursor := edit.cursor
+
+	sr, sc, er, ec := cursor.row_anchor, cursor.col_anchor, cursor.row, cursor.col
+	if er < sr || er == sr && ec < sc {
+		sr, sc, er, ec = er, ec, sr, sc
+	}
+
+	edit.buffer.marks['<'] = edit.buffer.offset(sr, sc)
+	edit.buffer.marks['>'] = edit.buffer.offset(er, ec)
+}
+
+// goes to a mark, to the first character of its line if linewise
+func jumpToMark(edit *Edit, name rune, linewise bool) bool {
+	row, col, ok := getMarkPosition(edit, name)
+
+	if !ok && isFileMark(name) { // set in another file
+		if !openFileMark(name) {
+			return false
+		}
+		row, col, ok = getMarkPosition(edit, name)
+	}else if ok {
+		recordJump()
+	}
+
+	if !ok {
+		return false
+	}
+
+	if linewise {
+		col = getFirstNonBlank(edit, row)
+	}
+	moveToTarget(edit, MotionTarget{row, col, MOTION_EXCLUSIVE}, false)
+	showCursor(edit)
+	return true
+}
+
+// switches to the file a file mark was set in, opening it if it isn't open
+func openFileMark(name rune) bool {
+	for indx, file := range(OPEN_FILES) {
+		if _, ok := file.edit.buffer.marks[name]; ok && indx != CURRENT_FILE {
+			switchToFile(indx)
+			return true
+		}
+	}
+
+	mark, ok := GLOBAL_MARKS[name]
+	if !ok || mark.path == "" {
+		return false
+	}
+	if info, err := os.Stat(mark.path); err != nil || info.IsDir() {
+		return false
+	}
+
+	openFileByUser(mark.path)
+	return absolute_path == mark.path
+}
+
+// puts the marks kept for the file that was just opened onto its text
+func loadFileMarks() {
+	buffer := MAIN_TEXTEDIT.buffer
+
+	for name, mark := range(FILE_MARKS[absolute_path]) {
+		buffer.marks[name] = buffer.clampedOffset(mark.row, mark.col)
+	}
+	for name, mark := range(GLOBAL_MARKS) {
+		if mark.path == absolute_path && absolute_path != "" {
+			buffer.marks[name] = buffer.clampedOffset(mark.row, mark.col)
+		}
+	}
+}
+
+// keeps the marks of the current file where they are now, for when it is closed
+func storeFileMarks() {
+	if absolute_path == "" {
+		return
+	}
+
+	marks := map[rune]FileMark{}
+	for name, offset := range(MAIN_TEXTEDIT.buffer.marks) {
+		row, col := MAIN_TEXTEDIT.buffer.position(offset)
+		mark := FileMark{path: absolute_path, row: row, col: col}
+
+		if isFileMark(name) {
+			GLOBAL_MARKS[name] = mark
+		}else if name >= 'a' && name <= 'z' {
+			marks[name] = mark
+		}
+	}
+
+	FILE_MARKS[absolute_path] = marks
+}
+
+// adds where the cursor is now to the jump list, before it jumps somewhere else
+func recordJump() bool {
+	if JUMPING || CURRENT_FILE < 0 || CURRENT_FILE >= len(OPEN_FILES) || isThrowawayFile() {
+		return false
+	}
+
+	cursor := MAIN_TEXTEDIT.cursor
+	MAIN_TEXTEDIT.buffer.marks['\''] = MAIN_TEXTEDIT.buffer.offset(cursor.row, cursor.col)
+
+	jump := Jump{path: absolute_path, file: OPEN_FILES[CURRENT_FILE], row: cursor.row, col: cursor.col}
+
+	jumps := []Jump{}
+	for _, old := range(JUMP_LIST) { // only the newest jump to each line is kept
+		if old.row != jump.row || !isSameJumpFile(old, jump) {
+			jumps = append(jumps, old)
+		}
+	}
+	jumps = append(jumps, jump)
+
+	if len(jumps) > JUMP_LIST_SIZE {
+		jumps = jumps[len(jumps)-JUMP_LIST_SIZE:]
+	}
+
+	JUMP_LIST = jumps
+	JUMP_INDX = len(JUMP_LIST)
+	return true
+}
+
+func isSameJumpFile(a, b Jump) bool {
+	if a.path != "" || b.path != "" {
+		return a.path == b.path
+	}
+	return a.file == b.file
+}
+
+// goes to the file and place of a jump, false if its file is gone
+func goToJump(jump Jump) bool {
+	indx := -1
+	for file_indx, file := range(OPEN_FILES) {
+		if jump.path != "" && file.absolute_path == jump.path || jump.path == "" && file == jump.file {
+			indx = file_indx
+		}
+	}
+	if indx == CURRENT_FILE {
+		storeCurrentFile()
+	}
+
+	JUMPING = true
+	defer func() { JUMPING = false }()
+
+	if indx == -1 {
+		if jump.path == "" {
+			return false
+		}
+		if info, err := os.Stat(jump.path); err != nil || info.IsDir() {
+			return false
+		}
+		openFileByUser(jump.path)
+		if absolute_path != jump.path {
+			return false
+		}
+	}else if indx != CURRENT_FILE {
+		switchToFile(indx)
+	}
+
+	edit := &MAIN_TEXTEDIT
+	offset := edit.buffer.clampedOffset(jump.row, jump.col)
+	row, col := edit.buffer.position(offset)
+
+	moveToTarget(edit, MotionTarget{row, col, MOTION_EXCLUSIVE}, false)
+	showCursor(edit)
+	return true
+}
+
+// Ctrl+O (step -1) and Ctrl+I (step 1), count jumps along the list
+func walkJumpList(step, count int) bool {
+	if step < 0 && JUMP_INDX >= len(JUMP_LIST) && recordJump() {
+		JUMP_INDX = len(JUMP_LIST)-1 // where the walk started, for Ctrl+I to come back to
+	}
+
+	for {
+		target := JUMP_INDX+step*count
+		if target < 0 || target >= len(JUMP_LIST) {
+			return false
+		}
+
+		if goToJump(JUMP_LIST[target]) {
+			JUMP_INDX = target
+			return true
+		}
+
+		// its file is gone, so it is left out
+		JUMP_LIST = append(JUMP_LIST[:target], JUMP_LIST[target+1:]...)
+		if target < JUMP_INDX {
+			JUMP_INDX --
+		}
+	}
+}
+
+// g; (older) and g, (newer), count changes along the change list of the file
+func walkChangeList(edit *Edit, older bool, count int) bool {
+	buffer := edit.buffer
+	if len(buffer.changes) == 0 {
+		return false
+	}
+
+	target := buffer.change_indx+count
+	if older {
+		target = buffer.change_indx-count
+	}
+
+	if target < 0 && buffer.change_indx > 0 {
+		target = 0
+	}else if target >= len(buffer.changes) && buffer.change_indx < len(buffer.changes)-1 {
+		target = len(buffer.changes)-1
+	}
+	if target < 0 || target >= len(buffer.changes) {
+		return false
+	}
+
+	buffer.change_indx = target
+	row, col := buffer.position(buffer.changes[target])
+	moveToTarget(edit, MotionTarget{row, col, MOTION_EXCLUSIVE}, false)
+	showCursor(edit)
+	return true
+}
+
+func saveMarks() {
+	lines := []string{"# Marks and the jump list, one per line as: mark {name} row,col path  or  jump row,col path"}
+
+	paths := []string{}
+	for path := range(FILE_MARKS) {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	formatMark := func(kind string, mark FileMark) string {
+		return kind+" "+strconv.Itoa(mark.row)+","+strconv.Itoa(mark.col)+" "+mark.path
+	}
+
+	for _, path := range(paths) {
+		names := []string{}
+		for name := range(FILE_MARKS[path]) {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+
+		for _, name := range(names) {
+			lines = append(lines, formatMark("mark "+name, FILE_MARKS[path][rune(name[0])]))
+		}
+	}
+
+	for name := 'A'; name <= 'Z'; name++ {
+		if mark, ok := GLOBAL_MARKS[name]; ok && mark.path != "" {
+			lines = append(lines, formatMark("mark "+string(name), mark))
+		}
+	}
+
+	for _, jump := range(JUMP_LIST) {
+		if jump.path != "" {
+			lines = append(lines, formatMark("jump", FileMark{path: jump.path, row: jump.row, col: jump.col}))
+		}
+	}
+
+	os.WriteFile(filepath.Join(APP_CONFIG_DIR, "marks.cdmg"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func loadMarks() {
+	data, err := os.ReadFile(filepath.Join(APP_CONFIG_DIR, "marks.cdmg"))
+	if err != nil {
+		return
+	}
+
+	// reads "row,col path" from the end of a line
+	parseMark := func(text string) (FileMark, bool) {
+		place, path, ok := strings.Cut(text, " ")
+		if !ok || path == "" {
+			return FileMark{}, false
+		}
+
+		row_text, col_text, _ := strings.Cut(place, ",")
+		row, row_err := strconv.Atoi(row_text)
+		col, col_err := strconv.Atoi(col_text)
+		if row_err != nil || col_err != nil {
+			return FileMark{}, false
+		}
+
+		return FileMark{path: path, row: row, col: col}, true
+	}
+
+	for _, line := range(strings.Split(string(data), "\n")) {
+		line = strings.TrimRight(line, "\r")
+
+		if strings.HasPrefix(line, "mark ") && len(line) > 7 && line[6] == ' ' {
+			name := rune(line[5])
+			mark, ok := parseMark(line[7:])
+			if !ok {
+				continue
+			}
+
+			if isFileMark(name) {
+				GLOBAL_MARKS[name] = mark
+			}else if name >= 'a' && name <= 'z' {
+				if FILE_MARKS[mark.path] == nil {
+					FILE_MARKS[mark.path] = map[rune]FileMark{}
+				}
+				FILE_MARKS[mark.path][name] = mark
+			}
+		}else if strings.HasPrefix(line, "jump ") {
+			mark, ok := parseMark(line[5:])
+			if ok {
+				JUMP_LIST = append(JUMP_LIST, Jump{path: mark.path, row: mark.row, col: mark.col})
+			}
+		}
+	}
+
+	JUMP_INDX = len(JUMP_LIST)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Multiple cursors: the primary cursor stays in edit.cursor and the others
+// are kept in extra_cursors, each with its own anchor so each can hold a
+// selection. Keys that type, delete or move are handled at every cursor in
+// turn, from the top of the text down, with the mode and the half typed
+// command put back in between so every cursor sees the key the same way.
+// While that goes on the buffer keeps the byte offsets of all of them in
+// cursor_offsets and moves them with the text like marks, so an edit at one
+// cursor doesn't throw the others off. It is still one key to the undo
+// history and to . (repeat).
+//
+//	Ctrl+D           select the word under the cursor, then add the next occurrence of the selection
+//	Alt+D            select every occurrence of the selection
+//	Alt+J, Alt+Down  add a cursor on the line below
+//	Alt+K, Alt+Up    add a cursor on the line above
+//	Alt+click        add a cursor, or remove the one clicked on
+//	Esc              (in normal mode) back to one cursor
+
+var CURSOR_KEY_PASS int // which cursor a key is being handled at, from 1, 0 when it isn't going around them
+var CURSOR_GLOBAL_KEYS = ":/q@.m'`gG[]" // normal mode keys that act once for the whole edit
+
+func getAllCursors(edit *Edit) []Cursor {
+	return append([]Cursor{edit.cursor}, edit.extra_cursors...)
+}
+
+// the start and end byte offsets of what a cursor selects, the same when it selects nothing
+func getCursorSpan(edit *Edit, cursor Cursor) (int, int) {
+	at := edit.buffer.clampedOffset(cursor.row, cursor.col)
+	anchor := edit.buffer.clampedOffset(cursor.row_anchor, cursor.col_anchor)
+	return min(at, anchor), max(at, anchor)
+}
+
+// puts the cursors' offsets on the buffer so edits move them, returns where they start
+func pinCursors(edit *Edit, cursors []Cursor) int {
+	base := len(edit.buffer.cursor_offsets)
+	for _, cursor := range(cursors) {
+		edit.buffer.cursor_offsets = append(edit.buffer.cursor_offsets, edit.buffer.clampedOffset(cursor.row, cursor.col), edit.buffer.clampedOffset(cursor.row_anchor, cursor.col_anchor))
+	}
+	return base
+}
+
+// the cursor moved to where its offsets went
+func getPinnedCursor(edit *Edit, cursor Cursor, offsets []int) Cursor {
+	row, col := edit.buffer.position(offsets[0])
+	row_anchor, col_anchor := edit.buffer.position(offsets[1])
+
+	if row != cursor.row || col != cursor.col {
+		cursor.preferencial_col = getTrueCol(col, row, edit)
+	}
+	cursor.row, cursor.col = row, col
+	cursor.row_anchor, cursor.col_anchor = row_anchor, col_anchor
+	return cursor
+}
+
+// takes the cursors off the buffer again, moved along with the text
+func unpinCursors(edit *Edit, cursors []Cursor, base int) {
+	for indx := range(cursors) {
+		cursors[indx] = getPinnedCursor(edit, cursors[indx], edit.buffer.cursor_offsets[base+indx*2:])
+	}
+	edit.buffer.cursor_offsets = edit.buffer.cursor_offsets[:base]
+}
+
+// runs fn, which changes the text, and keeps every cursor on the text it was on
+func trackCursors(edit *Edit, fn func()) {
+	cursors := getAllCursors(edit)
+	base := pinCursors(edit, cursors)
+
+	fn()
+
+	unpinCursors(edit, cursors, base)
+	edit.cursor = cursors[0]
+	edit.extra_cursors = cursors[1:]
+}
+
+// runs fn with each cursor in turn as edit.cursor, from the top of the text
+// down. What runs sees only the one cursor.
+func forEachCursor(edit *Edit, fn func()) {
+	cursors := getAllCursors(edit)
+	primary := cursors[0]
+
+	sort.SliceStable(cursors, func(a, b int) bool {
+		start_a, _ := getCursorSpan(edit, cursors[a])
+		start_b, _ := getCursorSpan(edit, cursors[b])
+		return start_a < start_b
+	})
+	primary_indx := slices.Index(cursors, primary)
+
+	base := pinCursors(edit, cursors)
+	done := edit.buffer.cursors_done
+	edit.extra_cursors = nil
+
+	for indx := range(cursors) {
+		edit.buffer.cursors_done = base+indx*2 // the ones above are done, text typed right after them isn't theirs
+		edit.cursor = getPinnedCursor(edit, cursors[indx], edit.buffer.cursor_offsets[base+indx*2:])
+
+		fn()
+
+		cursors[indx] = edit.cursor
+		edit.buffer.cursor_offsets[base+indx*2] = edit.buffer.clampedOffset(edit.cursor.row, edit.cursor.col)
+		edit.buffer.cursor_offsets[base+indx*2+1] = edit.buffer.clampedOffset(edit.cursor.row_anchor, edit.cursor.col_anchor)
+	}
+
+	edit.buffer.cursors_done = done
+	unpinCursors(edit, cursors, base)
+
+	edit.cursor = cursors[primary_indx]
+	edit.extra_cursors = slices.Delete(cursors, primary_indx, primary_indx+1)
+	mergeCursors(edit)
+}
+
+// drops cursors that landed on the same place or whose selections overlap, the primary always stays
+func mergeCursors(edit *Edit) {
+	if len(edit.extra_cursors) == 0 {
+		return
+	}
+
+	cursors := getAllCursors(edit)
+	primary := cursors[0]
+
+	sort.SliceStable(cursors, func(a, b int) bool {
+		start_a, _ := getCursorSpan(edit, cursors[a])
+		start_b, _ := getCursorSpan(edit, cursors[b])
+		return start_a < start_b
+	})
+
+	kept := []Cursor{}
+	for _, cursor := range(cursors) {
+		if len(kept) > 0 {
+			last := kept[len(kept)-1]
+			last_start, last_end := getCursorSpan(edit, last)
+			start, _ := getCursorSpan(edit, cursor)
+
+			if start < last_end || start == last_start {
+				if cursor == primary {
+					kept[len(kept)-1] = cursor
+				}
+				continue
+			}
+		}
+		kept = append(kept, cursor)
+	}
+
+	primary_indx := slices.Index(kept, primary)
+	edit.cursor = kept[primary_indx]
+	edit.extra_cursors = slices.Delete(kept, primary_indx, primary_indx+1)
+}
+
+func clearExtraCursors(edit *Edit) {
+	edit.extra_cursors = nil
+}
+
+// the new cursor becomes the primary one
+func addCursor(edit *Edit, cursor Cursor) {
+	edit.extra_cursors = append(edit.extra_cursors, edit.cursor)
+	edit.cursor = cursor
+	mergeCursors(edit)
+	showCursor(edit)
+}
+
+// a cursor on the line after the lowest cursor (step 1) or before the highest (-1)
+func addCursorOnLine(edit *Edit, step int) {
+	from := edit.cursor
+	for _, cursor := range(edit.extra_cursors) {
+		if cursor.row*step > from.row*step {
+			from = cursor
+		}
+	}
+
+	row := from.row+step
+	if row < 0 || row >= edit.buffer.lineCount() {
+		failMacro()
+		return
+	}
+
+	col := getFalseCol(from.preferencial_col, row, edit)
+	addCursor(edit, Cursor{row: row, col: col, row_anchor: row, col_anchor: col, preferencial_col: from.preferencial_col})
+}
+
+// adds a cursor where it was clicked, or takes away the one that is there
+func toggleCursorAt(edit *Edit, row, col int) {
+	for indx, cursor := range(edit.extra_cursors) {
+		if cursor.row == row && cursor.col == col {
+			edit.extra_cursors = slices.Delete(edit.extra_cursors, indx, indx+1)
+			return
+		}
+	}
+
+	if edit.cursor.row == row && edit.cursor.col == col && len(edit.extra_cursors) > 0 {
+		edit.cursor = edit.extra_cursors[len(edit.extra_cursors)-1]
+		edit.extra_cursors = edit.extra_cursors[:len(edit.extra_cursors)-1]
+		return
+	}
+
+	addCursor(edit, Cursor{row: row, col: col, row_anchor: row, col_anchor: col, preferencial_col: getTrueCol(col, row, edit)})
+}
+
+func selectWordAtCursor(edit *Edit) bool {
+	object, ok := getWordObject(edit, false, 1)
+	if !ok || getCharTypeAt(edit, object.sr, object.sc) == WHITESPACE_CHAR_TYPE {
+		return false
+	}
+
+	edit.cursor = Cursor{row: object.er, col: object.ec, row_anchor: object.sr, col_anchor: object.sc, preferencial_col: getTrueCol(object.ec, object.er, edit)}
+	return true
+}
+
+// what the occurrence keys look for: the selection, or the word under the
+// cursor when nothing is selected (then selected, and nothing more is done)
+func getOccurrenceText(edit *Edit) (string, bool) {
+	if edit.visual_mode == "b" {
+		return "", false
+	}else if edit.visual_mode != "" { // the same text as a plain selection
+		sr, sc, er, ec := getSelectionRange(edit)
+		edit.visual_mode = ""
+		edit.cursor = Cursor{row: er, col: ec, row_anchor: sr, col_anchor: sc, preferencial_col: getTrueCol(ec, er, edit)}
+	}
+
+	if !hasSelection(edit) {
+		if len(edit.extra_cursors) == 0 && selectWordAtCursor(edit) {
+			return "", true
+		}
+		return "", false
+	}
+
+	return getCursorSelection(edit), true
+}
+
+// the starts of every place text is in the edit that no cursor has selected yet
+func findFreeOccurrences(edit *Edit, text string) []int {
+	spans := [][2]int{}
+	for _, cursor := range(getAllCursors(edit)) {
+		start, end := getCursorSpan(edit, cursor)
+		spans = append(spans, [2]int{start, end})
+	}
+
+	whole := edit.buffer.text()
+	found := []int{}
+
+	for from := 0; from <= len(whole); {
+		indx := strings.Index(whole[from:], text)
+		if indx == -1 {
+			break
+		}
+		indx += from
+
+		taken := false
+		for _, span := range(spans) {
+			if indx < span[1] && indx+len(text) > span[0] {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			found = append(found, indx)
+		}
+		from = indx+len(text)
+	}
+
+	return found
+}
+
+func getOccurrenceCursor(edit *Edit, start int, text string) Cursor {
+	sr, sc := edit.buffer.position(start)
+	er, ec := edit.buffer.position(start+len(text))
+	return Cursor{row: er, col: ec, row_anchor: sr, col_anchor: sc, preferencial_col: getTrueCol(ec, er, edit)}
+}
+
+// Ctrl+D: selects the next place the selection is in the text after the
+// primary cursor, going around to the top, with a new cursor
+func addNextOccurrence(edit *Edit) {
+	text, ok := getOccurrenceText(edit)
+	if !ok {
+		failMacro()
+		return
+	}else if text == "" {
+		return // the word was just selected
+	}
+
+	found := findFreeOccurrences(edit, text)
+	if len(found) == 0 {
+		failMacro()
+		return
+	}
+
+	_, end := getCursorSpan(edit, edit.cursor)
+	next := found[0]
+	for _, start := range(found) {
+		if start >= end {
+			next = start
+			break
+		}
+	}
+
+	addCursor(edit, getOccurrenceCursor(edit, next, text))
+}
+
+// Alt+D: a cursor selecting every place the selection is in the text
+func selectAllOccurrences(edit *Edit) {
+	text, ok := getOccurrenceText(edit)
+	if !ok {
+		failMacro()
+		return
+	}else if text == "" { // the word under the cursor, just selected
+		text = getCursorSelection(edit)
+	}
+
+	for _, start := range(findFreeOccurrences(edit, text)) {
+		edit.extra_cursors = append(edit.extra_cursors, getOccurrenceCursor(edit, start, text))
+	}
+	mergeCursors(edit)
+
+	commandMessage(pluralize(len(edit.extra_cursors)+1, "cursor"))
+}
+
+// every row one of the cursors is on or selects, in order
+func getCursorRows(edit *Edit) []int {
+	rows := []int{}
+	for _, cursor := range(getAllCursors(edit)) {
+		for row := min(cursor.row, cursor.row_anchor); row <= max(cursor.row, cursor.row_anchor); row++ {
+			rows = append(rows, row)
+		}
+	}
+
+	slices.Sort(rows)
+	return slices.Compact(rows)
+}
+
+// the text every cursor selects, top to bottom, a line each
+func getCursorsText(edit *Edit) string {
+	type Selected struct {
+		start int
+		text string
+	}
+	selected := []Selected{}
+
+	for _, cursor := range(getAllCursors(edit)) {
+		sr, sc, er, ec := getCursorRange(edit, cursor)
+		selected = append(selected, Selected{edit.buffer.offset(sr, sc), edit.buffer.textRange(sr, sc, er, ec)})
+	}
+	sort.Slice(selected, func(a, b int) bool { return selected[a].start < selected[b].start })
+
+	texts := []string{}
+	for _, part := range(selected) {
+		texts = append(texts, part.text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+// keys that are handled at each cursor rather than once
+func isCursorKey(ev *tcell.EventKey, edit *Edit) bool {
+	if ev.Modifiers()&tcell.ModAlt != 0 {
+		return false
+	}
+
+	switch ev.Key() {
+	case tcell.KeyLeft, tcell.KeyRight, tcell.KeyUp, tcell.KeyDown, tcell.KeyHome, tcell.KeyEnd, tcell.KeyBackspace, tcell.KeyBackspace2, tcell.KeyDelete, tcell.KeyEnter:
+		return true
+	case tcell.KeyTab:
+		return edit.current_mode == "i"
+	case tcell.KeyEscape:
+		return edit.current_mode == "n" && edit.visual_mode != ""
+	case tcell.KeyRune:
+		return edit.current_mode == "i" || edit.pending_command != "" || !strings.ContainsRune(CURSOR_GLOBAL_KEYS, ev.Rune())
+	}
+
+	return false
+}
+
+// handles the key at every cursor when there is more than one, returns false
+// to leave it to editHandleKey
+func multiCursorHandleKey(ev *tcell.EventKey, edit *Edit) bool {
+	if CURSOR_KEY_PASS > 0 || len(edit.extra_cursors) == 0 {
+		return false
+	}
+
+	if ev.Key() == tcell.KeyEscape && isCommandIdle(edit) {
+		clearExtraCursors(edit)
+		hideSuggestions()
+		return true
+	}
+
+	if !isCursorKey(ev, edit) {
+		return false
+	}
+
+	syncUndoCursor(edit)
+	beginChangeKey(edit)
+	hideSuggestions()
+
+	mode, pending, number, visual := edit.current_mode, edit.pending_command, edit.number_string, edit.visual_mode
+
+	forEachCursor(edit, func() {
+		edit.current_mode, edit.pending_command, edit.number_string, edit.visual_mode = mode, pending, number, visual
+		CURSOR_KEY_PASS ++
+		editHandleKey(ev, edit)
+		hideSuggestions() // they are for one cursor, Enter and Tab would take them at the next
+	})
+	CURSOR_KEY_PASS = 0
+
+	showCursor(edit)
+	endChangeKey(ev, edit)
+	readyUndoHistory(edit)
+
+	return true
+}
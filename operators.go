@@ -0,0 +1,686 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Normal mode commands in the vim grammar: [count] operator [count] motion,
+// [count] motion on its own, or an operator typed twice for whole lines (dd,
+// 3yy, >>). The keys of a command still being typed are kept on the Edit in
+// pending_command (the first count stays in number_string like before) and
+// the whole thing is parsed again on every key until it is complete.
+//
+// Operators: d delete, y yank, c change, > indent, < deindent.
+// Motions: h j k l w e b $ 0 ^ gg G f{char} t{char} F{char} T{char} ; ,
+// '{mark} `{mark}
+// Text objects (i{object} and a{object}) are in textobjects.go, marks (m{mark})
+// and the jump and change lists in marks.go.
+
+var OPERATOR_KEYS = "dyc<>"
+var COMMAND_START_KEYS = "dyc<>webWEB$0^GgfFtT;,xXpPDCY\"q@.m'`"
+
+var COMMAND_INCOMPLETE = 0
+var COMMAND_DONE = 1
+var COMMAND_FAILED = 2
+
+var MOTION_EXCLUSIVE = 0 // the range stops just before the target
+var MOTION_INCLUSIVE = 1 // the range takes in the character at the target
+var MOTION_LINEWISE = 2 // the range is every line from the cursor to the target
+
+var LAST_FIND_KEY rune // the f/t/F/T of the last find in the line, for ; and ,
+var LAST_FIND_CHAR rune
+
+type MotionTarget struct {
+	row int
+	col int
+	kind int
+}
+
+// returns true if the key was taken as part of a command
+func normalCommandHandleKey(ev *tcell.EventKey, edit *Edit) bool {
+	if ev.Key() != tcell.KeyRune || ev.Modifiers()&tcell.ModAlt != 0 {
+		if edit.pending_command != "" { // esc, or any other key, gives up on the command
+			edit.pending_command = ""
+			edit.number_string = ""
+			return true
+		}
+		return false
+	}
+
+	key := ev.Rune()
+
+	if edit.pending_command == "" {
+		if key >= '1' && key <= '9' || key == '0' && edit.number_string != "" {
+			return false // counts still go in number_string
+		}
+		if !strings.ContainsRune(COMMAND_START_KEYS, key) && !((hasSelection(edit) || edit.visual_mode != "") && (key == 'i' || key == 'a')) {
+			return false // i and a only start a text object on a selection, otherwise they are insert and append
+		}
+	}
+
+	edit.pending_command += string(key)
+
+	result := runPendingCommand(edit)
+	if result != COMMAND_INCOMPLETE {
+		edit.pending_command = ""
+		edit.number_string = ""
+	}
+	if result == COMMAND_FAILED {
+		failMacro()
+	}
+	CURRENT_REGISTER = 0 // only ever named for the one command
+
+	return true
+}
+
+func getCount(digits string) int {
+	count, err := strconv.Atoi(digits)
+	if err != nil || count <= 0 {
+		return 1
+	}
+	return count
+}
+
+func hasSelection(edit *Edit) bool {
+	return edit.cursor.row != edit.cursor.row_anchor || edit.cursor.col != edit.cursor.col_anchor
+}
+
+func runPendingCommand(edit *Edit) int {
+	command := edit.pending_command
+	count_digits := edit.number_string
+
+	// "{register} in front names the register to yank into or paste from, a count can follow it
+	CURRENT_REGISTER = 0
+	if strings.HasPrefix(command, "\"") {
+		keys := []rune(command)
+		if len(keys) < 2 {
+			return COMMAND_INCOMPLETE
+		}
+		if !isRegisterName(keys[1]) {
+			return COMMAND_FAILED
+		}
+		CURRENT_REGISTER = keys[1]
+		command = string(keys[2:])
+
+		digits := ""
+		for command != "" && unicode.IsDigit(rune(command[0])) && !(command[0] == '0' && digits == "") {
+			digits += command[:1]
+			command = command[1:]
+		}
+		if digits != "" {
+			count_digits = strconv.Itoa(getCount(count_digits)*getCount(digits))
+		}
+
+		if command == "" {
+			return COMMAND_INCOMPLETE
+		}
+	}
+
+	// shorthands for longer commands
+	if edit.visual_mode != "" && len(command) == 1 && strings.ContainsRune("xXDCY", rune(command[0])) {
+		if command != "x" {
+			edit.visual_mode = "V" // the capitals work on the whole lines of the selection
+		}
+		command = map[string]string{"x": "d", "X": "d", "D": "d", "C": "c", "Y": "y"}[command]
+	}else if command == "D" {
+		command = "d$"
+	}else if command == "C" {
+		command = "c$"
+	}else if command == "Y" {
+		command = "yy"
+	}else if command == "x" && !hasSelection(edit) {
+		command = "dl"
+	}else if command == "x" {
+		command = "d"
+	}else if command == "X" {
+		command = "dh"
+	}
+
+	keys := []rune(command)
+	count := getCount(count_digits)
+	has_count := count_digits != ""
+
+	if keys[0] == '.' { // in repeat.go
+		edit.pending_command = ""
+		edit.number_string = ""
+		repeatLastChange(edit, count_digits)
+		return COMMAND_DONE
+	}
+
+	if keys[0] == 'q' && RECORDING_REGISTER != 0 {
+		stopRecording()
+		return COMMAND_DONE
+	}else if keys[0] == 'q' || keys[0] == '@' { // macros, in macros.go
+		if len(keys) < 2 {
+			return COMMAND_INCOMPLETE
+		}
+
+		if keys[0] == 'q' && isMacroRegister(keys[1]) {
+			startRecording(keys[1])
+			return COMMAND_DONE
+		}else if keys[0] == '@' && (isRegisterName(keys[1]) || keys[1] == '@') {
+			edit.pending_command = "" // the keys played start on a clean slate
+			edit.number_string = ""
+			playMacro(keys[1], count)
+			return COMMAND_DONE
+		}
+
+		return COMMAND_FAILED
+	}
+
+	if keys[0] == 'm' {
+		if len(keys) < 2 {
+			return COMMAND_INCOMPLETE
+		}
+		if !setMark(edit, keys[1]) {
+			return COMMAND_FAILED
+		}
+		return COMMAND_DONE
+	}
+
+	if (keys[0] == 'p' || keys[0] == 'P') && edit.visual_mode != "" {
+		pasteOverSelection(edit, count)
+		return COMMAND_DONE
+	}else if keys[0] == 'p' || keys[0] == 'P' {
+		pasteText(edit, keys[0] == 'p', count)
+		return COMMAND_DONE
+	}
+
+	op := rune(0)
+	if strings.ContainsRune(OPERATOR_KEYS, keys[0]) {
+		op = keys[0]
+		keys = keys[1:]
+
+		if len(keys) == 0 && (hasSelection(edit) || edit.visual_mode != "") { // an operator on a selection acts on it straight away
+			applySelectionOperator(edit, op)
+			return COMMAND_DONE
+		}
+	}
+
+	digits := ""
+	for len(keys) > 0 && unicode.IsDigit(keys[0]) && !(keys[0] == '0' && digits == "") {
+		digits += string(keys[0])
+		keys = keys[1:]
+	}
+	if digits != "" {
+		count *= getCount(digits)
+		has_count = true
+	}
+
+	if len(keys) == 0 {
+		return COMMAND_INCOMPLETE
+	}
+
+	if keys[0] == 'i' || keys[0] == 'a' { // text objects, diw, ya(, or iw on a selection
+		if len(keys) < 2 {
+			return COMMAND_INCOMPLETE
+		}
+
+		object, ok := getTextObject(edit, keys[0] == 'a', keys[1], count)
+		if !ok {
+			return COMMAND_FAILED
+		}
+
+		if op == 0 {
+			selectTextObject(edit, object)
+		}else{
+			applyOperator(edit, op, object.sr, object.sc, object.er, object.ec, object.linewise)
+		}
+		return COMMAND_DONE
+	}
+
+	if op != 0 && keys[0] == op { // dd, yy, cc, >>, <<
+		last_row := min(edit.cursor.row+count-1, edit.buffer.lineCount()-1)
+		applyOperator(edit, op, edit.cursor.row, 0, last_row, edit.buffer.lineLen(last_row), true)
+		return COMMAND_DONE
+	}
+
+	motion := keys[0]
+	char := rune(0)
+
+	if strings.ContainsRune("gfFtT'`", motion) {
+		if len(keys) < 2 {
+			return COMMAND_INCOMPLETE
+		}
+		char = keys[1]
+
+		if motion == 'g' && (char == ';' || char == ',') && op == 0 {
+			if !walkChangeList(edit, char == ';', count) {
+				return COMMAND_FAILED
+			}
+			return COMMAND_DONE
+		}
+		if motion == 'g' && char != 'g' {
+			return COMMAND_FAILED
+		}
+	}
+
+	if (motion == '\'' || motion == '`') && op == 0 { // can go to another file, so isn't just a motion
+		edit.pending_command = ""
+		edit.number_string = ""
+		if !jumpToMark(edit, char, motion == '\'') {
+			return COMMAND_FAILED
+		}
+		return COMMAND_DONE
+	}
+
+	if op == 0 && strings.ContainsRune("hjkl", motion) {
+		return COMMAND_FAILED // hjkl on their own are still handled with the other keys
+	}
+
+	target, ok := getMotionTarget(edit, motion, char, count, has_count, op)
+	if !ok {
+		return COMMAND_FAILED
+	}
+
+	if op == 0 {
+		if motion == 'G' || motion == 'g' {
+			recordJump()
+		}
+		moveToTarget(edit, target, motion == 'W' || motion == 'E' || motion == 'B')
+		return COMMAND_DONE
+	}
+
+	sr, sc := edit.cursor.row, edit.cursor.col
+	er, ec := target.row, target.col
+	if er < sr || er == sr && ec < sc {
+		sr, sc, er, ec = er, ec, sr, sc
+	}
+
+	if target.kind == MOTION_INCLUSIVE {
+		ec = nextGrapheme(edit.buffer.line(er), ec)
+	}
+
+	applyOperator(edit, op, sr, sc, er, ec, target.kind == MOTION_LINEWISE)
+	return COMMAND_DONE
+}
+
+func moveToTarget(edit *Edit, target MotionTarget, keepAnchor bool) {
+	edit.cursor.row = target.row
+	edit.cursor.col = target.col
+
+	if !keepAnchor && edit.visual_mode == "" {
+		edit.cursor.row_anchor = target.row
+		edit.cursor.col_anchor = target.col
+	}
+
+	edit.cursor.preferencial_col = getTrueCol(target.col, target.row, edit)
+}
+
+func getSelectionRange(edit *Edit) (int, int, int, int) {
+	return getCursorRange(edit, edit.cursor)
+}
+
+// the selection of any of the edit's cursors, as the visual mode takes it in
+func getCursorRange(edit *Edit, cursor Cursor) (int, int, int, int) {
+	sr, sc := cursor.row_anchor, cursor.col_anchor
+	er, ec := cursor.row, cursor.col
+
+	if er < sr || er == sr && ec < sc {
+		sr, sc, er, ec = er, ec, sr, sc
+	}
+
+	if edit.visual_mode == "V" {
+		return sr, 0, er, edit.buffer.lineLen(er)
+	}else if edit.visual_mode != "" { // visual selections take in the character under the cursor
+		if ec < edit.buffer.lineLen(er) {
+			ec = nextGrapheme(edit.buffer.line(er), ec)
+		}else if er < edit.buffer.lineCount()-1 {
+			er, ec = er+1, 0
+		}
+	}
+
+	return sr, sc, er, ec
+}
+
+func getFirstNonBlank(edit *Edit, row int) int {
+	line := edit.buffer.line(row)
+	return len(line)-len(strings.TrimLeft(line, WHITESPACE))
+}
+
+// the class of the character at a position, with the end of a line counting as whitespace
+func getCharTypeAt(edit *Edit, row, col int) int {
+	line := edit.buffer.line(row)
+	if col >= len(line) {
+		return WHITESPACE_CHAR_TYPE
+	}
+	return getCharType(firstRune(line[col:]))
+}
+
+// steps one character forward through the whole text, the end of a line is a
+// position of its own (the newline). Returns false at the end of the text.
+func nextTextPos(edit *Edit, row, col int) (int, int, bool) {
+	line := edit.buffer.line(row)
+
+	if col < len(line) {
+		return row, nextGrapheme(line, col), true
+	}
+	if row < edit.buffer.lineCount()-1 {
+		return row+1, 0, true
+	}
+	return row, col, false
+}
+
+func prevTextPos(edit *Edit, row, col int) (int, int, bool) {
+	if col > 0 {
+		return row, prevGrapheme(edit.buffer.line(row), col), true
+	}
+	if row > 0 {
+		return row-1, edit.buffer.lineLen(row-1), true
+	}
+	return row, col, false
+}
+
+func isEmptyLineAt(edit *Edit, row, col int) bool {
+	return col == 0 && edit.buffer.lineLen(row) == 0
+}
+
+// vim's w: to the start of the next word, an empty line counts as a word
+func nextWordStart(edit *Edit, row, col int) (int, int) {
+	start_row := row
+	typ := getCharTypeAt(edit, row, col)
+	ok := true
+
+	if typ != WHITESPACE_CHAR_TYPE {
+		for ok && getCharTypeAt(edit, row, col) == typ {
+			row, col, ok = nextTextPos(edit, row, col)
+		}
+	}
+
+	for ok && getCharTypeAt(edit, row, col) == WHITESPACE_CHAR_TYPE {
+		if row != start_row && isEmptyLineAt(edit, row, col) {
+			break
+		}
+		row, col, ok = nextTextPos(edit, row, col)
+	}
+
+	if !ok { // ran off the end of the text
+		row = edit.buffer.lineCount()-1
+		col = edit.buffer.lineLen(row)
+	}
+
+	return row, col
+}
+
+// vim's e: to the last character of the current or next word
+func nextWordEnd(edit *Edit, row, col int) (int, int) {
+	row, col, ok := nextTextPos(edit, row, col)
+
+	for ok && getCharTypeAt(edit, row, col) == WHITESPACE_CHAR_TYPE {
+		row, col, ok = nextTextPos(edit, row, col)
+	}
+
+	typ := getCharTypeAt(edit, row, col)
+	for ok {
+		next_row, next_col, next_ok := nextTextPos(edit, row, col)
+		if !next_ok || next_row != row || getCharTypeAt(edit, next_row, next_col) != typ {
+			break
+		}
+		row, col = next_row, next_col
+	}
+
+	return row, col
+}
+
+// vim's b: to the start of the current or previous word
+func prevWordStart(edit *Edit, row, col int) (int, int) {
+	row, col, ok := prevTextPos(edit, row, col)
+
+	for ok && getCharTypeAt(edit, row, col) == WHITESPACE_CHAR_TYPE && !isEmptyLineAt(edit, row, col) {
+		row, col, ok = prevTextPos(edit, row, col)
+	}
+
+	typ := getCharTypeAt(edit, row, col)
+	for col > 0 {
+		prev := prevGrapheme(edit.buffer.line(row), col)
+		if getCharTypeAt(edit, row, prev) != typ {
+			break
+		}
+		col = prev
+	}
+
+	return row, col
+}
+
+// the count-th char in the line for f/t (forwards) or F/T (backwards)
+func findInLine(edit *Edit, key, char rune, count int) (int, bool) {
+	line := edit.buffer.line(edit.cursor.row)
+	col := edit.cursor.col
+	target := string(char)
+
+	for range(count) {
+		if key == 'f' || key == 't' {
+			start := nextGrapheme(line, col)
+			if key == 't' { // t stops before the char, so the one right next to the cursor doesn't count
+				start = nextGrapheme(line, start)
+			}
+
+			found := strings.Index(line[start:], target)
+			if found == -1 {
+				return 0, false
+			}
+
+			col = start+found
+			if key == 't' {
+				col = prevGrapheme(line, col)
+			}
+		}else{
+			end := col
+			if key == 'T' {
+				end = prevGrapheme(line, end)
+			}
+
+			found := strings.LastIndex(line[:end], target)
+			if found == -1 {
+				return 0, false
+			}
+
+			col = found
+			if key == 'T' {
+				col = nextGrapheme(line, col)
+			}
+		}
+	}
+
+	return col, true
+}
+
+func getMotionTarget(edit *Edit, motion, char rune, count int, has_count bool, op rune) (MotionTarget, bool) {
+	row, col := edit.cursor.row, edit.cursor.col
+	line_count := edit.buffer.lineCount()
+
+	if motion == ';' || motion == ',' {
+		if LAST_FIND_KEY == 0 {
+			return MotionTarget{}, false
+		}
+
+		reverse := motion == ','
+		motion, char = LAST_FIND_KEY, LAST_FIND_CHAR
+		if reverse {
+			motion = map[rune]rune{'f': 'F', 'F': 'f', 't': 'T', 'T': 't'}[motion]
+		}
+	}else if strings.ContainsRune("fFtT", motion) {
+		LAST_FIND_KEY, LAST_FIND_CHAR = motion, char
+	}
+
+	switch motion {
+	case 'h':
+		for range(count) {
+			col = prevGrapheme(edit.buffer.line(row), col)
+		}
+		return MotionTarget{row, col, MOTION_EXCLUSIVE}, true
+	case 'l':
+		for range(count) {
+			col = nextGrapheme(edit.buffer.line(row), col)
+		}
+		return MotionTarget{row, col, MOTION_EXCLUSIVE}, true
+	case 'j':
+		row = min(row+count, line_count-1)
+		return MotionTarget{row, getFalseCol(edit.cursor.preferencial_col, row, edit), MOTION_LINEWISE}, true
+	case 'k':
+		row = max(row-count, 0)
+		return MotionTarget{row, getFalseCol(edit.cursor.preferencial_col, row, edit), MOTION_LINEWISE}, true
+	case 'w', 'W':
+		if op == 'c' && getCharTypeAt(edit, row, col) != WHITESPACE_CHAR_TYPE { // cw changes to the end of the word, like ce
+			return getMotionTarget(edit, 'e', char, count, has_count, op)
+		}
+
+		for indx := range(count) {
+			next_row, next_col := nextWordStart(edit, row, col)
+
+			// an operator doesn't take the line break after the last word with it
+			if op != 0 && indx == count-1 && next_row > row {
+				next_row, next_col = row, edit.buffer.lineLen(row)
+			}
+			row, col = next_row, next_col
+		}
+		return MotionTarget{row, col, MOTION_EXCLUSIVE}, true
+	case 'e', 'E':
+		for range(count) {
+			row, col = nextWordEnd(edit, row, col)
+		}
+		return MotionTarget{row, col, MOTION_INCLUSIVE}, true
+	case 'b', 'B':
+		for range(count) {
+			row, col = prevWordStart(edit, row, col)
+		}
+		return MotionTarget{row, col, MOTION_EXCLUSIVE}, true
+	case '$':
+		row = min(row+count-1, line_count-1)
+		return MotionTarget{row, edit.buffer.lineLen(row), MOTION_EXCLUSIVE}, true
+	case '0':
+		return MotionTarget{row, 0, MOTION_EXCLUSIVE}, true
+	case '^':
+		return MotionTarget{row, getFirstNonBlank(edit, row), MOTION_EXCLUSIVE}, true
+	case 'G', 'g':
+		row = line_count-1
+		if motion == 'g' {
+			row = 0
+		}
+		if has_count {
+			row = min(count, line_count)-1
+		}
+		return MotionTarget{row, getFirstNonBlank(edit, row), MOTION_LINEWISE}, true
+	case '\'', '`':
+		mark_row, mark_col, ok := getMarkPosition(edit, char)
+		if !ok {
+			return MotionTarget{}, false
+		}
+		if motion == '\'' {
+			return MotionTarget{mark_row, getFirstNonBlank(edit, mark_row), MOTION_LINEWISE}, true
+		}
+		return MotionTarget{mark_row, mark_col, MOTION_EXCLUSIVE}, true
+	case 'f', 't', 'F', 'T':
+		col, ok := findInLine(edit, motion, char, count)
+		if !ok {
+			return MotionTarget{}, false
+		}
+
+		kind := MOTION_EXCLUSIVE
+		if motion == 'f' || motion == 't' {
+			kind = MOTION_INCLUSIVE
+		}
+		return MotionTarget{row, col, kind}, true
+	}
+
+	return MotionTarget{}, false
+}
+
+// runs op over the text from (sr, sc) up to (er, ec), or over rows sr to er when linewise
+func applyOperator(edit *Edit, op rune, sr, sc, er, ec int, linewise bool) {
+	if op == '>' || op == '<' {
+		edit.cursor = Cursor{row: sr, col: 0, row_anchor: er, col_anchor: 0}
+		if op == '>' {
+			indent(edit)
+		}else{
+			deindent(edit)
+		}
+
+		col := getFirstNonBlank(edit, sr)
+		moveToTarget(edit, MotionTarget{sr, col, MOTION_EXCLUSIVE}, false)
+		return
+	}
+
+	if linewise {
+		storeRegister(Register{text: edit.buffer.textRange(sr, 0, er, edit.buffer.lineLen(er))+"\n", linewise: true}, op)
+	}else{
+		storeRegister(Register{text: edit.buffer.textRange(sr, sc, er, ec)}, op)
+	}
+
+	if op == 'y' {
+		if linewise {
+			moveToTarget(edit, MotionTarget{sr, min(edit.cursor.col, edit.buffer.lineLen(sr)), MOTION_EXCLUSIVE}, false)
+		}else{
+			moveToTarget(edit, MotionTarget{sr, sc, MOTION_EXCLUSIVE}, false)
+		}
+		return
+	}
+
+	if !linewise {
+		edit.buffer.remove(sr, sc, er, ec)
+		moveToTarget(edit, MotionTarget{sr, sc, MOTION_EXCLUSIVE}, false)
+	}else if op == 'c' {
+		indentation := edit.buffer.line(sr)[:getFirstNonBlank(edit, sr)]
+		edit.buffer.remove(sr, 0, er, edit.buffer.lineLen(er))
+		end_row, end_col := edit.buffer.insert(sr, 0, indentation)
+		moveToTarget(edit, MotionTarget{end_row, end_col, MOTION_EXCLUSIVE}, false)
+	}else{
+		if er < edit.buffer.lineCount()-1 {
+			edit.buffer.remove(sr, 0, er+1, 0)
+		}else if sr > 0 {
+			edit.buffer.remove(sr-1, edit.buffer.lineLen(sr-1), er, edit.buffer.lineLen(er))
+			sr --
+		}else{
+			edit.buffer.remove(sr, 0, er, edit.buffer.lineLen(er))
+		}
+
+		moveToTarget(edit, MotionTarget{sr, getFirstNonBlank(edit, sr), MOTION_EXCLUSIVE}, false)
+	}
+
+	if op == 'c' {
+		edit.current_mode = "i"
+		drawTitleBar()
+	}
+}
+
+// p puts the register after the cursor (below the line for whole lines), P before it
+func pasteText(edit *Edit, after bool, count int) {
+	reg := readRegister(CURRENT_REGISTER)
+	text := reg.text
+	if text == "" {
+		return
+	}
+
+	if reg.blockwise {
+		pasteBlock(edit, text, after, count)
+		return
+	}
+
+	if reg.linewise {
+		lines := strings.Repeat(text, count)
+		row := edit.cursor.row
+
+		if after {
+			edit.buffer.insert(row, edit.buffer.lineLen(row), "\n"+strings.TrimSuffix(lines, "\n"))
+			row ++
+		}else{
+			edit.buffer.insert(row, 0, lines)
+		}
+
+		moveToTarget(edit, MotionTarget{row, getFirstNonBlank(edit, row), MOTION_EXCLUSIVE}, false)
+		return
+	}
+
+	if hasSelection(edit) {
+		deleteText(BACKSPACE, 1, edit)
+	}else if after {
+		edit.cursor.col = nextGrapheme(edit.buffer.line(edit.cursor.row), edit.cursor.col)
+		edit.cursor.col_anchor = edit.cursor.col
+	}
+
+	insertText(edit, strings.Repeat(text, count))
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// The screen can be split into panes, side by side or stacked, as a tree of
+// splits with a pane on every leaf. Each pane keeps its own cursor and scroll
+// over one of the OPEN_FILES, and several panes may show the same file. The
+// focused pane is the one typed into: its file is the current one and its
+// view lives in MAIN_TEXTEDIT, so only the other panes keep their view here.
+
+type Pane struct {
+	file *OpenFile
+	cursor Cursor
+	toprow int
+	leftchar int
+
+	top int // first row of the pane, its header when there are several panes
+	row int
+	col int
+	width int
+	height int
+}
+
+type PaneNode struct {
+	pane *Pane // set on leaves only
+
+	side_by_side bool // first left of second, otherwise first above second
+	ratio float64 // share of the space that goes to first
+	space int // rows or columns split between the two on the last layout
+	first *PaneNode
+	second *PaneNode
+	parent *PaneNode
+}
+
+var ROOT_PANE *PaneNode
+var FOCUSED_PANE *Pane
+var WAITING_FOR_PANE_KEY bool // Ctrl+W was pressed, the next key is a pane command
+
+func setupPanes() {
+	FOCUSED_PANE = &Pane{}
+	ROOT_PANE = &PaneNode{pane: FOCUSED_PANE}
+}
+
+func getPanes(node *PaneNode) []*Pane {
+	if node.pane != nil {
+		return []*Pane{node.pane}
+	}
+
+	return append(getPanes(node.first), getPanes(node.second)...)
+}
+
+func findPaneNode(node *PaneNode, pane *Pane) *PaneNode {
+	if node.pane != nil {
+		if node.pane == pane {
+			return node
+		}
+		return nil
+	}
+
+	if found := findPaneNode(node.first, pane); found != nil {
+		return found
+	}
+
+	return findPaneNode(node.second, pane)
+}
+
+func layoutPanes(node *PaneNode, row, col, width, height int) {
+	if node.pane != nil {
+		pane := node.pane
+		pane.top = row
+		pane.row = row
+		pane.col = col
+		pane.width = max(width, 1)
+		pane.height = height
+
+		if ROOT_PANE.pane == nil { // room for a header saying which file it is
+			pane.row ++
+			pane.height --
+		}
+		pane.height = max(pane.height, 1)
+
+		return
+	}
+
+	if node.side_by_side {
+		node.space = width-1 // one column for the separator
+	}else{
+		node.space = height
+	}
+
+	first := int(float64(node.space)*node.ratio+0.5)
+	first = max(min(first, node.space-2), min(2, node.space/2))
+
+	if node.side_by_side {
+		layoutPanes(node.first, row, col, first, height)
+		layoutPanes(node.second, row, col+first+1, width-first-1, height)
+	}else{
+		layoutPanes(node.first, row, col, width, first)
+		layoutPanes(node.second, row+first, col, width, height-first)
+	}
+}
+
+// lays the panes out over the screen below the title bar, leaving room for the explorer and the find panel
+func relayoutPanes() {
+	width, height := s.Size()
+
+	if SHOWING_FIND {
+		height = max(height-6, 1)
+	}else{
+		height = height-1
+	}
+
+	col := 0
+	if SHOWING_EXPLORER {
+		col = EXPLORER_TEXTEDIT.width+1 // and a column for the line between
+	}
+
+	layoutPanes(ROOT_PANE, 1, col, width-col, height)
+	fitFocusedPane()
+}
+
+// gives MAIN_TEXTEDIT the place of the focused pane on screen
+func fitFocusedPane() {
+	if FOCUSED_PANE == nil || FOCUSED_PANE.width == 0 {
+		return
+	}
+
+	MAIN_TEXTEDIT.row = FOCUSED_PANE.row
+	MAIN_TEXTEDIT.col = FOCUSED_PANE.col
+	MAIN_TEXTEDIT.width = FOCUSED_PANE.width
+	MAIN_TEXTEDIT.height = FOCUSED_PANE.height
+}
+
+func storePaneView(pane *Pane, edit *Edit) {
+	pane.cursor = edit.cursor
+	pane.toprow = edit.toprow
+	pane.leftchar = edit.leftchar
+}
+
+// puts the pane's view onto the edit, kept inside the text in case it was
+// changed from another pane since
+func loadPaneView(pane *Pane, edit *Edit) {
+	last_row := edit.buffer.lineCount()-1
+
+	cursor := pane.cursor
+	cursor.row = min(cursor.row, last_row)
+	cursor.col = snapToGrapheme(edit.buffer.line(cursor.row), cursor.col)
+	cursor.row_anchor = min(cursor.row_anchor, last_row)
+	cursor.col_anchor = snapToGrapheme(edit.buffer.line(cursor.row_anchor), cursor.col_anchor)
+
+	edit.cursor = cursor
+	edit.toprow = min(pane.toprow, last_row)
+	edit.leftchar = pane.leftchar
+}
+
+// the Edit holding the text of a pane that isn't focused
+func getPaneEdit(pane *Pane) *Edit {
+	if CURRENT_FILE >= 0 && pane.file == OPEN_FILES[CURRENT_FILE] {
+		return &MAIN_TEXTEDIT
+	}
+
+	return &pane.file.edit
+}
+
+func drawPanes() {
+	for _, pane := range(getPanes(ROOT_PANE)) {
+		if ROOT_PANE.pane == nil {
+			drawPaneHeader(pane)
+		}
+
+		if pane == FOCUSED_PANE {
+			drawEdit(&MAIN_TEXTEDIT, CURRENT_TEXT_EDIT == "main")
+			continue
+		}
+		if pane.file == nil {
+			continue
+		}
+
+		edit := getPaneEdit(pane)
+		saved := *edit
+
+		loadPaneView(pane, edit)
+		edit.row, edit.col, edit.width, edit.height = pane.row, pane.col, pane.width, pane.height
+		edit.is_main = false
+
+		drawEdit(edit, false)
+
+		// keep the highlighting worked out while drawing, the rest goes back
+		lines := edit.lines
+		*edit = saved
+		edit.lines = lines
+	}
+
+	drawPaneSeparators(ROOT_PANE)
+}
+
+func drawPaneHeader(pane *Pane) {
+	style := TITLE_STYLE
+	if pane == FOCUSED_PANE {
+		style = HIGHLIGHT_STYLE
+	}
+
+	text := title
+	if pane != FOCUSED_PANE && pane.file != nil {
+		text = pane.file.title
+	}
+
+	text = runewidth.FillRight(runewidth.Truncate(" "+text, pane.width, ""), pane.width)
+
+	emitStr(pane.col, pane.top, style, text)
+}
+
+func drawPaneSeparators(node *PaneNode) {
+	if node.pane != nil {
+		return
+	}
+
+	if node.side_by_side {
+		left := getPanes(node.first)[0]
+		x := left.col
+		for _, pane := range(getPanes(node.first)) {
+			x = max(x, pane.col+pane.width)
+		}
+
+		top := left.top
+		bottom := top
+		for _, pane := range(getPanes(node)) {
+			top = min(top, pane.top)
+			bottom = max(bottom, pane.row+pane.height)
+		}
+
+		for y := top; y < bottom; y++ {
+			emitStr(x, y, LINE_NUMBER_STYLE, "│")
+		}
+	}
+
+	drawPaneSeparators(node.first)
+	drawPaneSeparators(node.second)
+}
+
+// moves the typing to another pane, storing the view of the one left
+func focusPane(pane *Pane) {
+	if pane == FOCUSED_PANE || pane.file == nil {
+		return
+	}
+
+	closeUndoGroup(&MAIN_TEXTEDIT)
+	if CURRENT_FILE >= 0 {
+		storePaneView(FOCUSED_PANE, &MAIN_TEXTEDIT)
+		FOCUSED_PANE.file = OPEN_FILES[CURRENT_FILE]
+	}
+	storeCurrentFile()
+
+	FOCUSED_PANE = pane
+
+	for indx, file := range(OPEN_FILES) {
+		if file == pane.file {
+			loadOpenFile(indx)
+			break
+		}
+	}
+
+	loadPaneView(pane, &MAIN_TEXTEDIT)
+	fitFocusedPane()
+	syncUndoCursor(&MAIN_TEXTEDIT)
+
+	redrawFullScreen()
+}
+
+func splitPane(side_by_side bool) {
+	if CURRENT_FILE < 0 {
+		return
+	}
+
+	storeCurrentFile()
+	storePaneView(FOCUSED_PANE, &MAIN_TEXTEDIT)
+	FOCUSED_PANE.file = OPEN_FILES[CURRENT_FILE]
+
+	node := findPaneNode(ROOT_PANE, FOCUSED_PANE)
+	new_pane := *FOCUSED_PANE
+
+	node.first = &PaneNode{pane: FOCUSED_PANE, parent: node}
+	node.second = &PaneNode{pane: &new_pane, parent: node}
+	node.pane = nil
+	node.side_by_side = side_by_side
+	node.ratio = 0.5
+
+	FOCUSED_PANE = &new_pane
+
+	relayoutPanes()
+	showCursor(&MAIN_TEXTEDIT)
+	redrawFullScreen()
+}
+
+func removePane(pane *Pane) {
+	node := findPaneNode(ROOT_PANE, pane)
+	if node == nil || node.parent == nil {
+		return
+	}
+
+	parent := node.parent
+	sibling := parent.first
+	if sibling == node {
+		sibling = parent.second
+	}
+
+	// the sibling takes the place of the split
+	parent.pane = sibling.pane
+	parent.side_by_side = sibling.side_by_side
+	parent.ratio = sibling.ratio
+	parent.first = sibling.first
+	parent.second = sibling.second
+
+	if parent.first != nil {
+		parent.first.parent = parent
+		parent.second.parent = parent
+	}
+}
+
+func closePane() {
+	if ROOT_PANE.pane != nil {
+		return
+	}
+
+	closing := FOCUSED_PANE
+	next := getNeighbourPane(closing)
+
+	storeCurrentFile()
+	focusPane(next)
+	removePane(closing)
+
+	relayoutPanes()
+	showCursor(&MAIN_TEXTEDIT)
+	redrawFullScreen()
+}
+
+// the pane focus goes to when this one is closed: the closest one in the split
+func getNeighbourPane(pane *Pane) *Pane {
+	node := findPaneNode(ROOT_PANE, pane)
+	parent := node.parent
+
+	if parent.first == node {
+		return getPanes(parent.second)[0]
+	}
+
+	panes := getPanes(parent.first)
+	return panes[len(panes)-1]
+}
+
+// called once a file is closed, panes other than the focused one can't show it anymore
+func closePanesShowing(file *OpenFile) {
+	for _, pane := range(getPanes(ROOT_PANE)) {
+		if pane != FOCUSED_PANE && pane.file == file {
+			removePane(pane)
+		}
+	}
+}
+
+func isFileInOtherPane(file *OpenFile) bool {
+	for _, pane := range(getPanes(ROOT_PANE)) {
+		if pane != FOCUSED_PANE && pane.file == file {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getPaneAt(x, y int) *Pane {
+	for _, pane := range(getPanes(ROOT_PANE)) {
+		if x >= pane.col && x < pane.col+pane.width && y >= pane.top && y < pane.row+pane.height {
+			return pane
+		}
+	}
+
+	return nil
+}
+
+func movePaneFocus(dx, dy int) {
+	pane := FOCUSED_PANE
+
+	// aim at the row or column of the cursor just past the edge of this pane
+	x := max(min(CUR_CURS_X, pane.col+pane.width-1), pane.col)
+	y := max(min(CUR_CURS_Y, pane.row+pane.height-1), pane.row)
+
+	if dx < 0 {
+		x = pane.col-2
+	}else if dx > 0 {
+		x = pane.col+pane.width+1
+	}else if dy < 0 {
+		y = pane.top-1
+	}else if dy > 0 {
+		y = pane.row+pane.height
+	}
+
+	if next := getPaneAt(x, y); next != nil {
+		focusPane(next)
+	}
+}
+
+func cyclePaneFocus() {
+	panes := getPanes(ROOT_PANE)
+
+	for indx, pane := range(panes) {
+		if pane == FOCUSED_PANE {
+			focusPane(panes[(indx+1) % len(panes)])
+			return
+		}
+	}
+}
+
+// grows the focused pane by amount rows (or columns when side_by_side)
+func resizePane(side_by_side bool, amount int) {
+	node := findPaneNode(ROOT_PANE, FOCUSED_PANE)
+
+	for node.parent != nil {
+		parent := node.parent
+
+		if parent.side_by_side == side_by_side && parent.space > 0 {
+			if parent.second == node {
+				amount = -amount
+			}
+
+			first := int(float64(parent.space)*parent.ratio+0.5)+amount
+			first = max(min(first, parent.space-2), 2)
+			parent.ratio = float64(first)/float64(parent.space)
+
+			relayoutPanes()
+			showCursor(&MAIN_TEXTEDIT)
+			redrawFullScreen()
+			return
+		}
+
+		node = parent
+	}
+}
+
+func equalizePanes(node *PaneNode) {
+	if node.pane != nil {
+		return
+	}
+
+	// panes split the same way share the space evenly between them
+	first := countPanesAlong(node.first, node.side_by_side)
+	second := countPanesAlong(node.second, node.side_by_side)
+	node.ratio = float64(first)/float64(first+second)
+
+	equalizePanes(node.first)
+	equalizePanes(node.second)
+}
+
+func countPanesAlong(node *PaneNode, side_by_side bool) int {
+	if node.pane != nil || node.side_by_side != side_by_side {
+		return 1
+	}
+
+	return countPanesAlong(node.first, side_by_side)+countPanesAlong(node.second, side_by_side)
+}
+
+// Ctrl+W followed by a pane command, returns true if the key was used
+func paneHandleKey(ev *tcell.EventKey) bool {
+	if !WAITING_FOR_PANE_KEY {
+		if ev.Key() == tcell.KeyCtrlW {
+			WAITING_FOR_PANE_KEY = true
+			return true
+		}
+		return false
+	}
+
+	WAITING_FOR_PANE_KEY = false
+	rune := ev.Rune()
+
+	if rune == 'v' || rune == '|' {
+		splitPane(true)
+	}else if rune == 's' {
+		splitPane(false)
+	}else if rune == 'q' || rune == 'c' {
+		closePane()
+	}else if rune == 'h' || ev.Key() == tcell.KeyLeft {
+		movePaneFocus(-1, 0)
+	}else if rune == 'l' || ev.Key() == tcell.KeyRight {
+		movePaneFocus(1, 0)
+	}else if rune == 'k' || ev.Key() == tcell.KeyUp {
+		movePaneFocus(0, -1)
+	}else if rune == 'j' || ev.Key() == tcell.KeyDown {
+		movePaneFocus(0, 1)
+	}else if rune == 'w' || ev.Key() == tcell.KeyCtrlW {
+		cyclePaneFocus()
+	}else if rune == '+' {
+		resizePane(false, 1)
+	}else if rune == '-' {
+		resizePane(false, -1)
+	}else if rune == '>' {
+		resizePane(true, 1)
+	}else if rune == '<' {
+		resizePane(true, -1)
+	}else if rune == '=' {
+		equalizePanes(ROOT_PANE)
+		redrawFullScreen()
+	}
+
+	return true
+}
+
+// scrolls a pane that isn't focused from the mouse wheel, returns false for the focused one
+func scrollPaneAt(x, y, amount int) bool {
+	pane := getPaneAt(x, y)
+	if pane == nil || pane == FOCUSED_PANE || pane.file == nil {
+		return false
+	}
+
+	edit := getPaneEdit(pane)
+	pane.toprow = max(min(pane.toprow+amount, edit.buffer.lineCount()-pane.height), 0)
+
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// The picker is the list panel shown on the right of the screen for choosing
+// one row out of many (open files, undo states...). Whoever opens it hands in
+// the rows and what to do when a row is highlighted, chosen or given up on.
+
+var PICKER_TEXTEDIT Edit
+var SHOWING_PICKER bool
+var PICKER_LABEL string
+var PICKER_ROWS int
+
+var PICKER_CHOOSE_CALLBACK func(indx int) = nil
+var PICKER_MOVE_CALLBACK func(indx int) = nil
+var PICKER_CANCEL_CALLBACK func() = nil
+var PICKER_KEY_CALLBACK func(ev *tcell.EventKey, indx int) bool = nil // extra keys, returns true if it used the key
+
+func showPicker(label string, rows []string, selected int) {
+	PICKER_LABEL = label
+	PICKER_CHOOSE_CALLBACK = nil
+	PICKER_MOVE_CALLBACK = nil
+	PICKER_CANCEL_CALLBACK = nil
+	PICKER_KEY_CALLBACK = nil
+
+	SHOWING_PICKER = true
+	CURRENT_TEXT_EDIT = "picker"
+
+	setPickerRows(rows, selected)
+	redrawFullScreen()
+}
+
+func setPickerRows(rows []string, selected int) {
+	PICKER_ROWS = len(rows)
+	setEditText(&PICKER_TEXTEDIT, strings.Join(rows, "\n"))
+	selectPickerRow(selected)
+}
+
+func getPickerRow() int {
+	return PICKER_TEXTEDIT.cursor.row
+}
+
+func selectPickerRow(row int) {
+	selectListRow(&PICKER_TEXTEDIT, row)
+}
+
+// selects the whole of one row of an edit used as a list
+func selectListRow(edit *Edit, row int) {
+	row = max(0, min(row, edit.buffer.lineCount()-1))
+
+	edit.cursor.row = row
+	edit.cursor.col = 0
+	edit.cursor.row_anchor = row
+	edit.cursor.col_anchor = edit.buffer.lineLen(row)
+	showCursor(edit)
+}
+
+func closePicker() {
+	SHOWING_PICKER = false
+	CURRENT_TEXT_EDIT = "main"
+	redrawFullScreen()
+}
+
+func pickerHandleKey(ev *tcell.EventKey) {
+	rune := unicode.ToLower(ev.Rune())
+	row := getPickerRow()
+
+	if PICKER_KEY_CALLBACK != nil && PICKER_ROWS > 0 && PICKER_KEY_CALLBACK(ev, row) {
+		return
+	}
+
+	if ev.Key() == tcell.KeyEscape {
+		closePicker()
+		if PICKER_CANCEL_CALLBACK != nil {
+			PICKER_CANCEL_CALLBACK()
+		}
+		return
+	}else if ev.Key() == tcell.KeyEnter {
+		closePicker()
+		if PICKER_CHOOSE_CALLBACK != nil && PICKER_ROWS > 0 {
+			PICKER_CHOOSE_CALLBACK(row)
+		}
+		return
+	}else if ev.Key() == tcell.KeyDown || rune == 'j' {
+		row ++
+	}else if ev.Key() == tcell.KeyUp || rune == 'k' {
+		row --
+	}else if ev.Key() == tcell.KeyPgDn {
+		row += PICKER_TEXTEDIT.height
+	}else if ev.Key() == tcell.KeyPgUp {
+		row -= PICKER_TEXTEDIT.height
+	}else if ev.Key() == tcell.KeyHome || rune == 'g' {
+		row = 0
+	}else if ev.Key() == tcell.KeyEnd {
+		row = PICKER_ROWS-1
+	}else{
+		return
+	}
+
+	selectPickerRow(row)
+
+	if PICKER_MOVE_CALLBACK != nil && PICKER_ROWS > 0 {
+		PICKER_MOVE_CALLBACK(getPickerRow())
+	}
+}
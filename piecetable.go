@@ -0,0 +1,358 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// The text of an Edit is stored in a piece table. The original file text is
+// never modified, anything typed is appended to the add buffer, and the
+// document is the concatenation of the pieces (spans into either of them).
+// Edits only touch the pieces around the edit point, so typing costs the same
+// in a 10 line file as in a 10 million line one.
+
+type Piece struct {
+	added bool
+	start int
+	length int
+	newlines int
+}
+
+type TextBuffer struct {
+	original string
+	add []byte
+
+	original_newlines []int // byte offsets of every '\n' in original
+	add_newlines []int // byte offsets of every '\n' in add
+
+	pieces []Piece
+	length int
+	line_count int
+
+	first_changed int // lowest row modified since the styles were last updated
+	journal []EditOp // every change since the undo history last collected them
+
+	marks map[rune]int // byte offsets of the marks in the text, in marks.go
+	changes []int // byte offsets of the last changes, oldest first
+	change_indx int // where g; and g, are in changes
+
+	cursor_offsets []int // of every cursor and its anchor while a key is handled at each, in multicursor.go
+	cursors_done int // the cursor_offsets before this one are of cursors that have had the key
+
+	version int // goes up with every change, so a search of the text knows when it is out of date
+}
+
+type EditOp struct {
+	insert bool
+	offset int
+	text string
+}
+
+func newTextBuffer(text string) *TextBuffer {
+	buf := TextBuffer{original: text, add: []byte{}, original_newlines: findNewlines(text, 0), add_newlines: []int{}, marks: map[rune]int{}}
+
+	if len(text) > 0 {
+		buf.pieces = []Piece{{added: false, start: 0, length: len(text), newlines: len(buf.original_newlines)}}
+	}
+
+	buf.length = len(text)
+	buf.line_count = len(buf.original_newlines)+1
+
+	return &buf
+}
+
+func findNewlines(text string, base int) []int {
+	out := []int{}
+
+	for indx := range(len(text)) {
+		if text[indx] == '\n' {
+			out = append(out, base+indx)
+		}
+	}
+
+	return out
+}
+
+func (b *TextBuffer) newlinesOf(p Piece) []int {
+	if p.added {
+		return b.add_newlines
+	}
+	return b.original_newlines
+}
+
+// counts the newlines in [start, end) of the piece's underlying buffer
+func (b *TextBuffer) countNewlines(added bool, start, end int) int {
+	nls := b.original_newlines
+	if added {
+		nls = b.add_newlines
+	}
+
+	return sort.SearchInts(nls, end) - sort.SearchInts(nls, start)
+}
+
+func (b *TextBuffer) markChanged(row int) {
+	if row < b.first_changed {
+		b.first_changed = row
+	}
+}
+
+func (b *TextBuffer) lineCount() int {
+	return b.line_count
+}
+
+func (b *TextBuffer) textLength() int {
+	return b.length
+}
+
+// byte offset in the document of the first character of row
+func (b *TextBuffer) lineStart(row int) int {
+	if row <= 0 {
+		return 0
+	}
+	if row >= b.line_count {
+		return b.length
+	}
+
+	seen := 0
+	pos := 0
+
+	for _, p := range(b.pieces) {
+		if seen+p.newlines >= row {
+			nls := b.newlinesOf(p)
+			first := sort.SearchInts(nls, p.start)
+			nl := nls[first+row-seen-1]
+
+			return pos + nl - p.start + 1
+		}
+
+		seen += p.newlines
+		pos += p.length
+	}
+
+	return b.length
+}
+
+func (b *TextBuffer) lineEnd(row int) int {
+	if row >= b.line_count-1 {
+		return b.length
+	}
+
+	return b.lineStart(row+1)-1
+}
+
+func (b *TextBuffer) lineLen(row int) int {
+	return b.lineEnd(row) - b.lineStart(row)
+}
+
+func (b *TextBuffer) line(row int) string {
+	if row < 0 || row >= b.line_count {
+		return ""
+	}
+
+	return b.slice(b.lineStart(row), b.lineEnd(row))
+}
+
+func (b *TextBuffer) offset(row, col int) int {
+	return b.lineStart(row)+col
+}
+
+func (b *TextBuffer) position(offset int) (int, int) {
+	if offset <= 0 {
+		return 0, 0
+	}
+	if offset > b.length {
+		offset = b.length
+	}
+
+	row := 0
+	pos := 0
+
+	for _, p := range(b.pieces) {
+		if pos+p.length >= offset {
+			row += b.countNewlines(p.added, p.start, p.start+offset-pos)
+			break
+		}
+
+		row += p.newlines
+		pos += p.length
+	}
+
+	return row, offset - b.lineStart(row)
+}
+
+// returns the document text in [start, end)
+func (b *TextBuffer) slice(start, end int) string {
+	if start < 0 {
+		start = 0
+	}
+	if end > b.length {
+		end = b.length
+	}
+	if start >= end {
+		return ""
+	}
+
+	var out strings.Builder
+	out.Grow(end-start)
+
+	pos := 0
+	for _, p := range(b.pieces) {
+		p_end := pos+p.length
+
+		if p_end <= start {
+			pos = p_end
+			continue
+		}
+		if pos >= end {
+			break
+		}
+
+		from := max(start, pos)-pos
+		to := min(end, p_end)-pos
+
+		if p.added {
+			out.Write(b.add[p.start+from:p.start+to])
+		}else{
+			out.WriteString(b.original[p.start+from:p.start+to])
+		}
+
+		pos = p_end
+	}
+
+	return out.String()
+}
+
+func (b *TextBuffer) text() string {
+	return b.slice(0, b.length)
+}
+
+func (b *TextBuffer) textRange(start_row, start_col, end_row, end_col int) string {
+	return b.slice(b.offset(start_row, start_col), b.offset(end_row, end_col))
+}
+
+// inserts text at row, col and returns the position just after it
+func (b *TextBuffer) insert(row, col int, text string) (int, int) {
+	if text == "" {
+		return row, col
+	}
+
+	at := b.offset(row, col)
+	b.insertAt(at, text)
+	b.markChanged(row)
+	b.journal = append(b.journal, EditOp{insert: true, offset: at, text: text})
+	b.recordChange(at)
+
+	nls := strings.Count(text, "\n")
+	if nls == 0 {
+		return row, col+len(text)
+	}
+
+	return row+nls, len(text)-strings.LastIndexByte(text, '\n')-1
+}
+
+func (b *TextBuffer) insertAt(at int, text string) {
+	add_start := len(b.add)
+	b.add = append(b.add, text...)
+	new_nls := findNewlines(text, add_start)
+	b.add_newlines = append(b.add_newlines, new_nls...)
+
+	b.length += len(text)
+	b.line_count += len(new_nls)
+	b.shiftMarks(at, len(text))
+	b.version ++
+
+	piece := Piece{added: true, start: add_start, length: len(text), newlines: len(new_nls)}
+
+	pos := 0
+	for indx, p := range(b.pieces) {
+		p_end := pos+p.length
+
+		if at == p_end && p.added && p.start+p.length == add_start { // typing straight on from the last insert
+			b.pieces[indx].length += piece.length
+			b.pieces[indx].newlines += piece.newlines
+			return
+		}
+
+		if at == pos {
+			b.pieces = append(b.pieces[:indx], append([]Piece{piece}, b.pieces[indx:]...)...)
+			return
+		}
+
+		if at < p_end {
+			split := p.start+at-pos
+			left := Piece{added: p.added, start: p.start, length: split-p.start, newlines: b.countNewlines(p.added, p.start, split)}
+			right := Piece{added: p.added, start: split, length: p.start+p.length-split, newlines: p.newlines-left.newlines}
+
+			b.pieces = append(b.pieces[:indx], append([]Piece{left, piece, right}, b.pieces[indx+1:]...)...)
+			return
+		}
+
+		pos = p_end
+	}
+
+	b.pieces = append(b.pieces, piece)
+}
+
+// removes the text between the two positions
+func (b *TextBuffer) remove(start_row, start_col, end_row, end_col int) {
+	start := b.offset(start_row, start_col)
+	end := b.offset(end_row, end_col)
+
+	if start >= end {
+		return
+	}
+
+	b.journal = append(b.journal, EditOp{insert: false, offset: start, text: b.slice(start, end)})
+	b.removeRange(start, end)
+	b.markChanged(start_row)
+	b.recordChange(start)
+}
+
+func (b *TextBuffer) removeRange(start, end int) {
+	new_pieces := make([]Piece, 0, len(b.pieces)+1)
+	removed_nls := 0
+
+	pos := 0
+	for _, p := range(b.pieces) {
+		p_end := pos+p.length
+
+		if p_end <= start || pos >= end {
+			new_pieces = append(new_pieces, p)
+			pos = p_end
+			continue
+		}
+
+		cut_from := p.start+max(start, pos)-pos
+		cut_to := p.start+min(end, p_end)-pos
+
+		if cut_from > p.start {
+			new_pieces = append(new_pieces, Piece{added: p.added, start: p.start, length: cut_from-p.start, newlines: b.countNewlines(p.added, p.start, cut_from)})
+		}
+
+		removed_nls += b.countNewlines(p.added, cut_from, cut_to)
+
+		if cut_to < p.start+p.length {
+			new_pieces = append(new_pieces, Piece{added: p.added, start: cut_to, length: p.start+p.length-cut_to, newlines: b.countNewlines(p.added, cut_to, p.start+p.length)})
+		}
+
+		pos = p_end
+	}
+
+	b.pieces = new_pieces
+	b.length -= end-start
+	b.line_count -= removed_nls
+	b.shiftMarks(start, start-end)
+	b.version ++
+}
+
+// replays (or reverts) a recorded operation without journaling it again
+func (b *TextBuffer) applyOp(op EditOp, reverse bool) {
+	row, _ := b.position(op.offset)
+	b.markChanged(row)
+
+	if op.insert != reverse {
+		b.insertAt(op.offset, op.text)
+	}else{
+		b.removeRange(op.offset, op.offset+len(op.text))
+	}
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Key profiles: the set of bindings to start from, picked with KEY_PROFILE in
+// allSettings.cdmg. A profile is a keymap read after DEFAULT_KEYMAP (a binding
+// for the same keys replaces the built in one) and before keymap.cdmg, so
+// anything a profile does can still be changed there.
+//
+//	codemage  the modal keys CodeMage always had, DEFAULT_KEYMAP alone
+//	vim       those plus the rest of vim: u, Ctrl+R, n N * #, a A I O s S J ~,
+//	          H M L zz, ZZ ZQ, Ctrl+D/U/F/B/E/Y to scroll, Ctrl+A/X on numbers
+//	emacs     not modal: C-a C-e C-f C-b C-n C-p, C-k C-w M-w C-y M-y and the
+//	          kill ring, C-space for the mark, C-x C-s and the other C-x keys
+//	cua       not modal: Ctrl+C/X/V/Z/Y/A/S/O/N/W/F/G like most editors, shift
+//	          or the mouse to select
+//
+// With a profile that isn't modal the main edit never leaves insert mode, Esc
+// (or C-g) drops the selection and the extra cursors instead.
+
+type KeyProfile struct {
+	name string
+	modal bool
+	keymap string
+}
+
+var KEY_PROFILE = "codemage"
+
+var VIM_KEYMAP = `
+normal u undo
+normal <C-r> redo
+normal n find-next
+normal N find-previous
+normal * search-word
+normal # search-word-backward
+normal a append
+normal A append-line-end
+normal I insert-line-start
+normal O open-line-above
+normal s keys xi
+normal S keys cc
+normal J join-lines
+normal ~ toggle-case
+visual ~ toggle-case
+visual u lowercase
+visual U uppercase
+normal H screen-top
+normal M screen-middle
+normal L screen-bottom
+normal zz center-line
+normal ZZ save-and-close
+normal ZQ close-without-saving
+normal,visual <C-d> half-page-down
+normal,visual <C-u> half-page-up
+normal,visual <C-f> page-down
+normal,visual <C-b> page-up
+normal,visual <C-e> scroll-line-down
+normal,visual <C-y> scroll-line-up
+normal <C-a> increment
+normal <C-x> decrement
+normal,visual [ nothing
+normal,visual ] nothing
+insert <C-w> keys <C-Backspace2>
+insert <C-u> delete-to-line-start
+insert <C-t> indent
+insert <C-d> deindent
+`
+
+var EMACS_KEYMAP = `
+all <C-x> nothing
+insert,find,prompt <C-a> line-start
+insert,find,prompt <C-e> line-end
+insert,find,prompt <C-f> char-forward
+insert,find,prompt <C-b> char-backward
+insert,find,prompt <A-f> word-forward
+insert,find,prompt <A-b> word-backward
+insert <C-n> line-down
+insert <C-p> line-up
+insert <Left> char-backward
+insert <Right> char-forward
+insert <Down> line-down
+insert <Up> line-up
+insert <Home> line-start
+insert <End> line-end
+insert <A-lt> file-start
+insert <A-gt> file-end
+insert <C-v> page-down
+insert <A-v> page-up
+insert <C-l> center-line
+insert,find,prompt <C-d> delete-char
+insert,find,prompt <C-k> kill-line
+insert,find,prompt <A-d> kill-word
+insert,find,prompt <A-Backspace> backward-kill-word
+insert,find,prompt <A-Backspace2> backward-kill-word
+insert,find,prompt <C-w> kill-region
+insert,prompt <A-w> copy-region
+insert,find,prompt <C-y> yank
+insert,find,prompt <A-y> yank-pop
+insert,find,prompt <C-Space> set-mark
+insert <C-x><C-x> exchange-point-and-mark
+insert <C-x>h select-all
+insert <C-o> open-line
+insert <C-g> cancel
+insert <Esc> cancel
+find,prompt <C-g> keys <Esc><Esc>
+find,prompt <Esc> keys <Esc><Esc>
+insert <C-_> undo
+insert <C-x>u undo
+insert <C-s> find
+insert <C-r> find
+find <C-s> find-next
+find <C-r> find-previous
+insert <A-x> command-line
+insert <A-g><A-g> goto-line
+insert <C-x><C-s> save
+insert <C-x><C-w> save-as
+insert <C-x><C-f> open-file
+insert <C-x>b file-list
+insert <C-x>k close-file
+insert <C-x><Right> next-file
+insert <C-x><Left> previous-file
+insert <C-x>d explorer
+insert <C-x>2 split-below
+insert <C-x>3 split-right
+insert <C-x>o next-pane
+insert <C-x>0 close-pane
+insert <C-x><C-c> quit
+`
+
+var CUA_KEYMAP = `
+insert <C-a> select-all
+insert,find,prompt <C-v> paste
+insert <C-n> new-file
+insert <C-o> open-file
+insert <C-w> close-file
+insert <C-g> goto-line
+insert <C-Home> file-start
+insert <C-End> file-end
+insert <C-S-Home> file-start
+insert <C-S-End> file-end
+insert <PgDn> page-down
+insert <PgUp> page-up
+insert <S-PgDn> page-down
+insert <S-PgUp> page-up
+insert <Tab> indent-or-tab
+insert <Backtab> deindent
+insert <S-Backtab> deindent
+insert <F3> find-next
+insert <S-F3> find-previous
+find <F3> find-next
+find <S-F3> find-previous
+insert <Esc> cancel
+find,prompt <Esc> keys <Esc><Esc>
+`
+
+var KEY_PROFILES = []KeyProfile{
+	{name: "codemage", modal: true},
+	{name: "vim", modal: true, keymap: VIM_KEYMAP},
+	{name: "emacs", modal: false, keymap: EMACS_KEYMAP},
+	{name: "cua", modal: false, keymap: CUA_KEYMAP},
+}
+
+var KILL_RING []string // newest first
+var KILL_RING_SIZE = 60
+var YANK_INDEX int // the entry of the kill ring the last yank put in
+var YANK_ROW, YANK_COL int // where it went
+var MARK_ACTIVE bool // the selection follows the cursor from where C-space set the mark
+var LAST_KEY_COMMAND string // the command the last key ran, "" when it was handled as it is
+
+var NUMBER_PATTERN = regexp.MustCompile(`-?[0-9]+`)
+
+func getKeyProfile() *KeyProfile {
+	for indx := range(KEY_PROFILES) {
+		if KEY_PROFILES[indx].name == KEY_PROFILE {
+			return &KEY_PROFILES[indx]
+		}
+	}
+	return nil
+}
+
+func getKeyProfileNames() []string {
+	names := []string{}
+	for _, profile := range(KEY_PROFILES) {
+		names = append(names, profile.name)
+	}
+	return names
+}
+
+func isModalProfile() bool {
+	profile := getKeyProfile()
+	return profile == nil || profile.modal
+}
+
+// with a profile that isn't modal the main edit is put back in insert mode
+// after every key, whatever the key did
+func keepInsertMode() {
+	edit := &MAIN_TEXTEDIT
+	if isModalProfile() || edit.current_mode == "i" && edit.visual_mode == "" {
+		return
+	}
+
+	edit.current_mode = "i"
+	edit.visual_mode = ""
+	edit.pending_command = ""
+	edit.number_string = ""
+}
+
+func setupProfileCommands() {
+	addKeyCommand("line-start", "move to the start of the line", func(edit *Edit) { moveByCommand(edit, START_OF_LINE) })
+	addKeyCommand("line-end", "move to the end of the line", func(edit *Edit) { moveByCommand(edit, END_OF_LINE) })
+	addKeyCommand("char-forward", "move right a character", func(edit *Edit) { moveByCommand(edit, MOVE_RIGHT) })
+	addKeyCommand("char-backward", "move left a character", func(edit *Edit) { moveByCommand(edit, MOVE_LEFT) })
+	addKeyCommand("line-down", "move down a line", func(edit *Edit) { moveByCommand(edit, MOVE_DOWN) })
+	addKeyCommand("line-up", "move up a line", func(edit *Edit) { moveByCommand(edit, MOVE_UP) })
+	addKeyCommand("word-forward", "move to the end of the word, or the next one", func(edit *Edit) { moveByWords(edit, true) })
+	addKeyCommand("word-backward", "move to the start of the word, or the one before", func(edit *Edit) { moveByWords(edit, false) })
+	addKeyCommand("file-start", "move to the start of the file", func(edit *Edit) { moveToFileEdge(edit, false) })
+	addKeyCommand("file-end", "move to the end of the file", func(edit *Edit) { moveToFileEdge(edit, true) })
+	addKeyCommand("page-down", "scroll down a screen", func(edit *Edit) { scrollByRows(edit, max(edit.height-2, 1)*takeCount(edit), true) })
+	addKeyCommand("page-up", "scroll up a screen", func(edit *Edit) { scrollByRows(edit, -max(edit.height-2, 1)*takeCount(edit), true) })
+	addKeyCommand("half-page-down", "scroll down half a screen", func(edit *Edit) { scrollByRows(edit, max(edit.height/2, 1), true) })
+	addKeyCommand("half-page-up", "scroll up half a screen", func(edit *Edit) { scrollByRows(edit, -max(edit.height/2, 1), true) })
+	addKeyCommand("scroll-line-down", "scroll down a line, the cursor staying where it is if it can", func(edit *Edit) { scrollByRows(edit, takeCount(edit), false) })
+	addKeyCommand("scroll-line-up", "scroll up a line, the cursor staying where it is if it can", func(edit *Edit) { scrollByRows(edit, -takeCount(edit), false) })
+	addKeyCommand("screen-top", "move to the top line on screen", func(edit *Edit) { moveToScreenRow(edit, 0) })
+	addKeyCommand("screen-middle", "move to the middle line on screen", func(edit *Edit) { moveToScreenRow(edit, 1) })
+	addKeyCommand("screen-bottom", "move to the bottom line on screen", func(edit *Edit) { moveToScreenRow(edit, 2) })
+	addKeyCommand("center-line", "scroll the line of the cursor to the middle of the screen", func(edit *Edit) {
+		edit.toprow = max(edit.cursor.row-edit.height/2, 0)
+	})
+	addKeyCommand("goto-line", "ask for a line number to go to", func(edit *Edit) {
+		INPUT_MODAL_CALLBACK = continueGotoLine
+		getTextInput("Line number?")
+	})
+	addKeyCommand("select-all", "select the whole file", func(edit *Edit) {
+		clearExtraCursors(edit)
+		edit.cursor.row_anchor = 0
+		edit.cursor.col_anchor = 0
+		moveCursor(FULL_END, true, 1, edit)
+	})
+	addKeyCommand("cancel", "drop the selection, the mark and the extra cursors", cancelSelection)
+	addKeyCommand("find-next", "find the last search again", func(edit *Edit) { findAgain(edit, false) })
+	addKeyCommand("find-previous", "find the last search again, backwards", func(edit *Edit) { findAgain(edit, true) })
+	addKeyCommand("search-word", "find the next occurrence of the word under the cursor", func(edit *Edit) { searchWordAtCursor(edit, false) })
+	addKeyCommand("search-word-backward", "find the previous occurrence of the word under the cursor", func(edit *Edit) { searchWordAtCursor(edit, true) })
+	addKeyCommand("append", "insert after the cursor", func(edit *Edit) {
+		if edit.cursor.col < edit.buffer.lineLen(edit.cursor.row) {
+			moveCursor(MOVE_RIGHT, false, 1, edit)
+		}
+		startInsert(edit)
+	})
+	addKeyCommand("append-line-end", "insert at the end of the line", func(edit *Edit) {
+		moveCursor(END_OF_LINE, false, 1, edit)
+		startInsert(edit)
+	})
+	addKeyCommand("insert-line-start", "insert before the first character of the line that isn't blank", func(edit *Edit) {
+		moveToTarget(edit, MotionTarget{edit.cursor.row, getFirstNonBlank(edit, edit.cursor.row), MOTION_EXCLUSIVE}, false)
+		startInsert(edit)
+	})
+	addKeyCommand("open-line-above", "insert on a new line above", openLineAbove)
+	addKeyCommand("open-line", "break the line after the cursor, staying before the break", func(edit *Edit) {
+		runChangeStep(edit, func() {
+			row, col := edit.cursor.row, edit.cursor.col
+			insertText(edit, "\n")
+			edit.cursor = Cursor{row: row, col: col, row_anchor: row, col_anchor: col, preferencial_col: getTrueCol(col, row, edit)}
+		})
+	})
+	addKeyCommand("join-lines", "join the line below onto the line of the cursor", joinLines)
+	addKeyCommand("toggle-case", "switch the case of the character under the cursor, or of the selection", func(edit *Edit) { changeCase(edit, swapCase) })
+	addKeyCommand("lowercase", "make the selection lower case", func(edit *Edit) { changeCase(edit, unicode.ToLower) })
+	addKeyCommand("uppercase", "make the selection upper case", func(edit *Edit) { changeCase(edit, unicode.ToUpper) })
+	addKeyCommand("increment", "add the count to the number under or after the cursor", func(edit *Edit) { addToNumber(edit, takeCount(edit)) })
+	addKeyCommand("decrement", "take the count from the number under or after the cursor", func(edit *Edit) { addToNumber(edit, -takeCount(edit)) })
+	addKeyCommand("delete-char", "delete the character under the cursor", func(edit *Edit) {
+		runChangeStep(edit, func() { deleteText(DELETE, 1, edit) })
+	})
+	addKeyCommand("delete-to-line-start", "delete what is before the cursor on its line", func(edit *Edit) {
+		edit.buffer.remove(edit.cursor.row, 0, edit.cursor.row, edit.cursor.col)
+		moveCursor(START_OF_LINE, false, 1, edit)
+	})
+	addKeyCommand("indent-or-tab", "indent the lines of a selection across lines, otherwise type a tab", indentOrTab)
+	addKeyCommand("paste", "paste at every cursor, a line each if there are as many lines as cursors", pasteAtCursors)
+	addKeyCommand("kill-line", "cut to the end of the line onto the kill ring, or the line break at the end", killLine)
+	addKeyCommand("kill-word", "cut to the end of the word onto the kill ring", func(edit *Edit) { killWord(edit, true) })
+	addKeyCommand("backward-kill-word", "cut to the start of the word onto the kill ring", func(edit *Edit) { killWord(edit, false) })
+	addKeyCommand("kill-region", "cut from the mark to the cursor onto the kill ring", killRegion)
+	addKeyCommand("copy-region", "copy from the mark to the cursor onto the kill ring", copyRegion)
+	addKeyCommand("yank", "paste the newest entry of the kill ring", yank)
+	addKeyCommand("yank-pop", "right after a yank, put the entry before it in its place", yankPop)
+	addKeyCommand("set-mark", "set the mark at the cursor, the selection follows the cursor from it", func(edit *Edit) {
+		edit.cursor.row_anchor = edit.cursor.row
+		edit.cursor.col_anchor = edit.cursor.col
+		MARK_ACTIVE = true
+		commandMessage("Mark set")
+	})
+	addKeyCommand("exchange-point-and-mark", "swap the cursor and the mark", func(edit *Edit) {
+		edit.cursor.row, edit.cursor.row_anchor = edit.cursor.row_anchor, edit.cursor.row
+		edit.cursor.col, edit.cursor.col_anchor = edit.cursor.col_anchor, edit.cursor.col
+		edit.cursor.preferencial_col = getTrueCol(edit.cursor.col, edit.cursor.row, edit)
+		MARK_ACTIVE = true
+	})
+	addKeyCommand("new-file", "open a new untitled file", func(edit *Edit) { newUntitledFile() })
+	addKeyCommand("save-and-close", "save the file if it changed and close it, like :x", func(edit *Edit) { runExCommand("x") })
+	addKeyCommand("close-without-saving", "close the file throwing away its changes, like :q!", func(edit *Edit) { runExCommand("q!") })
+	addKeyCommand("quit", "close every file and quit, asking about unsaved ones", func(edit *Edit) { quitEditor() })
+	addKeyCommand("split-below", "split the pane, the new one below", func(edit *Edit) { splitPane(false) })
+	addKeyCommand("split-right", "split the pane, the new one to the right", func(edit *Edit) { splitPane(true) })
+	addKeyCommand("next-pane", "move to the next pane", func(edit *Edit) { cyclePaneFocus() })
+	addKeyCommand("close-pane", "close the pane", func(edit *Edit) { closePane() })
+}
+
+// the count typed in front of a command, which it uses up
+func takeCount(edit *Edit) int {
+	count := getCount(edit.number_string)
+	edit.number_string = ""
+	return count
+}
+
+// whether moving should drag the selection along: the mark is set, a visual
+// mode is on, or shift is held with a key that isn't a character
+func isSelectingKey(edit *Edit) bool {
+	return MARK_ACTIVE || edit.visual_mode != "" || KEYMAP_SHIFT_HELD
+}
+
+func moveByCommand(edit *Edit, action int) {
+	if len(SUGGESTIONS) != 0 && edit.is_main {
+		hideSuggestions()
+	}
+	moveCursor(action, isSelectingKey(edit), takeCount(edit), edit)
+}
+
+// emacs' words: past anything that isn't part of one, then to the other end
+// of the word after it
+func moveOverWord(edit *Edit, row, col int, forward bool) (int, int) {
+	if forward {
+		ok := true
+		for ok && getCharTypeAt(edit, row, col) != NORMAL_CHAR_TYPE {
+			row, col, ok = nextTextPos(edit, row, col)
+		}
+		for ok && getCharTypeAt(edit, row, col) == NORMAL_CHAR_TYPE {
+			row, col, ok = nextTextPos(edit, row, col)
+		}
+		return row, col
+	}
+
+	in_word := false
+	for {
+		prev_row, prev_col, ok := prevTextPos(edit, row, col)
+		is_word := ok && getCharTypeAt(edit, prev_row, prev_col) == NORMAL_CHAR_TYPE
+		if !ok || in_word && !is_word {
+			break
+		}
+		in_word = is_word
+		row, col = prev_row, prev_col
+	}
+	return row, col
+}
+
+func moveByWords(edit *Edit, forward bool) {
+	row, col := edit.cursor.row, edit.cursor.col
+	for range(takeCount(edit)) {
+		row, col = moveOverWord(edit, row, col, forward)
+	}
+	moveToTarget(edit, MotionTarget{row, col, MOTION_EXCLUSIVE}, isSelectingKey(edit))
+}
+
+func moveToFileEdge(edit *Edit, end bool) {
+	if edit.is_main {
+		recordJump()
+	}
+
+	if end {
+		moveCursor(FULL_END, isSelectingKey(edit), 1, edit)
+		return
+	}
+
+	edit.cursor.row = 0
+	edit.cursor.col = 0
+	edit.cursor.preferencial_col = 0
+	if !isSelectingKey(edit) {
+		edit.cursor.row_anchor = 0
+		edit.cursor.col_anchor = 0
+	}
+}
+
+// scrolls the view by rows and moves the cursor as far, or without move only
+// as far as keeps it on screen
+func scrollByRows(edit *Edit, rows int, move bool) {
+	edit.toprow = min(max(edit.toprow+rows, 0), max(edit.buffer.lineCount()-edit.height, 0))
+
+	steps, action := rows, MOVE_DOWN
+	if !move {
+		steps = max(edit.toprow-edit.cursor.row, 0)
+		if edit.cursor.row > edit.toprow+edit.height-1 {
+			steps, action = edit.cursor.row-(edit.toprow+edit.height-1), MOVE_UP
+		}
+	}else if rows < 0 {
+		steps, action = -rows, MOVE_UP
+	}
+
+	if steps > 0 {
+		moveCursor(action, isSelectingKey(edit), steps, edit)
+	}
+}
+
+// at is 0 for the top line on screen, 1 for the middle one and 2 for the bottom
+func moveToScreenRow(edit *Edit, at int) {
+	last := min(edit.toprow+edit.height-1, edit.buffer.lineCount()-1)
+	row := []int{edit.toprow, (edit.toprow+last)/2, last}[at]
+
+	recordJump()
+	moveToTarget(edit, MotionTarget{row, getFirstNonBlank(edit, row), MOTION_EXCLUSIVE}, isSelectingKey(edit))
+}
+
+func continueGotoLine() {
+	text := strings.TrimSpace(getPlainText(&INPT_TEXTEDIT))
+	if text == "" {
+		return
+	}
+
+	if _, err := strconv.Atoi(text); err != nil {
+		commandError("Not a line number: "+text)
+		return
+	}
+	runExCommand(text)
+}
+
+func cancelSelection(edit *Edit) {
+	MARK_ACTIVE = false
+	clearExtraCursors(edit)
+	hideSuggestions()
+
+	edit.visual_mode = ""
+	edit.pending_command = ""
+	edit.number_string = ""
+	edit.cursor.row_anchor = edit.cursor.row
+	edit.cursor.col_anchor = edit.cursor.col
+}
+
+func findAgain(edit *Edit, backwards bool) {
+	if getPlainText(&FIND_TEXTEDIT) == "" {
+		commandError("No previous search")
+		return
+	}
+
+	for range(takeCount(edit)) {
+		runFind(backwards)
+	}
+}
+
+func searchWordAtCursor(edit *Edit, backwards bool) {
+	edit = &MAIN_TEXTEDIT // runFind only looks there
+	if !selectWordAtCursor(edit) {
+		commandError("No word under the cursor")
+		return
+	}
+
+	setEditText(&FIND_TEXTEDIT, getCursorSelection(edit))
+	if backwards { // from the start of the word, so it isn't found again
+		edit.cursor.col = edit.cursor.col_anchor
+	}
+	findAgain(edit, backwards)
+}
+
+func startInsert(edit *Edit) {
+	edit.current_mode = "i"
+	edit.number_string = ""
+	drawTitleBar()
+}
+
+func openLineAbove(edit *Edit) {
+	line := edit.buffer.line(edit.cursor.row)
+	tabs := line[:len(line)-len(strings.TrimLeft(line, "\t"))]
+	row := edit.cursor.row
+
+	edit.cursor = Cursor{row: row, col: 0, row_anchor: row, col_anchor: 0}
+	insertText(edit, tabs+"\n")
+	edit.cursor = Cursor{row: row, col: len(tabs), row_anchor: row, col_anchor: len(tabs), preferencial_col: getTrueCol(len(tabs), row, edit)}
+
+	startInsert(edit)
+}
+
+// joins count lines (two without a count) into one, with a space between
+// where neither side already has one
+func joinLines(edit *Edit) {
+	row := edit.cursor.row
+	joins := max(takeCount(edit)-1, 1)
+
+	if row+1 >= edit.buffer.lineCount() {
+		failMacro()
+		return
+	}
+
+	for range(joins) {
+		if row+1 >= edit.buffer.lineCount() {
+			break
+		}
+
+		line := edit.buffer.line(row)
+		next := edit.buffer.line(row+1)
+		rest := strings.TrimLeft(next, WHITESPACE)
+		col := len(line)
+
+		edit.buffer.remove(row, col, row+1, len(next)-len(rest))
+		if line != "" && rest != "" && !strings.ContainsAny(line[len(line)-1:], WHITESPACE) && rest[0] != ')' {
+			edit.buffer.insert(row, col, " ")
+		}
+
+		edit.cursor = Cursor{row: row, col: col, row_anchor: row, col_anchor: col, preferencial_col: getTrueCol(col, row, edit)}
+	}
+}
+
+func swapCase(char rune) rune {
+	if unicode.IsUpper(char) {
+		return unicode.ToLower(char)
+	}
+	return unicode.ToUpper(char)
+}
+
+func replaceRange(edit *Edit, sr, sc, er, ec int, fn func(rune) rune) {
+	text := edit.buffer.textRange(sr, sc, er, ec)
+	changed := strings.Map(fn, text)
+	if changed != text {
+		edit.buffer.remove(sr, sc, er, ec)
+		edit.buffer.insert(sr, sc, changed)
+	}
+}
+
+// runs fn over the selection of a visual mode, or over as many characters as
+// the count from the cursor, which moves past them
+func changeCase(edit *Edit, fn func(rune) rune) {
+	if edit.visual_mode == "b" {
+		sr, er, left, right := getBlockBounds(edit)
+		for row := sr; row <= er; row++ {
+			start, end := getBlockCols(edit, row, left, right)
+			replaceRange(edit, row, start, row, end, fn)
+		}
+		exitVisualMode(edit)
+		moveToTarget(edit, MotionTarget{sr, min(edit.cursor.col, edit.buffer.lineLen(sr)), MOTION_EXCLUSIVE}, false)
+		return
+	}
+
+	if edit.visual_mode != "" {
+		sr, sc, er, ec := getSelectionRange(edit)
+		replaceRange(edit, sr, sc, er, ec, fn)
+		exitVisualMode(edit)
+		moveToTarget(edit, MotionTarget{sr, sc, MOTION_EXCLUSIVE}, false)
+		return
+	}
+
+	row, col := edit.cursor.row, edit.cursor.col
+	line := edit.buffer.line(row)
+	end := col
+	for range(takeCount(edit)) {
+		if end >= len(line) {
+			break
+		}
+		end = nextGrapheme(line, end)
+	}
+
+	if end == col {
+		failMacro()
+		return
+	}
+
+	replaceRange(edit, row, col, row, end, fn)
+	moveToTarget(edit, MotionTarget{row, min(end, edit.buffer.lineLen(row)), MOTION_EXCLUSIVE}, false)
+}
+
+// adds amount to the first number on the line that ends after the cursor,
+// leaving the cursor on its last digit
+func addToNumber(edit *Edit, amount int) {
+	row := edit.cursor.row
+	line := edit.buffer.line(row)
+
+	for _, loc := range(NUMBER_PATTERN.FindAllStringIndex(line, -1)) {
+		if loc[1] <= edit.cursor.col {
+			continue
+		}
+
+		value, err := strconv.Atoi(line[loc[0]:loc[1]])
+		if err != nil {
+			commandError("Number too big: "+line[loc[0]:loc[1]])
+			return
+		}
+
+		text := strconv.Itoa(value+amount)
+		edit.buffer.remove(row, loc[0], row, loc[1])
+		edit.buffer.insert(row, loc[0], text)
+		moveToTarget(edit, MotionTarget{row, loc[0]+len(text)-1, MOTION_EXCLUSIVE}, false)
+		return
+	}
+
+	failMacro()
+}
+
+// runs a change as an undo step of its own, which a change made in insert
+// mode otherwise wouldn't be
+func runChangeStep(edit *Edit, fn func()) {
+	if !UNDO_GROUP_HELD {
+		closeUndoGroup(edit)
+	}
+	fn()
+	if !UNDO_GROUP_HELD {
+		closeUndoGroup(edit)
+	}
+}
+
+func indentOrTab(edit *Edit) {
+	for _, cursor := range(getAllCursors(edit)) {
+		if cursor.row != cursor.row_anchor {
+			indent(edit)
+			return
+		}
+	}
+
+	typeKeys([]*tcell.EventKey{tcell.NewEventKey(tcell.KeyRune, '\t', tcell.ModNone)})
+}
+
+func pasteAtCursors(edit *Edit) {
+	text := readRegister(0).text
+	if text == "" {
+		commandError("Nothing to paste")
+		return
+	}
+
+	cursors := len(edit.extra_cursors)+1
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	indx := 0
+
+	runChangeStep(edit, func() {
+		forEachCursor(edit, func() {
+			if len(lines) == cursors && cursors > 1 {
+				insertText(edit, lines[indx])
+			}else{
+				insertText(edit, text)
+			}
+			indx ++
+		})
+	})
+}
+
+// puts text on the kill ring, added to the newest entry when the key before
+// killed too (in front of it when killing backwards)
+func killText(text string, backwards bool) {
+	if strings.Contains(LAST_KEY_COMMAND, "kill-") && len(KILL_RING) > 0 {
+		if backwards {
+			KILL_RING[0] = text+KILL_RING[0]
+		}else{
+			KILL_RING[0] += text
+		}
+	}else{
+		KILL_RING = append([]string{text}, KILL_RING...)
+		if len(KILL_RING) > KILL_RING_SIZE {
+			KILL_RING = KILL_RING[:KILL_RING_SIZE]
+		}
+	}
+
+	CURRENT_REGISTER = 0
+	storeRegister(Register{text: KILL_RING[0]}, 'd')
+}
+
+func killRange(edit *Edit, sr, sc, er, ec int, backwards bool) {
+	if sr == er && sc == ec {
+		failMacro()
+		return
+	}
+
+	MARK_ACTIVE = false
+	runChangeStep(edit, func() {
+		killText(edit.buffer.textRange(sr, sc, er, ec), backwards)
+		edit.buffer.remove(sr, sc, er, ec)
+		edit.cursor = Cursor{row: sr, col: sc, row_anchor: sr, col_anchor: sc, preferencial_col: getTrueCol(sc, sr, edit)}
+	})
+}
+
+func killLine(edit *Edit) {
+	row, col := edit.cursor.row, edit.cursor.col
+	end_row, end_col := row, edit.buffer.lineLen(row)
+
+	if col == end_col && row+1 < edit.buffer.lineCount() { // at the end it takes the line break
+		end_row, end_col = row+1, 0
+	}
+	killRange(edit, row, col, end_row, end_col, false)
+}
+
+func killWord(edit *Edit, forward bool) {
+	row, col := edit.cursor.row, edit.cursor.col
+	to_row, to_col := moveOverWord(edit, row, col, forward)
+
+	if forward {
+		killRange(edit, row, col, to_row, to_col, false)
+	}else{
+		killRange(edit, to_row, to_col, row, col, true)
+	}
+}
+
+func killRegion(edit *Edit) {
+	if !hasSelection(edit) {
+		commandError("The mark is not set")
+		return
+	}
+
+	sr, sc, er, ec := getCursorRange(edit, edit.cursor)
+	killRange(edit, sr, sc, er, ec, false)
+}
+
+func copyRegion(edit *Edit) {
+	if !hasSelection(edit) {
+		commandError("The mark is not set")
+		return
+	}
+
+	sr, sc, er, ec := getCursorRange(edit, edit.cursor)
+	killText(edit.buffer.textRange(sr, sc, er, ec), false)
+
+	MARK_ACTIVE = false
+	edit.cursor.row_anchor = edit.cursor.row
+	edit.cursor.col_anchor = edit.cursor.col
+}
+
+func insertYank(edit *Edit, text string) {
+	MARK_ACTIVE = false
+	edit.cursor.row_anchor = edit.cursor.row
+	edit.cursor.col_anchor = edit.cursor.col
+	YANK_ROW, YANK_COL = edit.cursor.row, edit.cursor.col
+
+	insertText(edit, text)
+}
+
+func yank(edit *Edit) {
+	if clip := getClipboard(); clip != "" && (len(KILL_RING) == 0 || clip != KILL_RING[0]) {
+		KILL_RING = append([]string{clip}, KILL_RING...) // copied outside the editor
+	}
+
+	if len(KILL_RING) == 0 {
+		commandError("The kill ring is empty")
+		return
+	}
+
+	YANK_INDEX = 0
+	runChangeStep(edit, func() { insertYank(edit, KILL_RING[0]) })
+}
+
+func yankPop(edit *Edit) {
+	if LAST_KEY_COMMAND != "yank" && LAST_KEY_COMMAND != "yank-pop" {
+		commandError("The key before was not a yank")
+		return
+	}
+
+	YANK_INDEX = (YANK_INDEX+1) % len(KILL_RING)
+
+	runChangeStep(edit, func() { // taking the last yank out and putting this in are undone together
+		edit.buffer.remove(YANK_ROW, YANK_COL, edit.cursor.row, edit.cursor.col)
+		edit.cursor = Cursor{row: YANK_ROW, col: YANK_COL, row_anchor: YANK_ROW, col_anchor: YANK_COL}
+		insertYank(edit, KILL_RING[YANK_INDEX])
+	})
+}
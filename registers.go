@@ -0,0 +1,263 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+	"golang.design/x/clipboard"
+)
+
+// Registers hold what was yanked and deleted. A normal mode command can name
+// one with "{register} in front of it ("ayy, "bp, "+y), otherwise it uses the
+// unnamed register. The unnamed register is mirrored to the system clipboard
+// when USE_CLIP is on, and if something else was copied there since, pasting
+// without naming a register pastes that instead.
+//
+//	"a to "z    named registers, "A to "Z append to them instead
+//	"0          the last yank
+//	"1 to "9    the last deletes of whole lines or across lines, newest first
+//	"-          the last delete within a line
+//	"+ and "*   the system clipboard
+//	"_          throws the text away
+//	". "% "/    read only: the last inserted text, the file name, the last search
+//
+// Everything yanked, deleted or copied also goes on the clipboard history,
+// which Alt+V shows to pick something to paste from.
+
+type Register struct {
+	text string
+	linewise bool // whole lines, always ending in a line break
+	blockwise bool // a block of columns, one line of it per row
+}
+
+var REGISTERS = map[rune]Register{}
+var CURRENT_REGISTER rune // the register named for the command being run, 0 when none was
+
+var CLIPBOARD_HISTORY []Register // newest first
+var CLIPBOARD_HISTORY_SIZE = 50
+
+var INSERTED_TEXT string // typed so far in the insert session going on
+var LAST_INSERTED_TEXT string
+
+func isRegisterName(name rune) bool {
+	return name >= 'a' && name <= 'z' || name >= 'A' && name <= 'Z' || name >= '0' && name <= '9' || strings.ContainsRune("\"-+*_.%/", name)
+}
+
+func setClipboard(text string) {
+	if USE_CLIP {
+		clipboard.Write(clipboard.FmtText, []byte(text))
+	}
+}
+
+func getClipboard() string {
+	if USE_CLIP {
+		return strings.ReplaceAll(string(clipboard.Read(clipboard.FmtText)), "\r", "")
+	}
+	return ""
+}
+
+func readRegister(name rune) Register {
+	if name == 0 || name == '"' {
+		reg := REGISTERS['"']
+		if clip := getClipboard(); clip != "" && clip != reg.text { // copied outside the editor since
+			return Register{text: clip}
+		}
+		return reg
+	}
+
+	if (name == '+' || name == '*') && USE_CLIP {
+		return Register{text: getClipboard()}
+	}else if name == '+' || name == '*' {
+		return REGISTERS['+']
+	}else if name == '.' {
+		return Register{text: LAST_INSERTED_TEXT}
+	}else if name == '%' {
+		return Register{text: file_name}
+	}else if name == '/' {
+		return Register{text: getPlainText(&FIND_TEXTEDIT)}
+	}
+
+	return REGISTERS[unicode.ToLower(name)]
+}
+
+// adds reg on to the end of old, for the capital registers
+func appendRegister(old, reg Register) Register {
+	if !old.linewise && !reg.linewise {
+		return Register{text: old.text+reg.text, blockwise: old.blockwise && reg.blockwise}
+	}
+
+	// when either is whole lines the result is too, each part on lines of its own
+	text := old.text
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	text += reg.text
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+
+	return Register{text: text, linewise: true}
+}
+
+// keeps text yanked (op y) or deleted by op in the register named for the
+// command, and in the unnamed register, the clipboard and its history
+func storeRegister(reg Register, op rune) {
+	name := CURRENT_REGISTER
+	if name == '_' {
+		return
+	}
+	if strings.ContainsRune(".%/", name) {
+		name = 0 // read only, so it goes where it would if no register was named
+	}
+
+	if name >= 'A' && name <= 'Z' {
+		name = unicode.ToLower(name)
+		reg = appendRegister(REGISTERS[name], reg)
+	}
+
+	if name >= 'a' && name <= 'z' {
+		REGISTERS[name] = reg
+		keepMacro(name, reg.text) // in macros.go
+	}else if name >= '0' && name <= '9' {
+		REGISTERS[name] = reg
+	}else if name == '+' || name == '*' {
+		REGISTERS['+'] = reg
+	}else if op == 'y' {
+		REGISTERS['0'] = reg
+	}else if reg.linewise || strings.Contains(reg.text, "\n") {
+		for indx := '9'; indx > '1'; indx-- {
+			REGISTERS[indx] = REGISTERS[indx-1]
+		}
+		REGISTERS['1'] = reg
+	}else{
+		REGISTERS['-'] = reg
+	}
+
+	REGISTERS['"'] = reg
+	setClipboard(reg.text)
+	addClipboardHistory(reg)
+}
+
+func addClipboardHistory(reg Register) {
+	if reg.text == "" {
+		return
+	}
+
+	history := []Register{reg}
+	for _, old := range(CLIPBOARD_HISTORY) {
+		if old.text != reg.text && len(history) < CLIPBOARD_HISTORY_SIZE {
+			history = append(history, old)
+		}
+	}
+
+	CLIPBOARD_HISTORY = history
+}
+
+// keeps what is typed in insert mode for the ". register
+func recordInsertKey(ev *tcell.EventKey, edit *Edit) {
+	if !edit.is_main || CURSOR_KEY_PASS > 1 { // every cursor types the same
+		return
+	}
+
+	if ev.Key() == tcell.KeyEscape {
+		LAST_INSERTED_TEXT = INSERTED_TEXT
+		INSERTED_TEXT = ""
+	}else if ev.Key() == tcell.KeyBackspace || ev.Key() == tcell.KeyBackspace2 {
+		_, size := utf8.DecodeLastRuneInString(INSERTED_TEXT)
+		INSERTED_TEXT = INSERTED_TEXT[:len(INSERTED_TEXT)-size]
+	}else if ev.Key() == tcell.KeyEnter {
+		INSERTED_TEXT += "\n"
+	}else if ev.Key() == tcell.KeyTab {
+		INSERTED_TEXT += "\t"
+	}else if ev.Key() == tcell.KeyRune && ev.Modifiers()&(tcell.ModAlt|tcell.ModCtrl) == 0 {
+		INSERTED_TEXT += string(ev.Rune())
+	}
+}
+
+func getClipboardHistoryRows() []string {
+	rows := []string{}
+
+	for _, reg := range(CLIPBOARD_HISTORY) {
+		text := strings.ReplaceAll(strings.TrimSuffix(reg.text, "\n"), "\t", " ")
+		text = strings.ReplaceAll(text, "\n", " ⏎ ")
+
+		if reg.linewise {
+			text = "[lines] "+text
+		}else if reg.blockwise {
+			text = "[block] "+text
+		}
+
+		rows = append(rows, text)
+	}
+
+	return rows
+}
+
+func pasteClipboardHistory(indx int) {
+	reg := CLIPBOARD_HISTORY[indx]
+	edit := &MAIN_TEXTEDIT
+
+	CURRENT_REGISTER = 0
+	storeRegister(reg, 'y') // it becomes what p pastes too
+	syncUndoCursor(edit)
+
+	if edit.current_mode == "i" {
+		insertText(edit, reg.text)
+	}else{
+		pasteText(edit, true, 1)
+	}
+
+	showCursor(edit)
+	readyUndoHistory(edit)
+}
+
+// Ctrl+C, with more than one cursor every selection goes in, a line each
+func copySelection(edit *Edit) {
+	if len(edit.extra_cursors) > 0 {
+		storeRegister(Register{text: getCursorsText(edit)}, 'y')
+		return
+	}
+
+	storeRegister(Register{text: getCursorSelection(edit), blockwise: edit.visual_mode == "b"}, 'y')
+}
+
+func cutSelection(edit *Edit) {
+	if len(edit.extra_cursors) > 0 {
+		storeRegister(Register{text: getCursorsText(edit)}, 'd')
+		visual := edit.visual_mode
+
+		forEachCursor(edit, func() {
+			if visual != "" {
+				sr, sc, er, ec := getSelectionRange(edit)
+				edit.cursor = Cursor{row: er, col: ec, row_anchor: sr, col_anchor: sc}
+			}
+			insertText(edit, "")
+		})
+		edit.visual_mode = ""
+		return
+	}
+
+	if edit.visual_mode != "" {
+		applySelectionOperator(edit, 'd') // yanking it puts it in the clipboard
+		return
+	}
+
+	storeRegister(Register{text: getCursorSelection(edit)}, 'd')
+	insertText(edit, "")
+}
+
+func openClipboardHistory() {
+	if clip := getClipboard(); clip != "" && clip != REGISTERS['"'].text {
+		addClipboardHistory(Register{text: clip}) // copied outside the editor
+	}
+
+	if len(CLIPBOARD_HISTORY) == 0 {
+		displayError("Nothing has been copied yet")
+		return
+	}
+
+	showPicker("Clipboard History (enter pastes)", getClipboardHistoryRows(), 0)
+	PICKER_CHOOSE_CALLBACK = pasteClipboardHistory
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// . repeats the last change. The keys of the main edit are kept from the
+// moment a command starts (a count, an operator, v, i...) until it is all
+// done and the editor is back in normal mode with nothing pending, and if
+// the text changed along the way they become the change . plays again.
+// A count before . takes the place of the one the change was typed with.
+//
+// The replayed keys are held in one undo step, however many they are.
+
+var CHANGE_KEYS []*tcell.EventKey // of the command being typed now
+var CHANGE_MADE bool // the text has changed since it started
+var LAST_CHANGE []*tcell.EventKey
+
+var REPEATING_CHANGE bool
+var CHANGE_REPEATED bool // the key just handled was a ., which isn't a change of its own
+
+// nothing half typed, so the next key starts something new
+func isCommandIdle(edit *Edit) bool {
+	return edit.current_mode == "n" && edit.pending_command == "" && edit.number_string == "" && edit.visual_mode == ""
+}
+
+// called before each key of the main edit is handled
+func beginChangeKey(edit *Edit) {
+	if REPEATING_CHANGE || !edit.is_main || CURSOR_KEY_PASS > 0 {
+		return
+	}
+
+	if isCommandIdle(edit) {
+		CHANGE_KEYS = []*tcell.EventKey{}
+		CHANGE_MADE = false
+	}
+}
+
+// called after each key of the main edit is handled, before the undo history takes the changes
+func endChangeKey(ev *tcell.EventKey, edit *Edit) {
+	if REPEATING_CHANGE || !edit.is_main || CURSOR_KEY_PASS > 0 {
+		return
+	}
+
+	if CHANGE_REPEATED {
+		CHANGE_REPEATED = false
+		CHANGE_KEYS = []*tcell.EventKey{}
+		return
+	}
+
+	CHANGE_KEYS = append(CHANGE_KEYS, ev)
+	if len(edit.buffer.journal) > 0 {
+		CHANGE_MADE = true
+	}
+
+	if isCommandIdle(edit) {
+		if CHANGE_MADE {
+			LAST_CHANGE = CHANGE_KEYS
+		}
+		CHANGE_KEYS = []*tcell.EventKey{}
+		CHANGE_MADE = false
+	}
+}
+
+// plays the last change again at the cursor, with count in place of its own if there is one
+func repeatLastChange(edit *Edit, count string) {
+	CHANGE_REPEATED = true
+	if len(LAST_CHANGE) == 0 {
+		failMacro()
+		return
+	}
+
+	keys := LAST_CHANGE
+	if count != "" {
+		for len(keys) > 0 && keys[0].Key() == tcell.KeyRune && unicode.IsDigit(keys[0].Rune()) {
+			keys = keys[1:]
+		}
+
+		counted := []*tcell.EventKey{}
+		for _, digit := range(count) {
+			counted = append(counted, tcell.NewEventKey(tcell.KeyRune, digit, tcell.ModNone))
+		}
+		keys = append(counted, keys...)
+		LAST_CHANGE = keys // the new count sticks for the next .
+	}
+
+	REPEATING_CHANGE = true
+	UNDO_GROUP_HELD = true
+
+	for _, ev := range(keys) {
+		editHandleKey(ev, edit)
+	}
+
+	REPEATING_CHANGE = false
+	UNDO_GROUP_HELD = false
+	closeUndoGroup(edit)
+}
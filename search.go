@@ -0,0 +1,630 @@
+package main
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Find and replace. The text in the find box is looked for in the whole
+// buffer at once, so a match can run across lines (a line break in the find
+// box, or \n in a pattern).
+//
+// With FIND_REGEX on (Alt+R in the find panel) the find text is a regular
+// expression written the Go way ((\w+) not \(\w\+\), ^ and $ at the ends of
+// lines) and the replacement can put in what its groups matched with $1 or
+// ${name}, $$ for a $ itself. Otherwise both are plain text. A pattern that
+// doesn't compile shows why in the outline of the find box.
+//
+// The other options sit at the right of that outline, click one or use its
+// key to switch it: Alt+C matches case (it is ignored otherwise), Alt+W only
+// takes matches that are whole words, Alt+P gives a replacement the case of
+// what it replaces (foo -> bar, Foo -> Bar, FOO -> BAR) and Alt+L only looks
+// in what was selected when find was opened.
+//
+// Alt+Enter replaces every match the options let through at once.
+
+var FIND_REGEX bool
+var FIND_MATCH_CASE bool
+var FIND_WHOLE_WORD bool
+var FIND_PRESERVE_CASE bool
+var FIND_IN_SELECTION bool
+var FIND_ERROR string // what is wrong with the pattern in the find box, "" when nothing is
+
+// the selection when find was opened, as offsets in the main buffer. Empty
+// when nothing was selected.
+var FIND_SCOPE_START int
+var FIND_SCOPE_END int
+
+type FindOption struct {
+	label string
+	on *bool
+	toggle func()
+}
+
+func getFindOptions() []FindOption {
+	return []FindOption{
+		{"case", &FIND_MATCH_CASE, toggleFindMatchCase},
+		{"word", &FIND_WHOLE_WORD, toggleFindWholeWord},
+		{"regex", &FIND_REGEX, toggleFindRegex},
+		{"keep case", &FIND_PRESERVE_CASE, toggleFindPreserveCase},
+		{"selection", &FIND_IN_SELECTION, toggleFindInSelection},
+	}
+}
+
+// the pattern for the find box, false when it is empty or doesn't compile
+func getFindPattern() (*regexp.Regexp, bool) {
+	text := getPlainText(&FIND_TEXTEDIT)
+	FIND_ERROR = ""
+	if text == "" {
+		return nil, false
+	}
+
+	if !FIND_REGEX {
+		text = regexp.QuoteMeta(text)
+	}
+
+	flags := "(?m)"
+	if !FIND_MATCH_CASE {
+		flags = "(?im)"
+	}
+
+	re, err := regexp.Compile(flags+text)
+	if err != nil {
+		FIND_ERROR = describePatternError(err, text)
+		return nil, false
+	}
+	return re, true
+}
+
+func describePatternError(err error, text string) string {
+	syntax_err, ok := err.(*syntax.Error)
+	if !ok {
+		return err.Error()
+	}
+
+	expr := syntax_err.Expr
+	for _, flags := range([]string{"(?im)", "(?m)", "(?i)"}) { // the flags put in front, which weren't typed
+		expr = strings.TrimPrefix(expr, flags)
+	}
+	if expr == "" || expr == text {
+		return string(syntax_err.Code)
+	}
+	return string(syntax_err.Code)+": "+expr
+}
+
+// what a search looks for and in which text, everything that decides its
+// matches. Two searches that are == find the same ones.
+type FindSearch struct {
+	pattern string // with its flags
+	whole_word bool
+	in_selection bool
+	scope_start int
+	scope_end int
+
+	buffer *TextBuffer
+	version int
+}
+
+func getFindSearch(re *regexp.Regexp) FindSearch {
+	edit := &MAIN_TEXTEDIT
+	return FindSearch{re.String(), FIND_WHOLE_WORD, FIND_IN_SELECTION, FIND_SCOPE_START, FIND_SCOPE_END, edit.buffer, edit.buffer.version}
+}
+
+// every match of the main buffer the options let through, the ones found as
+// you typed when they are still right
+func getFindMatches(re *regexp.Regexp) [][]int {
+	search := getFindSearch(re)
+	if search == FIND_MATCHES_OF {
+		return FIND_MATCHES
+	}
+	return searchText(re, MAIN_TEXTEDIT.buffer.text(), search)
+}
+
+// every match in text search lets through. Each match is the start and end
+// of it then of each group, like FindStringSubmatchIndex. It only reads what
+// it is given so it can run on any goroutine.
+func searchText(re *regexp.Regexp, text string, search FindSearch) [][]int {
+	matches := [][]int{}
+	for _, match := range(re.FindAllStringSubmatchIndex(text, -1)) {
+		if match[0] == match[1] {
+			continue // an empty match can't be selected or seen
+		}
+		if search.in_selection && (match[0] < search.scope_start || match[1] > search.scope_end) {
+			continue
+		}
+		if search.whole_word && !isWholeWord(text, match[0], match[1]) {
+			continue
+		}
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+// whether text[start:end] doesn't run on into a word on either side
+func isWholeWord(text string, start, end int) bool {
+	before, _ := utf8.DecodeLastRuneInString(text[:start])
+	after, _ := utf8.DecodeRuneInString(text[end:])
+	first, _ := utf8.DecodeRuneInString(text[start:end])
+	last, _ := utf8.DecodeLastRuneInString(text[start:end])
+
+	if start > 0 && isWordRune(before) && isWordRune(first) {
+		return false
+	}
+	if end < len(text) && isWordRune(after) && isWordRune(last) {
+		return false
+	}
+	return true
+}
+
+func isWordRune(char rune) bool {
+	return char != '\n' && getCharType(char) == NORMAL_CHAR_TYPE
+}
+
+// the first match starting at or after from, or backwards the last one
+// starting before it, going around the end of the text
+func findNextMatch(matches [][]int, from int, backwards bool) ([]int, bool) {
+	if len(matches) == 0 {
+		return nil, false
+	}
+
+	if backwards {
+		for indx := len(matches)-1; indx >= 0; indx-- {
+			if matches[indx][0] < from {
+				return matches[indx], true
+			}
+		}
+		return matches[len(matches)-1], true
+	}
+
+	for _, match := range(matches) {
+		if match[0] >= from {
+			return match, true
+		}
+	}
+	return matches[0], true
+}
+
+// the offsets the selection of edit starts and ends at
+func getSelectionOffsets(edit *Edit) (int, int) {
+	start := edit.buffer.offset(edit.cursor.row_anchor, edit.cursor.col_anchor)
+	end := edit.buffer.offset(edit.cursor.row, edit.cursor.col)
+	return min(start, end), max(start, end)
+}
+
+func selectOffsets(edit *Edit, start, end int) {
+	sr, sc := edit.buffer.position(start)
+	er, ec := edit.buffer.position(end)
+	edit.cursor = Cursor{row: er, col: ec, row_anchor: sr, col_anchor: sc, preferencial_col: getTrueCol(ec, er, edit)}
+}
+
+func runFind(backwards bool) {
+	re, ok := getFindPattern()
+	if !ok {
+		failMacro()
+		return
+	}
+
+	edit := &MAIN_TEXTEDIT
+	start, _ := getSelectionOffsets(edit)
+	from := start+1 // past the match that is selected now
+	if backwards {
+		from = start
+	}
+
+	findMatchFrom(re, from, backwards)
+}
+
+// selects the next match from the offset from, see findNextMatch
+func findMatchFrom(re *regexp.Regexp, from int, backwards bool) {
+	edit := &MAIN_TEXTEDIT
+
+	match, found := findNextMatch(getFindMatches(re), from, backwards)
+	if !found {
+		failMacro() // nothing found anywhere
+		return
+	}
+
+	FIND_FROM = match[0]
+	FIND_ACCEPTED = true
+
+	recordJump()
+	selectOffsets(edit, match[0], match[1])
+	showCursor(edit)
+}
+
+// what replaces match, with the groups put in for a regular expression
+func expandReplacement(re *regexp.Regexp, text string, match []int) string {
+	replacement := getPlainText(&REPLACE_TEXTEDIT)
+	if FIND_REGEX {
+		replacement = string(re.ExpandString(nil, replacement, text, match))
+	}
+	if FIND_PRESERVE_CASE {
+		replacement = matchCase(text[match[0]:match[1]], replacement)
+	}
+	return replacement
+}
+
+// replacement in the case of matched: all upper, all lower or capitalized.
+// Anything mixed leaves it as it is.
+func matchCase(matched, replacement string) string {
+	if strings.ToUpper(matched) == strings.ToLower(matched) {
+		return replacement // no letters to go by
+	}
+
+	first := strings.IndexFunc(matched, unicode.IsLetter)
+	letter, size := utf8.DecodeRuneInString(matched[first:])
+	rest := matched[first+size:]
+
+	if matched == strings.ToUpper(matched) && strings.ToUpper(rest) != strings.ToLower(rest) {
+		return strings.ToUpper(replacement)
+	}else if matched == strings.ToLower(matched) {
+		return strings.ToLower(replacement)
+	}else if unicode.IsUpper(letter) && rest == strings.ToLower(rest) {
+		start := strings.IndexFunc(replacement, unicode.IsLetter)
+		if start < 0 {
+			return replacement
+		}
+		r, size := utf8.DecodeRuneInString(replacement[start:])
+		return replacement[:start]+string(unicode.ToUpper(r))+replacement[start+size:]
+	}
+	return replacement
+}
+
+// replaces the selection if it is a match, then finds the next one
+func runReplace(backwards bool) {
+	re, ok := getFindPattern()
+	if !ok {
+		failMacro()
+		return
+	}
+
+	edit := &MAIN_TEXTEDIT
+	text := edit.buffer.text()
+	start, end := getSelectionOffsets(edit)
+
+	var selected []int
+	for _, match := range(getFindMatches(re)) {
+		if match[0] == start && match[1] == end {
+			selected = match
+			break
+		}
+	}
+
+	if selected == nil {
+		runFind(backwards)
+		return
+	}
+
+	closeUndoGroup(edit) // a replace is always its own undo step
+	FIND_ACCEPTED = true
+
+	replacement := expandReplacement(re, text, selected)
+	selectOffsets(edit, start, end)
+	insertText(edit, replacement)
+
+	closeUndoGroup(edit)
+
+	if FIND_SCOPE_END > FIND_SCOPE_START && start >= FIND_SCOPE_START && end <= FIND_SCOPE_END {
+		FIND_SCOPE_END += len(replacement)-(end-start) // the selection grows or shrinks with it
+	}
+
+	if backwards {
+		findMatchFrom(re, start, true)
+	}else{
+		findMatchFrom(re, start+len(replacement), false)
+	}
+	showCursor(edit)
+}
+
+// replaces every match at once, in what was selected when find was opened
+// if that option is on. It is undone in one step.
+func runReplaceAll() {
+	re, ok := getFindPattern()
+	if !ok {
+		failMacro()
+		return
+	}
+
+	edit := &MAIN_TEXTEDIT
+	text := edit.buffer.text()
+	matches := getFindMatches(re)
+	if len(matches) == 0 {
+		commandError("Nothing to replace")
+		return
+	}
+
+	replacements := make([]string, len(matches))
+	for indx, match := range(matches) {
+		replacements[indx] = expandReplacement(re, text, match) // from the text as it was, before any are replaced
+	}
+
+	cursor, _ := getSelectionOffsets(edit)
+	clearExtraCursors(edit)
+	closeUndoGroup(edit)
+
+	// from the end back, so the matches before each one haven't moved yet
+	grown := 0
+	for indx := len(matches)-1; indx >= 0; indx-- {
+		start, end := matches[indx][0], matches[indx][1]
+		sr, sc := edit.buffer.position(start)
+		er, ec := edit.buffer.position(end)
+		edit.buffer.remove(sr, sc, er, ec)
+		edit.buffer.insert(sr, sc, replacements[indx])
+
+		change := len(replacements[indx])-(end-start)
+		grown += change
+		if end <= cursor {
+			cursor += change // the cursor stays on the same text
+		}else if start < cursor {
+			cursor = start // it was inside this match
+		}
+	}
+
+	closeUndoGroup(edit)
+
+	if FIND_IN_SELECTION {
+		FIND_SCOPE_END += grown
+	}
+
+	FIND_FROM = cursor
+	FIND_ACCEPTED = true
+
+	selectOffsets(edit, cursor, cursor)
+	showCursor(edit)
+	commandMessage("Replaced "+pluralize(len(matches), "occurrence"))
+}
+
+// remembers the selection of the main edit for searching in it, called as
+// find opens
+func setFindScope() {
+	edit := &MAIN_TEXTEDIT
+	FIND_SCOPE_START, FIND_SCOPE_END = 0, 0
+
+	if hasSelection(edit) || edit.visual_mode != "" {
+		sr, sc, er, ec := getSelectionRange(edit)
+		FIND_SCOPE_START = edit.buffer.offset(sr, sc)
+		FIND_SCOPE_END = edit.buffer.offset(er, ec)
+	}
+
+	// a selection over several lines is what to look in, not what to look for
+	FIND_IN_SELECTION = strings.Contains(edit.buffer.slice(FIND_SCOPE_START, FIND_SCOPE_END), "\n")
+}
+
+func toggleFindRegex() {
+	FIND_REGEX = !FIND_REGEX
+	getFindPattern()
+}
+
+func toggleFindMatchCase() {
+	FIND_MATCH_CASE = !FIND_MATCH_CASE
+	getFindPattern()
+}
+
+func toggleFindWholeWord() {
+	FIND_WHOLE_WORD = !FIND_WHOLE_WORD
+}
+
+func toggleFindPreserveCase() {
+	FIND_PRESERVE_CASE = !FIND_PRESERVE_CASE
+}
+
+func toggleFindInSelection() {
+	if !FIND_IN_SELECTION && FIND_SCOPE_END <= FIND_SCOPE_START {
+		commandError("Nothing was selected when find was opened")
+		return
+	}
+	FIND_IN_SELECTION = !FIND_IN_SELECTION
+}
+
+// where each option is drawn in the outline above edit, right aligned
+func getOptionColumns(edit *Edit, options []FindOption) []int {
+	columns := make([]int, len(options))
+
+	x := edit.col+edit.width+2
+	for indx := len(options)-1; indx >= 0; indx-- {
+		x -= len(options[indx].label)+3 // a space each side of it and one between
+		columns[indx] = x
+	}
+	return columns
+}
+
+func drawOptions(edit *Edit, options []FindOption) {
+	columns := getOptionColumns(edit, options)
+	for indx, option := range(options) {
+		style := LINE_NUMBER_STYLE
+		if *option.on {
+			style = INVERTED_STYLE
+		}
+		emitStr(columns[indx], edit.row-1, style, " "+option.label+" ")
+	}
+}
+
+// switches the option clicked on, false when the click wasn't on one
+func optionsHandleMouse(edit *Edit, options []FindOption, x, y int) bool {
+	if y != edit.row-1 {
+		return false
+	}
+
+	columns := getOptionColumns(edit, options)
+	for indx, option := range(options) {
+		if x >= columns[indx] && x < columns[indx]+len(option.label)+2 {
+			option.toggle()
+			return true
+		}
+	}
+	return false
+}
+
+// the label in the outline of the find box, with what is wrong with the
+// pattern or how many matches it has
+func getFindLabel() string {
+	label := "Find Text"
+	if FIND_ERROR != "" {
+		return label+" - "+FIND_ERROR
+	}else if FIND_SEARCHED.pattern == "" {
+		return label
+	}else if FIND_SEARCHED != FIND_MATCHES_OF {
+		return label+" - searching"
+	}else if len(FIND_MATCHES) == 0 {
+		return label+" - no matches"
+	}
+
+	total := strconv.Itoa(len(FIND_MATCHES))
+	if current := getCurrentMatch(); current != -1 {
+		return label+" - match "+strconv.Itoa(current+1)+" of "+total
+	}else if len(FIND_MATCHES) == 1 {
+		return label+" - 1 match"
+	}
+	return label+" - "+total+" matches"
+}
+
+// Searching as you type. Every change to the find box or its options (or to
+// the text) searches the main buffer again, moves the cursor to the nearest
+// match after where it was and highlights the matches on screen. A text of
+// FIND_ASYNC_SIZE or more is searched on its own goroutine so typing doesn't
+// wait on it, the result comes back through runOnUI (which waits for room in
+// the event queue, so the label can't be left on searching). Closing find
+// without going to a match with Enter or replacing one puts the cursor back.
+
+var FIND_ASYNC_SIZE = 256*1024
+
+var FIND_SEARCHED FindSearch // the last search started
+var FIND_MATCHES_OF FindSearch // the search FIND_MATCHES came from, != FIND_SEARCHED while one is running
+var FIND_MATCHES [][]int
+var FIND_GENERATION int // bumped on every search so one that was overtaken is thrown away
+
+var FIND_START_CURSOR Cursor // the main cursor as find was opened
+var FIND_START_TOPROW int
+var FIND_START_BUFFER *TextBuffer
+var FIND_FROM int // the offset typing looks for the nearest match from
+var FIND_ACCEPTED bool // a match was gone to with Enter or replaced, so closing find stays there
+
+// called as find opens
+func startFindSession() {
+	edit := &MAIN_TEXTEDIT
+	FIND_START_CURSOR = edit.cursor
+	FIND_START_TOPROW = edit.toprow
+	FIND_START_BUFFER = edit.buffer
+	FIND_FROM, _ = getSelectionOffsets(edit)
+	FIND_ACCEPTED = false
+	clearFindMatches()
+}
+
+// called as find closes
+func endFindSession() {
+	clearFindMatches()
+	returnToFindStart()
+}
+
+func clearFindMatches() {
+	FIND_GENERATION ++
+	FIND_SEARCHED = FindSearch{}
+	FIND_MATCHES_OF = FindSearch{}
+	FIND_MATCHES = nil
+}
+
+// puts the cursor back where it was as find opened, unless a match was taken
+func returnToFindStart() {
+	edit := &MAIN_TEXTEDIT
+	if FIND_ACCEPTED || edit.buffer != FIND_START_BUFFER {
+		return
+	}
+
+	edit.cursor = FIND_START_CURSOR
+	edit.toprow = FIND_START_TOPROW
+}
+
+// searches again if the find box, its options or the text changed since the
+// last search, called after every key and click while find is open
+func searchAsYouType() {
+	re, ok := getFindPattern()
+	if !ok {
+		if FIND_SEARCHED != (FindSearch{}) {
+			clearFindMatches()
+			returnToFindStart()
+		}
+		return
+	}
+
+	search := getFindSearch(re)
+	if search == FIND_SEARCHED {
+		return
+	}
+
+	// only the text changing (a replace) doesn't move the cursor
+	last := FIND_SEARCHED
+	last.buffer, last.version = search.buffer, search.version
+	moving := search != last
+
+	FIND_SEARCHED = search
+	FIND_GENERATION ++
+	generation := FIND_GENERATION
+	text := MAIN_TEXTEDIT.buffer.text()
+
+	if len(text) < FIND_ASYNC_SIZE {
+		finishFindSearch(search, searchText(re, text, search), moving)
+		return
+	}
+
+	go func() {
+		matches := searchText(re, text, search)
+		runOnUI(func() {
+			if generation == FIND_GENERATION {
+				finishFindSearch(search, matches, moving)
+			}
+		})
+	}()
+}
+
+func finishFindSearch(search FindSearch, matches [][]int, moving bool) {
+	FIND_MATCHES_OF = search
+	FIND_MATCHES = matches
+
+	if !moving || search.buffer != MAIN_TEXTEDIT.buffer {
+		return
+	}
+
+	match, found := findNextMatch(matches, FIND_FROM, false)
+	if !found {
+		returnToFindStart()
+		return
+	}
+
+	edit := &MAIN_TEXTEDIT
+	selectOffsets(edit, match[0], match[1])
+	showCursor(edit)
+}
+
+// which of FIND_MATCHES is selected in the main edit, -1 when none is
+func getCurrentMatch() int {
+	start, end := getSelectionOffsets(&MAIN_TEXTEDIT)
+	indx := sort.Search(len(FIND_MATCHES), func(i int) bool { return FIND_MATCHES[i][0] >= start })
+
+	if indx < len(FIND_MATCHES) && FIND_MATCHES[indx][0] == start && FIND_MATCHES[indx][1] == end {
+		return indx
+	}
+	return -1
+}
+
+// the byte columns (start and end) of the matches on row of edit, to be
+// highlighted. Nothing when they are out of date.
+func getMatchColumns(edit *Edit, row int) [][2]int {
+	if !SHOWING_FIND || edit.buffer != FIND_MATCHES_OF.buffer || edit.buffer.version != FIND_MATCHES_OF.version {
+		return nil
+	}
+
+	start := edit.buffer.lineStart(row)
+	end := start+edit.buffer.lineLen(row)
+
+	columns := [][2]int{}
+	indx := sort.Search(len(FIND_MATCHES), func(i int) bool { return FIND_MATCHES[i][1] > start })
+	for ; indx < len(FIND_MATCHES) && FIND_MATCHES[indx][0] < end; indx++ {
+		columns = append(columns, [2]int{max(FIND_MATCHES[indx][0], start)-start, min(FIND_MATCHES[indx][1], end)-start})
+	}
+	return columns
+}
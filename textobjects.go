@@ -0,0 +1,467 @@
+package main
+
+import (
+	"strings"
+)
+
+// Text objects pick out a piece of text around the cursor rather than
+// moving it: i{object} is the inside of it and a{object} takes the
+// surroundings too. They follow an operator (diw, ca", yi{, >ip) or, with
+// a selection already showing, replace it with the object.
+//
+//	w  word             s  sentence         p  paragraph
+//	" ' `  quoted text  ( ) b  [ ]  { } B  < >  brackets
+//	i  lines at the same indentation or deeper (ai also takes the line above)
+
+type TextObject struct {
+	sr int
+	sc int
+	er int // the end is just past the last character
+	ec int
+	linewise bool
+}
+
+func getTextObject(edit *Edit, around bool, key rune, count int) (TextObject, bool) {
+	switch key {
+	case 'w':
+		return getWordObject(edit, around, count)
+	case 's':
+		return getSentenceObject(edit, around)
+	case 'p':
+		return getParagraphObject(edit, around, count)
+	case '"', '\'', '`':
+		return getQuoteObject(edit, around, byte(key))
+	case '(', ')', 'b':
+		return getBracketObject(edit, around, '(', ')', count)
+	case '[', ']':
+		return getBracketObject(edit, around, '[', ']', count)
+	case '{', '}', 'B':
+		return getBracketObject(edit, around, '{', '}', count)
+	case '<', '>':
+		return getBracketObject(edit, around, '<', '>', count)
+	case 'i':
+		return getIndentObject(edit, around)
+	}
+
+	return TextObject{}, false
+}
+
+// iw is a run of characters of the same type (word, punctuation or
+// whitespace), aw adds the whitespace after it, or before it at the end of a line
+func getWordObject(edit *Edit, around bool, count int) (TextObject, bool) {
+	row := edit.cursor.row
+	line := edit.buffer.line(row)
+	if len(line) == 0 {
+		return TextObject{}, false
+	}
+
+	col := min(edit.cursor.col, prevGrapheme(line, len(line)))
+
+	// back to the start of the run the cursor is in
+	typ := getCharTypeAt(edit, row, col)
+	start := col
+	for start > 0 && getCharTypeAt(edit, row, prevGrapheme(line, start)) == typ {
+		start = prevGrapheme(line, start)
+	}
+
+	end := col
+	for indx := range(count) {
+		run_type := getCharTypeAt(edit, row, end)
+		for end < len(line) && getCharTypeAt(edit, row, end) == run_type {
+			end = nextGrapheme(line, end)
+		}
+
+		if around && run_type != WHITESPACE_CHAR_TYPE && indx == count-1 {
+			trailing := end
+			for trailing < len(line) && getCharTypeAt(edit, row, trailing) == WHITESPACE_CHAR_TYPE {
+				trailing = nextGrapheme(line, trailing)
+			}
+
+			if trailing > end {
+				end = trailing
+			}else{
+				for start > 0 && getCharTypeAt(edit, row, prevGrapheme(line, start)) == WHITESPACE_CHAR_TYPE {
+					start = prevGrapheme(line, start)
+				}
+			}
+		}
+
+		if end >= len(line) {
+			break
+		}
+	}
+
+	return TextObject{row, start, row, end, false}, true
+}
+
+func isBlankLine(edit *Edit, row int) bool {
+	return strings.TrimLeft(edit.buffer.line(row), WHITESPACE) == ""
+}
+
+// ip is the block of lines the cursor is in, all blank or all not, ap adds the blank lines after it
+func getParagraphObject(edit *Edit, around bool, count int) (TextObject, bool) {
+	last := edit.buffer.lineCount()-1
+	start := edit.cursor.row
+	blank := isBlankLine(edit, start)
+
+	for start > 0 && isBlankLine(edit, start-1) == blank {
+		start --
+	}
+
+	end := edit.cursor.row
+	for indx := range(count) {
+		if indx > 0 {
+			if end == last {
+				break
+			}
+			end ++
+		}
+
+		block_blank := isBlankLine(edit, end)
+		for end < last && isBlankLine(edit, end+1) == block_blank {
+			end ++
+		}
+
+		if around && !block_blank && indx == count-1 {
+			if end < last && isBlankLine(edit, end+1) {
+				for end < last && isBlankLine(edit, end+1) {
+					end ++
+				}
+			}else{
+				for start > 0 && isBlankLine(edit, start-1) {
+					start --
+				}
+			}
+		}
+	}
+
+	return TextObject{start, 0, end, edit.buffer.lineLen(end), true}, true
+}
+
+func isSentenceEnd(text string, indx int) bool {
+	if !strings.ContainsRune(".!?", rune(text[indx])) {
+		return false
+	}
+
+	next := indx+1
+	for next < len(text) && strings.ContainsRune(")]\"'", rune(text[next])) {
+		next ++
+	}
+
+	return next >= len(text) || strings.ContainsRune(" \t\n", rune(text[next]))
+}
+
+// is runs from the start of the sentence to its . ! or ?, as adds the whitespace after it.
+// Sentences don't go past the paragraph they are in.
+func getSentenceObject(edit *Edit, around bool) (TextObject, bool) {
+	if isBlankLine(edit, edit.cursor.row) {
+		return TextObject{}, false
+	}
+
+	para, _ := getParagraphObject(edit, false, 1)
+	base := edit.buffer.offset(para.sr, 0)
+	text := edit.buffer.textRange(para.sr, 0, para.er, para.ec)
+	cursor := edit.buffer.offset(edit.cursor.row, edit.cursor.col)-base
+
+	// the sentence starts after the last end before the cursor, past any whitespace
+	start := 0
+	for indx := 0; indx < cursor && indx < len(text); indx++ {
+		if isSentenceEnd(text, indx) {
+			start = indx+1
+		}
+	}
+	for start < len(text) && strings.ContainsRune(")]\"'", rune(text[start])) {
+		start ++
+	}
+	for start < len(text) && strings.ContainsRune(" \t\n", rune(text[start])) {
+		start ++
+	}
+
+	end := len(text)
+	for indx := max(start, 0); indx < len(text); indx++ {
+		if isSentenceEnd(text, indx) {
+			end = indx+1
+			for end < len(text) && strings.ContainsRune(")]\"'", rune(text[end])) {
+				end ++
+			}
+			break
+		}
+	}
+
+	if around {
+		trailing := end
+		for trailing < len(text) && strings.ContainsRune(" \t\n", rune(text[trailing])) {
+			trailing ++
+		}
+
+		if trailing > end {
+			end = trailing
+		}else{
+			for start > 0 && strings.ContainsRune(" \t", rune(text[start-1])) {
+				start --
+			}
+		}
+	}
+
+	sr, sc := edit.buffer.position(base+start)
+	er, ec := edit.buffer.position(base+end)
+	return TextObject{sr, sc, er, ec, false}, true
+}
+
+// i" is the text between the quotes around the cursor on its line, a" takes in the
+// quotes and the whitespace after them, or before them when there is none after.
+// Quotes escaped with a backslash don't count.
+func getQuoteObject(edit *Edit, around bool, quote byte) (TextObject, bool) {
+	row := edit.cursor.row
+	line := edit.buffer.line(row)
+	col := edit.cursor.col
+
+	quotes := []int{}
+	for indx := 0; indx < len(line); indx++ {
+		if line[indx] == '\\' {
+			indx ++
+			continue
+		}
+		if line[indx] == quote {
+			quotes = append(quotes, indx)
+		}
+	}
+
+	// the pair the cursor is in or on, otherwise the first pair after it
+	open, close := -1, -1
+	for indx := 0; indx+1 < len(quotes); indx += 2 {
+		if col <= quotes[indx+1] {
+			open, close = quotes[indx], quotes[indx+1]
+			break
+		}
+	}
+	if open == -1 {
+		return TextObject{}, false
+	}
+
+	if !around {
+		return TextObject{row, open+1, row, close, false}, true
+	}
+
+	start, end := open, close+1
+	for end < len(line) && strings.ContainsRune(" \t", rune(line[end])) {
+		end ++
+	}
+	if end == close+1 {
+		for start > 0 && strings.ContainsRune(" \t", rune(line[start-1])) {
+			start --
+		}
+	}
+
+	return TextObject{row, start, row, end, false}, true
+}
+
+// the quoted strings on line as the columns of their opening and closing
+// quotes. A ' after a letter or digit is an apostrophe (don't), not a quote.
+func getQuotedSpans(line string) [][2]int {
+	spans := [][2]int{}
+	open := -1
+
+	for indx := 0; indx < len(line); indx++ {
+		char := line[indx]
+		if char == '\\' {
+			indx ++
+			continue
+		}
+		if char != '"' && char != '\'' && char != '`' {
+			continue
+		}
+
+		if open == -1 {
+			if char == '\'' && indx > 0 && getCharType(rune(line[indx-1])) == NORMAL_CHAR_TYPE {
+				continue
+			}
+			open = indx
+		}else if line[open] == char {
+			spans = append(spans, [2]int{open, indx})
+			open = -1
+		}
+	}
+
+	return spans
+}
+
+// true if col is in one of spans other than the one the cursor is in, so a
+// bracket there is part of a string and not of the code around it
+func isInOtherString(spans [][2]int, col, cursor_col int) bool {
+	for _, span := range(spans) {
+		if col >= span[0] && col <= span[1] {
+			return cursor_col < span[0] || cursor_col > span[1]
+		}
+	}
+	return false
+}
+
+// i( is the text between the count-th enclosing pair of brackets, a( takes in the
+// brackets. When the brackets sit on lines of their own the inside is the whole lines between.
+// Brackets in strings on the same line as them are left out, unless the cursor is in that string.
+func getBracketObject(edit *Edit, around bool, open, close byte, count int) (TextObject, bool) {
+	row := edit.cursor.row
+	line := edit.buffer.line(row)
+
+	start := edit.cursor.col // on the closing bracket, looking back from before it finds the pair it closes
+	if start < len(line) && line[start] == open {
+		start ++ // on the opening bracket, the pair is the one it opens
+	}
+
+	open_row, open_col := -1, -1
+	depth := 0
+	for r := row; r >= 0 && open_row == -1; r-- {
+		if r != row {
+			line = edit.buffer.line(r)
+			start = len(line)
+		}
+		spans := getQuotedSpans(line)
+		cursor_col := -1 // no string holds the cursor off its row
+		if r == edit.cursor.row {
+			cursor_col = edit.cursor.col
+		}
+
+		for indx := start-1; indx >= 0; indx-- {
+			if (line[indx] != open && line[indx] != close) || isInOtherString(spans, indx, cursor_col) {
+				continue
+			}
+
+			if line[indx] == close {
+				depth ++
+			}else if depth > 0 {
+				depth --
+			}else{
+				count --
+				if count == 0 {
+					open_row, open_col = r, indx
+					break
+				}
+			}
+		}
+	}
+	if open_row == -1 {
+		return TextObject{}, false
+	}
+
+	close_row, close_col := -1, -1
+	depth = 0
+	for r := open_row; r < edit.buffer.lineCount() && close_row == -1; r++ {
+		line = edit.buffer.line(r)
+		spans := getQuotedSpans(line)
+		cursor_col := -1
+		if r == edit.cursor.row {
+			cursor_col = edit.cursor.col
+		}
+
+		from := 0
+		if r == open_row {
+			from = open_col+1
+		}
+
+		for indx := from; indx < len(line); indx++ {
+			if (line[indx] != open && line[indx] != close) || isInOtherString(spans, indx, cursor_col) {
+				continue
+			}
+
+			if line[indx] == open {
+				depth ++
+			}else if depth > 0 {
+				depth --
+			}else{
+				close_row, close_col = r, indx
+				break
+			}
+		}
+	}
+	if close_row == -1 {
+		return TextObject{}, false
+	}
+
+	if around {
+		return TextObject{open_row, open_col, close_row, close_col+1, false}, true
+	}
+
+	sr, sc := open_row, open_col+1
+	er, ec := close_row, close_col
+	own_lines := 0
+
+	if close_row > open_row && strings.TrimLeft(edit.buffer.line(open_row)[sc:], WHITESPACE) == "" {
+		sr, sc = open_row+1, 0
+		own_lines ++
+	}
+	if close_row > sr && strings.TrimLeft(edit.buffer.line(close_row)[:close_col], WHITESPACE) == "" {
+		er, ec = close_row-1, edit.buffer.lineLen(close_row-1)
+		own_lines ++
+	}
+
+	return TextObject{sr, sc, er, ec, own_lines == 2}, true
+}
+
+func getIndentWidth(edit *Edit, row int) int {
+	return getTrueCol(getFirstNonBlank(edit, row), row, edit)
+}
+
+// ii is the lines around the cursor indented at least as far as its line, with
+// the blank lines among them, ai also takes the line above that opens the block
+func getIndentObject(edit *Edit, around bool) (TextObject, bool) {
+	last := edit.buffer.lineCount()-1
+	row := edit.cursor.row
+
+	for row < last && isBlankLine(edit, row) {
+		row ++
+	}
+	width := getIndentWidth(edit, row)
+
+	in_block := func(row int) bool {
+		return isBlankLine(edit, row) || getIndentWidth(edit, row) >= width
+	}
+
+	start := row
+	for start > 0 && in_block(start-1) {
+		start --
+	}
+	end := row
+	for end < last && in_block(end+1) {
+		end ++
+	}
+
+	// blank lines on the edges belong to whatever is around the block
+	for start < end && isBlankLine(edit, start) {
+		start ++
+	}
+	for end > start && isBlankLine(edit, end) {
+		end --
+	}
+
+	if around && start > 0 {
+		start --
+	}
+
+	return TextObject{start, 0, end, edit.buffer.lineLen(end), true}, true
+}
+
+// makes the object the selection, the cursor going on its end
+func selectTextObject(edit *Edit, object TextObject) {
+	edit.cursor.row_anchor = object.sr
+	edit.cursor.col_anchor = object.sc
+	edit.cursor.row = object.er
+	edit.cursor.col = object.ec
+
+	if object.linewise && edit.visual_mode != "" {
+		edit.visual_mode = "V"
+	}else if object.linewise {
+		edit.cursor.col_anchor = 0
+		edit.cursor.col = edit.buffer.lineLen(object.er)
+	}else if edit.visual_mode != "" { // visual selections end on their last character rather than after it
+		edit.visual_mode = "v"
+		if object.ec > 0 {
+			edit.cursor.col = prevGrapheme(edit.buffer.line(object.er), object.ec)
+		}else if object.er > object.sr {
+			edit.cursor.row --
+			edit.cursor.col = edit.buffer.lineLen(edit.cursor.row)
+		}
+	}
+
+	edit.cursor.preferencial_col = getTrueCol(edit.cursor.col, edit.cursor.row, edit)
+}
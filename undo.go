@@ -0,0 +1,432 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Undo history is made of the insert/delete operations recorded in each
+// TextBuffer's journal rather than copies of the text. After every key
+// readyUndoHistory moves the journal into the open UndoStep, and the step is
+// closed when the edit session ends: leaving insert mode, moving the cursor
+// without typing, or a command (like replace) that closes it itself.
+//
+// Closed steps are kept as a tree. Typing after an undo starts a new branch
+// instead of throwing the redo away, every node remembers when it was made so
+// the history can be walked by time, and undo_nodes keeps them in the order
+// they were made for stepping through every state across branches.
+
+type UndoStep struct {
+	ops []EditOp
+	cursor_before Cursor
+	cursor_after Cursor
+	extra_before []Cursor // the other cursors, when there were more
+	extra_after []Cursor
+	time_taken int64
+	size int
+}
+
+type UndoNode struct {
+	step UndoStep // what turns the parent's text into this node's
+	parent *UndoNode
+	children []*UndoNode
+	redo_child *UndoNode // the branch redo follows, the newest one unless another was visited
+	seq int
+}
+
+var UNDO_MEMORY_LIMIT_KB int = 65536
+var UNDO_OP_OVERHEAD = 48 // rough bytes per recorded op on top of its text
+var UNDO_GROUP_HELD bool // keeps the open step from closing between keys, for keys replayed as one change
+
+func addUndoOp(step *UndoStep, op EditOp) {
+	if len(step.ops) > 0 {
+		last := &step.ops[len(step.ops)-1]
+
+		if last.insert && op.insert && op.offset == last.offset+len(last.text) { // typing
+			last.text += op.text
+			return
+		}else if last.insert && !op.insert && op.offset >= last.offset && op.offset+len(op.text) == last.offset+len(last.text) { // backspacing what was just typed
+			last.text = last.text[:op.offset-last.offset]
+			if last.text == "" {
+				step.ops = step.ops[:len(step.ops)-1]
+			}
+			return
+		}else if !last.insert && !op.insert && op.offset+len(op.text) == last.offset { // backspace
+			last.text = op.text + last.text
+			last.offset = op.offset
+			return
+		}else if !last.insert && !op.insert && op.offset == last.offset { // delete
+			last.text += op.text
+			return
+		}
+	}
+
+	step.ops = append(step.ops, op)
+}
+
+func collectJournal(edit *Edit) {
+	if len(edit.buffer.journal) == 0 {
+		return
+	}
+
+	if edit.undo_group == nil {
+		edit.undo_group = &UndoStep{cursor_before: edit.undo_cursor, extra_before: edit.undo_extra_cursors}
+	}
+
+	for _, op := range(edit.buffer.journal) {
+		addUndoOp(edit.undo_group, op)
+	}
+	edit.buffer.journal = nil
+
+	edit.undo_group.cursor_after = edit.cursor
+	edit.undo_group.extra_after = slices.Clone(edit.extra_cursors)
+	edit.undo_group.time_taken = time.Now().UnixNano() / 1e6
+}
+
+// called before a key is handled, anything that moved the cursor since the
+// last key (mouse, find) ends the current session
+func syncUndoCursor(edit *Edit) {
+	if CURSOR_KEY_PASS > 0 {
+		return // the key going around the cursors is synced once for all of them
+	}
+
+	if edit.undo_group != nil && edit.cursor != edit.undo_cursor && !UNDO_GROUP_HELD {
+		closeUndoGroup(edit)
+	}
+
+	edit.undo_cursor = edit.cursor
+	edit.undo_extra_cursors = slices.Clone(edit.extra_cursors)
+}
+
+func readyUndoHistory(edit *Edit) {
+	if CURSOR_KEY_PASS > 0 {
+		return
+	}
+
+	had_changes := len(edit.buffer.journal) > 0
+	collectJournal(edit)
+
+	if edit.undo_group != nil && !UNDO_GROUP_HELD && (edit.current_mode != "i" || (!had_changes && edit.cursor != edit.undo_cursor)) {
+		closeUndoGroup(edit)
+	}
+
+	edit.undo_cursor = edit.cursor
+	edit.undo_extra_cursors = slices.Clone(edit.extra_cursors)
+}
+
+func closeUndoGroup(edit *Edit) {
+	collectJournal(edit)
+
+	step := edit.undo_group
+	edit.undo_group = nil
+	edit.undo_cursor = edit.cursor
+	edit.undo_extra_cursors = slices.Clone(edit.extra_cursors)
+
+	if step == nil || len(step.ops) == 0 {
+		return
+	}
+
+	for _, op := range(step.ops) {
+		step.size += len(op.text)+UNDO_OP_OVERHEAD
+	}
+
+	edit.undo_seq ++
+	node := &UndoNode{step: *step, parent: edit.undo_current, seq: edit.undo_seq}
+
+	edit.undo_current.children = append(edit.undo_current.children, node)
+	edit.undo_current.redo_child = node
+	edit.undo_current = node
+	edit.undo_nodes = append(edit.undo_nodes, node)
+	edit.undo_size += step.size
+
+	trimUndoHistory(edit)
+}
+
+func isUndoAncestor(node, of *UndoNode) bool {
+	for n := of; n != nil; n = n.parent {
+		if n == node {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeUndoNode(edit *Edit, node *UndoNode) {
+	edit.undo_size -= node.step.size
+	edit.undo_nodes = slices.DeleteFunc(edit.undo_nodes, func(n *UndoNode) bool { return n == node })
+}
+
+// drops the oldest history until it fits in UNDO_MEMORY_LIMIT_KB. Abandoned
+// branches go leaf by leaf, the path to the current state is shortened from
+// the root, whichever is older goes first.
+func trimUndoHistory(edit *Edit) {
+	limit := UNDO_MEMORY_LIMIT_KB*1024
+
+	for edit.undo_size > limit {
+		var oldest_leaf *UndoNode
+
+		for _, node := range(edit.undo_nodes) {
+			if len(node.children) == 0 && node.parent != nil && !isUndoAncestor(node, edit.undo_current) {
+				oldest_leaf = node
+				break
+			}
+		}
+
+		root := edit.undo_root
+		can_collapse := root != edit.undo_current && len(root.children) == 1 && root.children[0] != edit.undo_current
+
+		if oldest_leaf != nil && (!can_collapse || oldest_leaf.seq < root.children[0].seq) {
+			parent := oldest_leaf.parent
+			parent.children = slices.DeleteFunc(parent.children, func(n *UndoNode) bool { return n == oldest_leaf })
+			if parent.redo_child == oldest_leaf {
+				parent.redo_child = nil
+				if len(parent.children) > 0 {
+					parent.redo_child = parent.children[len(parent.children)-1]
+				}
+			}
+			removeUndoNode(edit, oldest_leaf)
+		}else if can_collapse { // the first step becomes the new starting point
+			new_root := root.children[0]
+			removeUndoNode(edit, root)
+			edit.undo_size -= new_root.step.size
+			new_root.step.size = 0
+			new_root.step.ops = nil
+			new_root.parent = nil
+			edit.undo_root = new_root
+		}else{
+			break
+		}
+	}
+}
+
+func clearUndoHistory(edit *Edit) {
+	edit.undo_root = &UndoNode{step: UndoStep{time_taken: time.Now().UnixNano() / 1e6}}
+	edit.undo_current = edit.undo_root
+	edit.undo_nodes = []*UndoNode{edit.undo_root}
+	edit.undo_seq = 0
+	edit.undo_group = nil
+	edit.undo_size = 0
+	edit.buffer.journal = nil
+	edit.undo_cursor = edit.cursor
+}
+
+func undo(edit *Edit) {
+	closeUndoGroup(edit)
+
+	node := edit.undo_current
+	if node.parent == nil {
+		return
+	}
+
+	for indx := len(node.step.ops)-1; indx >= 0; indx-- {
+		edit.buffer.applyOp(node.step.ops[indx], true)
+	}
+
+	node.parent.redo_child = node
+	edit.undo_current = node.parent
+	edit.cursor = node.step.cursor_before
+	edit.extra_cursors = slices.Clone(node.step.extra_before)
+	edit.undo_cursor = edit.cursor
+	edit.undo_extra_cursors = slices.Clone(edit.extra_cursors)
+}
+
+func redo(edit *Edit) {
+	closeUndoGroup(edit)
+
+	node := edit.undo_current.redo_child
+	if node == nil {
+		return
+	}
+
+	for _, op := range(node.step.ops) {
+		edit.buffer.applyOp(op, false)
+	}
+
+	edit.undo_current = node
+	edit.cursor = node.step.cursor_after
+	edit.extra_cursors = slices.Clone(node.step.extra_after)
+	edit.undo_cursor = edit.cursor
+	edit.undo_extra_cursors = slices.Clone(edit.extra_cursors)
+}
+
+// undoes back to the closest common ancestor then redoes down to target
+func jumpToUndoNode(edit *Edit, target *UndoNode) {
+	closeUndoGroup(edit)
+
+	for !isUndoAncestor(edit.undo_current, target) {
+		undo(edit)
+	}
+
+	chain := []*UndoNode{}
+	for n := target; n != edit.undo_current; n = n.parent {
+		chain = append(chain, n)
+	}
+
+	for indx := len(chain)-1; indx >= 0; indx-- {
+		edit.undo_current.redo_child = chain[indx]
+		redo(edit)
+	}
+}
+
+// steps through every state in the order they were made, across branches
+func undoChronological(edit *Edit, steps int) {
+	closeUndoGroup(edit)
+
+	indx := slices.Index(edit.undo_nodes, edit.undo_current)+steps
+	indx = max(0, min(indx, len(edit.undo_nodes)-1))
+
+	jumpToUndoNode(edit, edit.undo_nodes[indx])
+}
+
+// goes to the newest state made at or before the current state's time plus
+// offset, so -5m is the text as it was five minutes before this state
+func undoTimeTravel(edit *Edit, offset time.Duration) {
+	closeUndoGroup(edit)
+
+	target_time := edit.undo_current.step.time_taken + offset.Milliseconds()
+	target := edit.undo_nodes[0]
+
+	for _, node := range(edit.undo_nodes) {
+		if node.step.time_taken <= target_time {
+			target = node
+		}
+	}
+
+	jumpToUndoNode(edit, target)
+}
+
+// parses things like "-5m", "+30s" or "-3" (steps) from the user
+func continueUndoTimeTravel() {
+	input := strings.ReplaceAll(getPlainText(&INPT_TEXTEDIT), " ", "")
+	if input == "" {
+		return
+	}
+
+	sign := -1
+	if input[0] == '+' {
+		sign = 1
+	}
+	amount := strings.TrimLeft(input, "+-")
+
+	if steps, err := strconv.Atoi(amount); err == nil {
+		undoChronological(&MAIN_TEXTEDIT, sign*steps)
+	}else if duration, err := time.ParseDuration(amount); err == nil {
+		undoTimeTravel(&MAIN_TEXTEDIT, time.Duration(sign)*duration)
+	}else{
+		displayError("Couldn't read \""+input+"\", try -5m, +30s or -3")
+		return
+	}
+
+	showCursor(&MAIN_TEXTEDIT)
+}
+
+func openUndoTimeTravel() {
+	INPUT_MODAL_CALLBACK = continueUndoTimeTravel
+	getTextInput("Travel by? (-5m, +1h, -3)")
+}
+
+var UNDO_TREE_ROWS []*UndoNode
+var UNDO_TREE_START *UndoNode // where the view was opened, esc goes back to it
+
+// how many branches off the first child each node is, in one pass since parents are always older than their children
+func getUndoBranchLevels(edit *Edit) map[*UndoNode]int {
+	levels := map[*UndoNode]int{}
+
+	for _, node := range(edit.undo_nodes) {
+		if node.parent == nil {
+			levels[node] = 0
+		}else if node.parent.children[0] != node {
+			levels[node] = levels[node.parent]+1
+		}else{
+			levels[node] = levels[node.parent]
+		}
+	}
+
+	return levels
+}
+
+func formatAgo(millis int64) string {
+	secs := (time.Now().UnixNano() / 1e6 - millis) / 1000
+
+	if secs < 60 {
+		return strconv.FormatInt(secs, 10)+"s"
+	}else if secs < 60*60 {
+		return strconv.FormatInt(secs/60, 10)+"m"
+	}else if secs < 60*60*24 {
+		return strconv.FormatInt(secs/(60*60), 10)+"h"
+	}
+
+	return strconv.FormatInt(secs/(60*60*24), 10)+"d"
+}
+
+// lists the states newest first, branches indented under where they split off
+func getUndoTreeRows() ([]string, int) {
+	edit := &MAIN_TEXTEDIT
+	UNDO_TREE_ROWS = []*UndoNode{}
+	lines := []string{}
+	selected := 0
+	levels := getUndoBranchLevels(edit)
+
+	for indx := len(edit.undo_nodes)-1; indx >= 0; indx-- {
+		node := edit.undo_nodes[indx]
+
+		marker := "  "
+		if node == edit.undo_current {
+			marker = "> "
+			selected = len(lines)
+		}
+
+		text := strings.Repeat("| ", levels[node]) + marker + "#" + strconv.Itoa(node.seq)
+
+		if node.parent == nil {
+			text += "  start"
+		}else{
+			added, removed := 0, 0
+			for _, op := range(node.step.ops) {
+				if op.insert {
+					added += utf8.RuneCountInString(op.text)
+				}else{
+					removed += utf8.RuneCountInString(op.text)
+				}
+			}
+
+			text += "  " + formatAgo(node.step.time_taken) + " ago  +" + strconv.Itoa(added) + " -" + strconv.Itoa(removed)
+
+			if indx == 0 || edit.undo_nodes[indx-1] != node.parent {
+				text += "  (from #" + strconv.Itoa(node.parent.seq) + ")"
+			}
+		}
+
+		lines = append(lines, text)
+		UNDO_TREE_ROWS = append(UNDO_TREE_ROWS, node)
+	}
+
+	return lines, selected
+}
+
+// moving through the list previews each state in the main edit
+func previewUndoTreeRow(indx int) {
+	jumpToUndoNode(&MAIN_TEXTEDIT, UNDO_TREE_ROWS[indx])
+	showCursor(&MAIN_TEXTEDIT)
+	setPickerRows(getUndoTreeRows())
+}
+
+func cancelUndoTree() {
+	jumpToUndoNode(&MAIN_TEXTEDIT, UNDO_TREE_START)
+	showCursor(&MAIN_TEXTEDIT)
+}
+
+func openUndoTree() {
+	closeUndoGroup(&MAIN_TEXTEDIT)
+	UNDO_TREE_START = MAIN_TEXTEDIT.undo_current
+
+	rows, selected := getUndoTreeRows()
+	showPicker("Undo Tree (enter keeps, esc goes back)", rows, selected)
+
+	PICKER_MOVE_CALLBACK = previewUndoTreeRow
+	PICKER_CANCEL_CALLBACK = cancelUndoTree
+}
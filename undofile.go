@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The undo tree of each file is written to APP_CONFIG_DIR/undo when it is
+// closed, along with a hash of the text it ends on. openFile only reuses it
+// if the file on disk still hashes the same, otherwise the offsets in it would
+// point at the wrong text.
+//
+// Format, one record per line (nodes are written oldest first so a parent is
+// always read before its children):
+//	hash <sha256 of the text at the current node>
+//	current <seq>
+//	node <seq> <parent seq> <time> <redo child seq> <cursor before x5> <cursor after x5>
+//	op <+|-> <offset> <quoted text>
+
+func hashText(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+func getUndoFilePath(path string) string {
+	return filepath.Join(APP_CONFIG_DIR, "undo", hashText(path)[:24]+".cdmg")
+}
+
+func cursorFields(cursor Cursor) string {
+	return strconv.Itoa(cursor.row)+" "+strconv.Itoa(cursor.col)+" "+strconv.Itoa(cursor.row_anchor)+" "+strconv.Itoa(cursor.col_anchor)+" "+strconv.Itoa(cursor.preferencial_col)
+}
+
+func saveUndoHistory() {
+	if absolute_path == "" {
+		return
+	}
+
+	edit := &MAIN_TEXTEDIT
+	closeUndoGroup(edit)
+
+	undo_path := getUndoFilePath(absolute_path)
+
+	if len(edit.undo_nodes) <= 1 {
+		os.Remove(undo_path)
+		return
+	}
+
+	lines := []string{}
+	lines = append(lines, "hash "+hashText(getPlainText(edit)))
+	lines = append(lines, "current "+strconv.Itoa(edit.undo_current.seq))
+
+	for _, node := range(edit.undo_nodes) {
+		parent := -1
+		if node.parent != nil {
+			parent = node.parent.seq
+		}
+		redo_child := -1
+		if node.redo_child != nil {
+			redo_child = node.redo_child.seq
+		}
+
+		lines = append(lines, "node "+strconv.Itoa(node.seq)+" "+strconv.Itoa(parent)+" "+strconv.FormatInt(node.step.time_taken, 10)+" "+strconv.Itoa(redo_child)+" "+cursorFields(node.step.cursor_before)+" "+cursorFields(node.step.cursor_after))
+
+		for _, op := range(node.step.ops) {
+			kind := "-"
+			if op.insert {
+				kind = "+"
+			}
+			lines = append(lines, "op "+kind+" "+strconv.Itoa(op.offset)+" "+strconv.Quote(op.text))
+		}
+	}
+
+	os.MkdirAll(filepath.Dir(undo_path), 0755)
+	os.WriteFile(undo_path, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+func parseInts(fields []string) ([]int, bool) {
+	nums := []int{}
+
+	for _, field := range(fields) {
+		num, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, false
+		}
+		nums = append(nums, num)
+	}
+
+	return nums, true
+}
+
+// loads the saved tree into MAIN_TEXTEDIT if it was saved on this exact text
+func loadUndoHistory(text string) {
+	file, err := os.Open(getUndoFilePath(absolute_path))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<30) // ops can hold whole pastes on one line
+
+	by_seq := map[int]*UndoNode{}
+	redo_children := map[*UndoNode]int{}
+	nodes := []*UndoNode{}
+	current := -1
+	var node *UndoNode
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.SplitN(line, " ", 4)
+
+		if fields[0] == "hash" && len(fields) == 2 {
+			if fields[1] != hashText(text) {
+				return // the file was changed outside of CodeMage since
+			}
+		}else if fields[0] == "current" && len(fields) == 2 {
+			current, err = strconv.Atoi(fields[1])
+			if err != nil {
+				return
+			}
+		}else if fields[0] == "node" {
+			nums, ok := parseInts(strings.Fields(line)[1:])
+			if !ok || len(nums) != 14 {
+				return
+			}
+
+			node = &UndoNode{seq: nums[0]}
+			node.step.time_taken = int64(nums[2])
+			node.step.cursor_before = Cursor{row: nums[4], col: nums[5], row_anchor: nums[6], col_anchor: nums[7], preferencial_col: nums[8]}
+			node.step.cursor_after = Cursor{row: nums[9], col: nums[10], row_anchor: nums[11], col_anchor: nums[12], preferencial_col: nums[13]}
+
+			if parent, ok := by_seq[nums[1]]; ok {
+				node.parent = parent
+				parent.children = append(parent.children, node)
+			}else if len(nodes) > 0 {
+				return
+			}
+
+			redo_children[node] = nums[3]
+			by_seq[node.seq] = node
+			nodes = append(nodes, node)
+		}else if fields[0] == "op" && len(fields) == 4 && node != nil {
+			offset, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return
+			}
+			text, err := strconv.Unquote(fields[3])
+			if err != nil {
+				return
+			}
+
+			node.step.ops = append(node.step.ops, EditOp{insert: fields[1] == "+", offset: offset, text: text})
+			node.step.size += len(text)+UNDO_OP_OVERHEAD
+		}
+	}
+
+	if scanner.Err() != nil || len(nodes) == 0 || by_seq[current] == nil {
+		return
+	}
+
+	edit := &MAIN_TEXTEDIT
+	clearUndoHistory(edit)
+
+	for _, node := range(nodes) {
+		node.redo_child = by_seq[redo_children[node]]
+		edit.undo_size += node.step.size
+		edit.undo_seq = max(edit.undo_seq, node.seq)
+	}
+
+	edit.undo_root = nodes[0]
+	edit.undo_current = by_seq[current]
+	edit.undo_nodes = nodes
+
+	trimUndoHistory(edit)
+}
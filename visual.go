@@ -0,0 +1,352 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Visual modes: v selects by character, V by whole lines and Ctrl+V a block
+// of columns. The mode is kept on the Edit in visual_mode ("v", "V" or "b")
+// while current_mode stays "n", so every motion works as usual and just
+// drags the cursor away from the anchor. An operator acts on the selection
+// and leaves visual mode.
+//
+// In block mode I and A type on every row of the block at once: the text goes
+// in the first row while in insert mode and is copied to the rest on Esc.
+
+var BLOCK_INSERT_EDIT *Edit // set while the text typed in insert mode still has to go on the other rows
+var BLOCK_INSERT_ROW int
+var BLOCK_INSERT_LAST_ROW int
+var BLOCK_INSERT_COL int // display column
+var BLOCK_INSERT_START int // byte column the typing started at in the first row
+var BLOCK_INSERT_PAD bool // A pads rows that are too short, I leaves them alone
+var BLOCK_INSERT_LINE string // the first row before any typing
+var BLOCK_INSERT_LINE_COUNT int
+
+// returns true if the key was taken as a visual mode key
+func visualHandleKey(ev *tcell.EventKey, edit *Edit) bool {
+	if edit.pending_command != "" {
+		return false // the key belongs to the command (fv, dv, ...)
+	}
+
+	key := ev.Rune()
+	if ev.Key() != tcell.KeyRune {
+		key = 0
+	}
+	if ev.Modifiers()&tcell.ModAlt != 0 {
+		return false
+	}
+
+	if key == 'v' || key == 'V' || ev.Key() == tcell.KeyCtrlV {
+		mode := "v"
+		if key == 'V' {
+			mode = "V"
+		}else if ev.Key() == tcell.KeyCtrlV {
+			mode = "b"
+		}
+
+		if edit.visual_mode == mode { // the same key again leaves visual mode
+			exitVisualMode(edit)
+		}else{
+			edit.visual_mode = mode
+		}
+		edit.number_string = ""
+		return true
+	}
+
+	if edit.visual_mode == "" {
+		return false
+	}
+
+	if ev.Key() == tcell.KeyEscape {
+		exitVisualMode(edit)
+		edit.number_string = ""
+		return true
+	}
+
+	if key == 'o' { // to the other end of the selection
+		edit.cursor.row, edit.cursor.row_anchor = edit.cursor.row_anchor, edit.cursor.row
+		edit.cursor.col, edit.cursor.col_anchor = edit.cursor.col_anchor, edit.cursor.col
+		edit.cursor.preferencial_col = getTrueCol(edit.cursor.col, edit.cursor.row, edit)
+		return true
+	}
+
+	if key == 'I' || key == 'A' {
+		if edit.visual_mode == "b" {
+			sr, er, left, right := getBlockBounds(edit)
+			if key == 'I' {
+				startBlockInsert(edit, sr, er, left, false)
+			}else{
+				startBlockInsert(edit, sr, er, right, true)
+			}
+			return true
+		}
+
+		sr, sc, er, ec := getSelectionRange(edit)
+		if edit.visual_mode == "V" {
+			sc = getFirstNonBlank(edit, sr)
+		}
+		edit.visual_mode = ""
+
+		if key == 'I' {
+			moveToTarget(edit, MotionTarget{sr, sc, MOTION_EXCLUSIVE}, false)
+		}else{
+			moveToTarget(edit, MotionTarget{er, ec, MOTION_EXCLUSIVE}, false)
+		}
+		edit.current_mode = "i"
+		edit.number_string = ""
+		return true
+	}
+
+	if ev.Key() == tcell.KeyBackspace || ev.Key() == tcell.KeyBackspace2 || ev.Key() == tcell.KeyDelete {
+		applySelectionOperator(edit, 'd')
+		return true
+	}
+
+	if key == ' ' || key == '\t' || ev.Key() == tcell.KeyEnter || ev.Key() == tcell.KeyTab {
+		return true // these would type over the selection
+	}
+
+	return false
+}
+
+func exitVisualMode(edit *Edit) {
+	setVisualMarks(edit)
+	edit.visual_mode = ""
+	edit.cursor.row_anchor = edit.cursor.row
+	edit.cursor.col_anchor = edit.cursor.col
+}
+
+// runs op over what is selected, leaving visual mode
+func applySelectionOperator(edit *Edit, op rune) {
+	setVisualMarks(edit)
+	mode := edit.visual_mode
+	sr, sc, er, ec := getSelectionRange(edit)
+	edit.visual_mode = ""
+
+	if mode == "b" {
+		applyBlockOperator(edit, op)
+		return
+	}
+
+	applyOperator(edit, op, sr, sc, er, ec, mode == "V")
+}
+
+// the width of the character at col, 1 past the end of the line where the cursor can still sit
+func getCharWidthAt(edit *Edit, row, col int) int {
+	line := edit.buffer.line(row)
+	if col >= len(line) {
+		return 1
+	}
+	return clusterWidth(line[col:nextGrapheme(line, col)])
+}
+
+// the rows of the block and the display columns it covers, left up to right
+func getBlockBounds(edit *Edit) (int, int, int, int) {
+	cursor := edit.cursor
+
+	sr, er := min(cursor.row, cursor.row_anchor), max(cursor.row, cursor.row_anchor)
+
+	anchor_col := getTrueCol(cursor.col_anchor, cursor.row_anchor, edit)
+	cursor_col := getTrueCol(cursor.col, cursor.row, edit)
+
+	left := min(anchor_col, cursor_col)
+	right := max(anchor_col+getCharWidthAt(edit, cursor.row_anchor, cursor.col_anchor), cursor_col+getCharWidthAt(edit, cursor.row, cursor.col))
+
+	return sr, er, left, right
+}
+
+// the byte range of row that falls in the display columns left up to right,
+// taking in the whole of a tab or wide character that is only partly inside
+func getBlockCols(edit *Edit, row, left, right int) (int, int) {
+	line := edit.buffer.line(row)
+
+	start, end := len(line), len(line)
+	width := 0
+
+	for col := 0; col < len(line); {
+		next := nextGrapheme(line, col)
+		char_end := width+clusterWidth(line[col:next])
+
+		if char_end > left && start == len(line) {
+			start = col
+		}
+		if width >= right {
+			end = col
+			break
+		}
+
+		width = char_end
+		col = next
+	}
+
+	return start, max(start, end)
+}
+
+func getBlockText(edit *Edit) string {
+	sr, er, left, right := getBlockBounds(edit)
+
+	lines := []string{}
+	for row := sr; row <= er; row++ {
+		sc, ec := getBlockCols(edit, row, left, right)
+		lines = append(lines, edit.buffer.textRange(row, sc, row, ec))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func applyBlockOperator(edit *Edit, op rune) {
+	sr, er, left, right := getBlockBounds(edit)
+
+	if op == '>' || op == '<' {
+		applyOperator(edit, op, sr, 0, er, 0, true)
+		return
+	}
+
+	storeRegister(Register{text: getBlockText(edit), blockwise: true}, op)
+
+	start_col, _ := getBlockCols(edit, sr, left, right)
+
+	if op != 'y' {
+		for row := sr; row <= er; row++ {
+			sc, ec := getBlockCols(edit, row, left, right)
+			edit.buffer.remove(row, sc, row, ec)
+		}
+	}
+
+	moveToTarget(edit, MotionTarget{sr, start_col, MOTION_EXCLUSIVE}, false)
+
+	if op == 'c' {
+		startBlockInsert(edit, sr, er, left, false)
+	}
+}
+
+// the byte column at display column col of row, padding the row out with
+// spaces to reach it if pad is set. Returns false if the row doesn't reach
+// into the column.
+func getColumnInRow(edit *Edit, row, col int, pad bool) (int, bool) {
+	width := stringWidth(edit.buffer.line(row))
+
+	if width <= col && !pad {
+		return 0, false
+	}else if width < col {
+		edit.buffer.insert(row, edit.buffer.lineLen(row), strings.Repeat(" ", col-width))
+		return edit.buffer.lineLen(row), true
+	}
+
+	return getFalseCol(col, row, edit), true
+}
+
+// starts insert mode at display column col of row sr, what is typed there
+// going in at the same column of every row down to er when insert mode ends
+func startBlockInsert(edit *Edit, sr, er, col int, pad bool) {
+	edit.visual_mode = ""
+
+	byte_col, ok := getColumnInRow(edit, sr, col, pad)
+	if !ok {
+		byte_col = edit.buffer.lineLen(sr)
+	}
+
+	BLOCK_INSERT_EDIT = edit
+	BLOCK_INSERT_ROW = sr
+	BLOCK_INSERT_LAST_ROW = er
+	BLOCK_INSERT_COL = col
+	BLOCK_INSERT_START = byte_col
+	BLOCK_INSERT_PAD = pad
+	BLOCK_INSERT_LINE = edit.buffer.line(sr)
+	BLOCK_INSERT_LINE_COUNT = edit.buffer.lineCount()
+
+	moveToTarget(edit, MotionTarget{sr, byte_col, MOTION_EXCLUSIVE}, false)
+	edit.current_mode = "i"
+	edit.number_string = ""
+}
+
+// copies what was typed on the first row of a block insert to the others,
+// called when insert mode ends. Anything more than text typed in the one
+// row (new lines, edits elsewhere) only stays where it was typed.
+func finishBlockInsert(edit *Edit) {
+	if BLOCK_INSERT_EDIT != edit {
+		return
+	}
+	BLOCK_INSERT_EDIT = nil
+
+	if edit.buffer.lineCount() != BLOCK_INSERT_LINE_COUNT {
+		return
+	}
+
+	before := BLOCK_INSERT_LINE
+	after := edit.buffer.line(BLOCK_INSERT_ROW)
+	added := len(after)-len(before)
+	col := BLOCK_INSERT_START
+
+	if added <= 0 || col+added > len(after) || col > len(before) || after[:col] != before[:col] || after[col+added:] != before[col:] {
+		return
+	}
+	typed := after[col:col+added]
+
+	for row := BLOCK_INSERT_ROW+1; row <= BLOCK_INSERT_LAST_ROW; row++ {
+		byte_col, ok := getColumnInRow(edit, row, BLOCK_INSERT_COL, BLOCK_INSERT_PAD)
+		if ok {
+			edit.buffer.insert(row, byte_col, typed)
+		}
+	}
+}
+
+// puts a yanked block back as columns starting at the cursor, one line of it per row
+func pasteBlock(edit *Edit, text string, after bool, count int) {
+	row := edit.cursor.row
+	col := getTrueCol(edit.cursor.col, row, edit)
+	if after && edit.buffer.lineLen(row) > 0 {
+		col += getCharWidthAt(edit, row, edit.cursor.col)
+	}
+
+	for indx, line := range(strings.Split(text, "\n")) {
+		if row+indx >= edit.buffer.lineCount() {
+			last := edit.buffer.lineCount()-1
+			edit.buffer.insert(last, edit.buffer.lineLen(last), "\n")
+		}
+
+		byte_col, _ := getColumnInRow(edit, row+indx, col, true)
+		edit.buffer.insert(row+indx, byte_col, strings.Repeat(line, count))
+	}
+
+	byte_col, _ := getColumnInRow(edit, row, col, true)
+	moveToTarget(edit, MotionTarget{row, byte_col, MOTION_EXCLUSIVE}, false)
+}
+
+// p on a selection replaces it with what was yanked
+func pasteOverSelection(edit *Edit, count int) {
+	reg := readRegister(CURRENT_REGISTER)
+	text, linewise := reg.text, reg.linewise
+
+	mode := edit.visual_mode
+	sr, sc, er, ec := getSelectionRange(edit)
+	edit.visual_mode = ""
+
+	if mode == "b" {
+		_, _, left, right := getBlockBounds(edit)
+		for row := sr; row <= er; row++ {
+			block_sc, block_ec := getBlockCols(edit, row, left, right)
+			edit.buffer.remove(row, block_sc, row, block_ec)
+		}
+
+		col, _ := getBlockCols(edit, sr, left, right)
+		moveToTarget(edit, MotionTarget{sr, col, MOTION_EXCLUSIVE}, false)
+		pasteText(edit, false, count)
+		return
+	}
+
+	text = strings.Repeat(text, count)
+	if linewise {
+		text = strings.TrimSuffix(text, "\n")
+		if mode != "V" {
+			text = "\n"+text+"\n" // whole lines still go on lines of their own
+		}
+	}
+
+	edit.buffer.remove(sr, sc, er, ec)
+	edit.buffer.insert(sr, sc, text)
+
+	moveToTarget(edit, MotionTarget{sr, sc, MOTION_EXCLUSIVE}, false)
+}